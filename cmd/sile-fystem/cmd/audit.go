@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/JakWai01/sile-fystem/pkg/audit"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	auditLogFlag   = "audit-log"
+	auditChainFlag = "audit-chain"
+)
+
+var errMissingAuditLog = errors.New("missing audit log")
+
+// auditOptions returns the option writing the audit log if one was selected by the global flags.
+// The log stays open for as long as the filesystem is mounted, i.e. until the process exits.
+func auditOptions() ([]filesystem.Option, error) {
+	name := viper.GetString(auditLogFlag)
+	if name == "" {
+		return nil, nil
+	}
+
+	log, err := audit.Open(name, viper.GetBool(auditChainFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	return []filesystem.Option{filesystem.WithAuditLog(log)}, nil
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Inspect audit logs",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify <file>",
+	Short: "Verify that no record of a hash-chained audit log was modified, removed or inserted",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errMissingAuditLog
+		}
+
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		records, err := audit.Verify(file)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Verified %v records\n", records)
+
+		return nil
+	},
+}
+
+func init() {
+	auditCmd.AddCommand(auditVerifyCmd)
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/JakWai01/sile-fystem/pkg/cachefs"
+	"github.com/JakWai01/sile-fystem/pkg/compressfs"
+	"github.com/JakWai01/sile-fystem/pkg/cryptfs"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+const (
+	encryptRecipientFlag = "encrypt-recipient"
+	identityFileFlag     = "identity-file"
+	encryptNamesFlag     = "encrypt-names"
+	compressionFlag      = "compression"
+	compressionSkipFlag  = "compression-skip"
+	cacheDirFlag         = "cache-dir"
+	cacheSizeFlag        = "cache-size"
+	cachePinFlag         = "cache-pin"
+)
+
+// wrapBackend applies the layers selected by the global flags to the backend of a mount.
+func wrapBackend(backend afero.Fs) (afero.Fs, error) {
+	// The disk cache sits right on top of the backend, so that the content
+	// it keeps is encrypted and compressed like the one of the backend.
+	if dir := viper.GetString(cacheDirFlag); dir != "" {
+		cached, err := cachefs.NewFs(backend, cachefs.Config{
+			Dir:  dir,
+			Size: viper.GetInt64(cacheSizeFlag),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := pinPaths(cached, viper.GetStringSlice(cachePinFlag)); err != nil {
+			return nil, err
+		}
+
+		backend = cached
+	}
+
+	if encrypted() {
+		cfg, err := cryptConfig(viper.GetStringSlice(encryptRecipientFlag), viper.GetString(identityFileFlag))
+		if err != nil {
+			return nil, err
+		}
+
+		if backend, err = cryptfs.NewFs(backend, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	// Content has to be compressed before it is encrypted, so the
+	// compression layer sits on top of the encryption layer.
+	if name := viper.GetString(compressionFlag); name != "" {
+		algorithm, err := compressfs.ParseAlgorithm(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if backend, err = compressfs.NewFs(backend, compressfs.Config{
+			Algorithm:      algorithm,
+			SkipExtensions: viper.GetStringSlice(compressionSkipFlag),
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return backend, nil
+}
+
+// wrapsBackend reports whether wrapBackend adds any layers.
+func wrapsBackend() bool {
+	return encrypted() || viper.GetString(compressionFlag) != "" || viper.GetString(cacheDirFlag) != ""
+}
+
+// pinPaths pins exactly the given paths of the disk cache. The content of
+// newly pinned paths is fetched in the background, so that mounting neither
+// waits for it nor fails while the backend can't be reached.
+func pinPaths(cached *cachefs.Fs, paths []string) error {
+	pinned := map[string]bool{}
+	for _, p := range paths {
+		pinned[path.Clean("/"+p)] = true
+	}
+
+	for _, p := range cached.Pins() {
+		if !pinned[p] {
+			if err := cached.Unpin(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	go func() {
+		for p := range pinned {
+			if err := cached.Pin(p); err != nil {
+				log.Printf("Could not fetch pinned path %v: %v", p, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func encrypted() bool {
+	return len(viper.GetStringSlice(encryptRecipientFlag)) > 0 || viper.GetString(identityFileFlag) != ""
+}
+
+func cryptConfig(recipients []string, identityFile string) (cryptfs.Config, error) {
+	cfg := cryptfs.Config{
+		EncryptNames: viper.GetBool(encryptNamesFlag),
+	}
+
+	if identityFile == "" {
+		return cfg, errors.New("encryption requires an identity file to decrypt the master key")
+	}
+
+	f, err := os.Open(identityFile)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	if cfg.Identities, err = age.ParseIdentities(f); err != nil {
+		return cfg, err
+	}
+
+	if len(recipients) > 0 {
+		if cfg.Recipients, err = age.ParseRecipients(strings.NewReader(strings.Join(recipients, "\n"))); err != nil {
+			return cfg, err
+		}
+	} else {
+		for _, identity := range cfg.Identities {
+			if x25519, ok := identity.(*age.X25519Identity); ok {
+				cfg.Recipients = append(cfg.Recipients, x25519.Recipient())
+			}
+		}
+	}
+
+	return cfg, nil
+}
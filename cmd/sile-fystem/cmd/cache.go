@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/JakWai01/sile-fystem/pkg/rules"
+	"github.com/spf13/viper"
+)
+
+const (
+	attrTTLFlag     = "attr-ttl"
+	entryTTLFlag    = "entry-ttl"
+	negativeTTLFlag = "negative-ttl"
+
+	blockCacheFlag       = "block-cache"
+	blockSizeFlag        = "block-size"
+	blockCacheMemoryFlag = "block-cache-memory"
+	readAheadFlag        = "read-ahead"
+
+	directIOFlag      = "direct-io"
+	keepPageCacheFlag = "keep-page-cache"
+)
+
+// cacheTTLs returns the kernel cache TTLs selected by the global flags.
+func cacheTTLs() filesystem.CacheTTL {
+	return filesystem.CacheTTL{
+		Attributes: cacheTTL(viper.GetDuration(attrTTLFlag)),
+		Entries:    cacheTTL(viper.GetDuration(entryTTLFlag)),
+		Negative:   cacheTTL(viper.GetDuration(negativeTTLFlag)),
+	}
+}
+
+// cacheTTL maps negative durations of the flags to caching forever.
+func cacheTTL(ttl time.Duration) time.Duration {
+	if ttl < 0 {
+		return filesystem.Forever
+	}
+
+	return ttl
+}
+
+// blockCacheOptions returns the option caching file content in memory if it was selected by the global flags.
+func blockCacheOptions() []filesystem.Option {
+	if !viper.GetBool(blockCacheFlag) {
+		return nil
+	}
+
+	return []filesystem.Option{filesystem.WithBlockCache(filesystem.BlockCache{
+		BlockSize: viper.GetInt(blockSizeFlag),
+		Memory:    viper.GetInt64(blockCacheMemoryFlag),
+		ReadAhead: viper.GetInt(readAheadFlag),
+	})}
+}
+
+// openPolicyOptions returns the option selecting how the kernel caches opened files if it was selected by the global flags.
+func openPolicyOptions() ([]filesystem.Option, error) {
+	policy := filesystem.OpenPolicy{
+		DirectIO:      viper.GetStringSlice(directIOFlag),
+		KeepPageCache: viper.GetBool(keepPageCacheFlag),
+	}
+
+	for _, pattern := range policy.DirectIO {
+		if _, err := rules.Match(pattern, "/"); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(policy.DirectIO) == 0 && !policy.KeepPageCache {
+		return nil, nil
+	}
+
+	return []filesystem.Option{filesystem.WithOpenPolicy(policy)}, nil
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+
+	"github.com/JakWai01/sile-fystem/pkg/control"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/viper"
+)
+
+const (
+	controlSocketFlag = "control-socket"
+)
+
+// controlSocket returns the control socket of the mount, which defaults to one derived from the mountpoint.
+func controlSocket() string {
+	if socket := viper.GetString(controlSocketFlag); socket != "" {
+		return socket
+	}
+
+	mount, err := filepath.Abs(viper.GetString(mountpoint))
+	if err != nil {
+		mount = viper.GetString(mountpoint)
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(mount))
+
+	return filepath.Join(os.TempDir(), fmt.Sprintf("sile-fystem-%x.sock", h.Sum64()))
+}
+
+// serveControl starts serving the control socket for a filesystem; the returned function stops it.
+func serveControl(server *filesystem.Server) (func(), error) {
+	socket := controlSocket()
+
+	listener, err := control.Listen(socket)
+	if err != nil {
+		return nil, err
+	}
+
+	go control.Serve(listener, server)
+
+	return func() {
+		listener.Close()
+		os.Remove(socket)
+	}, nil
+}
+
+func dialControl() (*control.Client, error) {
+	return control.Dial(controlSocket())
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/dedupfs"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	graceFlag = "grace"
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove chunks which are no longer referenced by any file from a chunk store",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store := viper.GetString(storeFlag)
+		if _, err := os.Stat(store); err != nil {
+			return err
+		}
+
+		backend, err := dedupfs.NewFs(store)
+		if err != nil {
+			return err
+		}
+		defer backend.Close()
+
+		removed, freed, err := backend.GC(viper.GetDuration(graceFlag))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Removed %v chunks, freed %v bytes\n", removed, freed)
+
+		return nil
+	},
+}
+
+func init() {
+	gcCmd.PersistentFlags().Duration(graceFlag, time.Hour, "Keep unreferenced chunks written within this duration, as they may belong to files being written")
+
+	if err := viper.BindPFlags(gcCmd.PersistentFlags()); err != nil {
+		log.Fatal("could not bind flags:", err)
+	}
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+)
+
+var errMissingPath = errors.New("missing path")
+
+var invalidateCmd = &cobra.Command{
+	Use:   "invalidate <path>...",
+	Short: "Make a mount pick up changes made to its backend without going through it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errMissingPath
+		}
+
+		client, err := dialControl()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		for _, p := range args {
+			if err := client.Invalidate(p); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/dedupfs"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	storeFlag = "store"
+)
+
+var dedupCmd = &cobra.Command{
+	Use:   "dedup",
+	Short: "Mount a folder on a given path using a deduplicating chunk store as backend",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := logging.NewJSONLogger(5)
+
+		backend, err := dedupfs.NewFs(viper.GetString(storeFlag))
+		if err != nil {
+			return err
+		}
+		defer backend.Close()
+
+		wrapped, err := wrapBackend(backend)
+		if err != nil {
+			return err
+		}
+
+		options, err := serverOptions(logger, "")
+		if err != nil {
+			return err
+		}
+
+		serve := filesystem.New(viper.GetString(mountpoint), wrapped, options...)
+
+		if err := configureServer(serve); err != nil {
+			return err
+		}
+
+		stopControl, err := serveControl(serve)
+		if err != nil {
+			return err
+		}
+		defer stopControl()
+
+		mfs, err := serve.Mount(context.Background())
+		if err != nil {
+			log.Fatalf("Mount: %v", err)
+		}
+
+		if err := mfs.Wait(); err != nil {
+			log.Fatalf("Join %v", err)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	dedupCmd.PersistentFlags().String(storeFlag, filepath.Join(os.TempDir(), "sile-fystem-dedup"), "Directory holding the chunks and the metadata database")
+
+	if err := viper.BindPFlags(dedupCmd.PersistentFlags()); err != nil {
+		log.Fatal("could not bind flags:", err)
+	}
+	viper.SetEnvPrefix("sile-fystem")
+	viper.AutomaticEnv()
+
+	dedupCmd.AddCommand(gcCmd)
+}
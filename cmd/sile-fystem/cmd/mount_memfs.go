@@ -4,47 +4,121 @@ import (
 	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/JakWai01/sile-fystem/internal/logging"
 	"github.com/JakWai01/sile-fystem/pkg/filesystem"
-	"github.com/JakWai01/sile-fystem/pkg/posix"
-	"github.com/jacobsa/fuse"
-	"github.com/spf13/afero"
+	"github.com/JakWai01/sile-fystem/pkg/memfs"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+var (
+	snapshotFileFlag     = "snapshot-file"
+	autosaveIntervalFlag = "autosave-interval"
+	maxBytesFlag         = "max-bytes"
+	maxInodesFlag        = "max-inodes"
+	spillDirFlag         = "spill-dir"
+)
+
 var memFsCmd = &cobra.Command{
 	Use:   "memfs",
 	Short: "Mount a folder on a given path using afero.MemMapFs as backend",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		logger := logging.NewJSONLogger(5)
 
-		os.MkdirAll(viper.GetString(mountpoint), os.ModePerm)
+		backend, err := memfs.NewLimitedFs(memfs.Limits{
+			MaxBytes:  viper.GetInt64(maxBytesFlag),
+			MaxInodes: viper.GetInt64(maxInodesFlag),
+			SpillDir:  viper.GetString(spillDirFlag),
+		})
+		if err != nil {
+			return err
+		}
+		defer backend.Close()
+
+		snapshotFile := viper.GetString(snapshotFileFlag)
+		if snapshotFile != "" {
+			if err := memfs.Load(backend, snapshotFile); err != nil {
+				return err
+			}
+		}
+
+		wrapped, err := wrapBackend(backend)
+		if err != nil {
+			return err
+		}
+
+		options, err := serverOptions(logger, "")
+		if err != nil {
+			return err
+		}
+
+		serve := filesystem.New(viper.GetString(mountpoint), wrapped, options...)
 
-		serve := filesystem.NewFileSystem(posix.CurrentUid(), posix.CurrentGid(), viper.GetString(mountpoint), "", logger, afero.NewMemMapFs(), false)
+		if err := configureServer(serve); err != nil {
+			return err
+		}
 
-		cfg := &fuse.MountConfig{
-			ReadOnly:                  false,
-			DisableDefaultPermissions: false,
+		stopControl, err := serveControl(serve)
+		if err != nil {
+			return err
 		}
+		defer stopControl()
 
-		fuse.Unmount(viper.GetString(mountpoint))
-		mfs, err := fuse.Mount(viper.GetString(mountpoint), serve, cfg)
+		mfs, err := serve.Mount(context.Background())
 		if err != nil {
 			log.Fatalf("Mount: %v", err)
 		}
 
-		if err := mfs.Join(context.Background()); err != nil {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+
+			if err := mfs.Unmount(); err != nil {
+				logger.Error("Unmount", map[string]interface{}{
+					"err": err,
+				})
+			}
+		}()
+
+		if interval := viper.GetDuration(autosaveIntervalFlag); snapshotFile != "" && interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			go func() {
+				for range ticker.C {
+					if err := memfs.Save(backend, snapshotFile); err != nil {
+						logger.Error("Autosave", map[string]interface{}{
+							"err": err,
+						})
+					}
+				}
+			}()
+		}
+
+		if err := mfs.Wait(); err != nil {
 			log.Fatalf("Join %v", err)
 		}
 
+		if snapshotFile != "" {
+			return memfs.Save(backend, snapshotFile)
+		}
+
 		return nil
 	},
 }
 
 func init() {
 	memFsCmd.PersistentFlags().String(mountpoint, "", "mount")
+	memFsCmd.PersistentFlags().String(snapshotFileFlag, "", "File to restore the filesystem from on startup and to save it to on unmount")
+	memFsCmd.PersistentFlags().Duration(autosaveIntervalFlag, 0, "Interval in which the filesystem is saved to the snapshot file (0 disables autosaving)")
+	memFsCmd.PersistentFlags().Int64(maxBytesFlag, 0, "Maximum amount of file content in bytes kept in memory (0 is unlimited)")
+	memFsCmd.PersistentFlags().Int64(maxInodesFlag, 0, "Maximum number of files, directories and symlinks (0 is unlimited)")
+	memFsCmd.PersistentFlags().String(spillDirFlag, "", "Directory to move the content of cold files to once the memory limit is reached")
 
 	if err := viper.BindPFlags(memFsCmd.PersistentFlags()); err != nil {
 		log.Fatal("could not bind flags:", err)
@@ -2,14 +2,12 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
-	"path/filepath"
 
 	"github.com/JakWai01/sile-fystem/internal/logging"
 	"github.com/JakWai01/sile-fystem/pkg/filesystem"
-	"github.com/JakWai01/sile-fystem/pkg/posix"
-	"github.com/jacobsa/fuse"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -17,8 +15,11 @@ import (
 
 var (
 	storageFlag = "storage"
+	watchFlag   = "watch"
 )
 
+var errWatchEncryptedNames = errors.New("can't watch the storage folder if names are encrypted")
+
 var osFsCmd = &cobra.Command{
 	Use:   "osfs",
 	Short: "Mount a folder on a given path using afero.OsFs as backend",
@@ -26,22 +27,47 @@ var osFsCmd = &cobra.Command{
 		logger := logging.NewJSONLogger(5)
 
 		os.MkdirAll(viper.GetString(storageFlag), os.ModePerm)
-		os.MkdirAll(viper.GetString(mountpoint), os.ModePerm)
 
-		serve := filesystem.NewFileSystem(posix.CurrentUid(), posix.CurrentGid(), viper.GetString(mountpoint), viper.GetString(storageFlag), logger, afero.NewOsFs(), false)
+		backend, root, err := storageBackend()
+		if err != nil {
+			return err
+		}
+
+		options, err := serverOptions(logger, root)
+		if err != nil {
+			return err
+		}
+
+		serve := filesystem.New(viper.GetString(mountpoint), backend, options...)
+
+		if err := configureServer(serve); err != nil {
+			return err
+		}
+
+		if viper.GetBool(watchFlag) {
+			if viper.GetBool(encryptNamesFlag) {
+				return errWatchEncryptedNames
+			}
+
+			watcher, err := serve.WatchDir(viper.GetString(storageFlag))
+			if err != nil {
+				return err
+			}
+			defer watcher.Close()
+		}
 
-		cfg := &fuse.MountConfig{
-			ReadOnly:                  false,
-			DisableDefaultPermissions: false,
+		stopControl, err := serveControl(serve)
+		if err != nil {
+			return err
 		}
+		defer stopControl()
 
-		fuse.Unmount(viper.GetString(mountpoint))
-		mfs, err := fuse.Mount(viper.GetString(mountpoint), serve, cfg)
+		mfs, err := serve.Mount(context.Background())
 		if err != nil {
 			log.Fatalf("Mount: %v", err)
 		}
 
-		if err := mfs.Join(context.Background()); err != nil {
+		if err := mfs.Wait(); err != nil {
 			log.Fatalf("Join %v", err)
 		}
 
@@ -50,7 +76,7 @@ var osFsCmd = &cobra.Command{
 }
 
 func init() {
-	osFsCmd.PersistentFlags().String(storageFlag, filepath.Join(os.TempDir(), "drive"), "Declare folder where data is stored")
+	osFsCmd.PersistentFlags().Bool(watchFlag, false, "Reflect changes made to the storage folder by other processes in the mount")
 
 	if err := viper.BindPFlags(osFsCmd.PersistentFlags()); err != nil {
 		log.Fatal("could not bind flags:", err)
@@ -58,3 +84,52 @@ func init() {
 	viper.SetEnvPrefix("sile-fystem")
 	viper.AutomaticEnv()
 }
+
+// storageBackend returns the backend for the storage folder with the layers
+// selected by the global flags applied, and the root of the files in it.
+func storageBackend() (afero.Fs, string, error) {
+	var backend afero.Fs = afero.NewOsFs()
+	root := viper.GetString(storageFlag)
+	if wrapsBackend() {
+		// Layers see paths relative to the storage folder, so that e.g.
+		// encrypted names don't include the path of the folder itself.
+		backend = storageFs{afero.NewBasePathFs(backend, root).(*afero.BasePathFs)}
+		root = "/"
+	}
+
+	backend, err := wrapBackend(backend)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return backend, root, nil
+}
+
+// storageFs is the storage folder, whose directories are synced and files
+// are linked in the filesystem of the OS.
+type storageFs struct {
+	*afero.BasePathFs
+}
+
+func (fs storageFs) SyncDir(name string) error {
+	real, err := fs.RealPath(name)
+	if err != nil {
+		return err
+	}
+
+	return filesystem.SyncDir(afero.NewOsFs(), real)
+}
+
+func (fs storageFs) Link(oldname string, newname string) error {
+	oldReal, err := fs.RealPath(oldname)
+	if err != nil {
+		return err
+	}
+
+	newReal, err := fs.RealPath(newname)
+	if err != nil {
+		return err
+	}
+
+	return os.Link(oldReal, newReal)
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/JakWai01/sile-fystem/pkg/s3fs"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	endpointFlag  = "endpoint"
+	regionFlag    = "region"
+	bucketFlag    = "bucket"
+	accessKeyFlag = "access-key"
+	secretKeyFlag = "secret-key"
+	partSizeFlag  = "part-size"
+)
+
+var s3Cmd = &cobra.Command{
+	Use:   "s3",
+	Short: "Mount a folder on a given path using an S3-compatible bucket as backend",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := logging.NewJSONLogger(5)
+
+		backend, err := s3fs.NewFs(s3fs.Config{
+			Endpoint:  viper.GetString(endpointFlag),
+			Region:    viper.GetString(regionFlag),
+			Bucket:    viper.GetString(bucketFlag),
+			AccessKey: viper.GetString(accessKeyFlag),
+			SecretKey: viper.GetString(secretKeyFlag),
+			PartSize:  viper.GetInt64(partSizeFlag),
+		})
+		if err != nil {
+			return err
+		}
+
+		wrapped, err := wrapBackend(backend)
+		if err != nil {
+			return err
+		}
+
+		options, err := serverOptions(logger, "")
+		if err != nil {
+			return err
+		}
+
+		serve := filesystem.New(viper.GetString(mountpoint), wrapped, options...)
+
+		if err := configureServer(serve); err != nil {
+			return err
+		}
+
+		stopControl, err := serveControl(serve)
+		if err != nil {
+			return err
+		}
+		defer stopControl()
+
+		mfs, err := serve.Mount(context.Background())
+		if err != nil {
+			log.Fatalf("Mount: %v", err)
+		}
+
+		if err := mfs.Wait(); err != nil {
+			log.Fatalf("Join %v", err)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	s3Cmd.PersistentFlags().String(endpointFlag, "http://localhost:9000", "Endpoint of the S3-compatible object store")
+	s3Cmd.PersistentFlags().String(regionFlag, "us-east-1", "Region of the bucket")
+	s3Cmd.PersistentFlags().String(bucketFlag, "", "Bucket to mount")
+	s3Cmd.PersistentFlags().String(accessKeyFlag, os.Getenv("AWS_ACCESS_KEY_ID"), "Access key used to sign requests")
+	s3Cmd.PersistentFlags().String(secretKeyFlag, os.Getenv("AWS_SECRET_ACCESS_KEY"), "Secret key used to sign requests")
+	s3Cmd.PersistentFlags().Int64(partSizeFlag, 16*1024*1024, "Size of the parts used for multipart uploads")
+
+	if err := viper.BindPFlags(s3Cmd.PersistentFlags()); err != nil {
+		log.Fatal("could not bind flags:", err)
+	}
+	viper.SetEnvPrefix("sile-fystem")
+	viper.AutomaticEnv()
+}
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/JakWai01/sile-fystem/pkg/posix"
+	"github.com/JakWai01/sile-fystem/pkg/quota"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	quotaDBFlag     = "quota-db"
+	quotaUidFlag    = "quota-uid"
+	quotaDirFlag    = "quota-dir"
+	quotaBytesFlag  = "quota-bytes"
+	quotaInodesFlag = "quota-inodes"
+)
+
+// noQuotaUid is the default of the uid flag, as 0 is a valid uid.
+const noQuotaUid = -1
+
+var (
+	errMissingQuotaDB     = errors.New("missing quota database")
+	errMissingQuotaTarget = errors.New("either a uid or a directory is required")
+)
+
+// quotaOptions returns the option enforcing quotas if a quota database was selected by the global flags.
+func quotaOptions() ([]filesystem.Option, error) {
+	if viper.GetString(quotaDBFlag) == "" {
+		return nil, nil
+	}
+
+	q, err := openQuotas()
+	if err != nil {
+		return nil, err
+	}
+
+	return []filesystem.Option{filesystem.WithQuotas(q)}, nil
+}
+
+func openQuotas() (*quota.Quotas, error) {
+	name := viper.GetString(quotaDBFlag)
+	if name == "" {
+		return nil, errMissingQuotaDB
+	}
+
+	return quota.Open(name)
+}
+
+var quotaCmd = &cobra.Command{
+	Use:   "quota",
+	Short: "Manage the quotas of a storage folder",
+}
+
+var quotaSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Set the quota of a user or directory (zero limits remove it)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		q, err := openQuotas()
+		if err != nil {
+			return err
+		}
+		defer q.Close()
+
+		limit := quota.Limit{
+			Bytes:  viper.GetInt64(quotaBytesFlag),
+			Inodes: viper.GetInt64(quotaInodesFlag),
+		}
+
+		if dir := viper.GetString(quotaDirFlag); dir != "" {
+			return q.SetDirLimit(dir, limit)
+		}
+
+		uid := viper.GetInt64(quotaUidFlag)
+		if uid == noQuotaUid {
+			return errMissingQuotaTarget
+		}
+
+		return q.SetUserLimit(uint32(uid), limit)
+	},
+}
+
+var quotaListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the quotas and their usage",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		q, err := openQuotas()
+		if err != nil {
+			return err
+		}
+		defer q.Close()
+
+		for _, entry := range q.List() {
+			owner := entry.Dir
+			if owner == "" {
+				owner = fmt.Sprintf("uid %v", entry.Uid)
+			}
+
+			fmt.Printf("%v\t%v/%v bytes\t%v/%v inodes\n", owner, entry.Usage.Bytes, entry.Limit.Bytes, entry.Usage.Inodes, entry.Limit.Inodes)
+		}
+
+		return nil
+	},
+}
+
+var quotaRebuildCmd = &cobra.Command{
+	Use:   "rebuild",
+	Short: "Recompute the usage of the quotas from the storage folder while it isn't mounted",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		q, err := openQuotas()
+		if err != nil {
+			return err
+		}
+		defer q.Close()
+
+		backend, root, err := storageBackend()
+		if err != nil {
+			return err
+		}
+
+		return filesystem.RebuildQuotas(q, backend, root, posix.CurrentUid())
+	},
+}
+
+func init() {
+	quotaSetCmd.PersistentFlags().Int64(quotaUidFlag, noQuotaUid, "User to set the quota of")
+	quotaSetCmd.PersistentFlags().String(quotaDirFlag, "", "Directory of the mount to set the quota of, e.g. /projects")
+	quotaSetCmd.PersistentFlags().Int64(quotaBytesFlag, 0, "Maximum bytes (0 is unlimited)")
+	quotaSetCmd.PersistentFlags().Int64(quotaInodesFlag, 0, "Maximum files, directories and other inodes (0 is unlimited)")
+
+	if err := viper.BindPFlags(quotaSetCmd.PersistentFlags()); err != nil {
+		log.Fatal("could not bind flags:", err)
+	}
+
+	quotaCmd.AddCommand(quotaSetCmd)
+	quotaCmd.AddCommand(quotaListCmd)
+	quotaCmd.AddCommand(quotaRebuildCmd)
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/JakWai01/sile-fystem/pkg/compressfs"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -44,6 +47,35 @@ func Execute() error {
 	os.MkdirAll(mountPath, os.ModePerm)
 
 	rootCmd.PersistentFlags().String(mountpoint, mountPath, "Mountpoint")
+	rootCmd.PersistentFlags().String(storageFlag, filepath.Join(os.TempDir(), "drive"), "Declare folder where data is stored")
+	rootCmd.PersistentFlags().StringSlice(encryptRecipientFlag, []string{}, "age recipient to encrypt the master key to when creating it (can be specified multiple times; defaults to the recipients of the identity file)")
+	rootCmd.PersistentFlags().String(identityFileFlag, "", "age identity file used to decrypt the master key; enables at-rest encryption")
+	rootCmd.PersistentFlags().Bool(encryptNamesFlag, false, "Encrypt file and directory names in addition to their content")
+	rootCmd.PersistentFlags().String(compressionFlag, "", "Compress file content with the given algorithm (zstd, lz4 or gzip; disabled if empty)")
+	rootCmd.PersistentFlags().StringSlice(compressionSkipFlag, compressfs.DefaultSkipExtensions, "Extensions of files to store uncompressed")
+	rootCmd.PersistentFlags().String(cacheDirFlag, "", "Directory to keep a copy of the files read from the backend in across remounts (disabled if empty)")
+	rootCmd.PersistentFlags().Int64(cacheSizeFlag, 1<<30, "Maximum size of the content in the cache directory in bytes, evicting the least recently used files first (0 is unlimited)")
+	rootCmd.PersistentFlags().StringSlice(cachePinFlag, []string{}, "Path of the mount to keep in the cache directory and available while the backend can't be reached (can be specified multiple times)")
+	rootCmd.PersistentFlags().Bool(versioningFlag, false, "Keep the previous content of files opened for writing as versions under .versions")
+	rootCmd.PersistentFlags().Int(versionsKeepFlag, 10, "Maximum number of versions kept per file (0 is unlimited)")
+	rootCmd.PersistentFlags().Duration(versionsMaxAgeFlag, 0, "Maximum age of versions kept (0 is unlimited)")
+	rootCmd.PersistentFlags().Bool(trashFlag, false, "Move deleted files and directories into the trash instead of removing them")
+	rootCmd.PersistentFlags().Duration(trashMaxAgeFlag, 30*24*time.Hour, "Remove entries from the trash after this duration (0 keeps them forever)")
+	rootCmd.PersistentFlags().Bool(journalFlag, false, "Record the intent of metadata operations, so that operations interrupted by a crash are recovered on the next mount")
+	rootCmd.PersistentFlags().Duration(attrTTLFlag, filesystem.DefaultCacheTTL.Attributes, "How long the kernel caches the attributes of files (0 disables caching, negative caches forever)")
+	rootCmd.PersistentFlags().Duration(entryTTLFlag, filesystem.DefaultCacheTTL.Entries, "How long the kernel caches the names of directories (0 disables caching, negative caches forever)")
+	rootCmd.PersistentFlags().Duration(negativeTTLFlag, filesystem.DefaultCacheTTL.Negative, "How long the kernel caches that names don't exist (0 disables caching, negative caches forever)")
+	rootCmd.PersistentFlags().String(auditLogFlag, "", "Append a record of every operation changing the filesystem to this file (disabled if empty)")
+	rootCmd.PersistentFlags().Bool(auditChainFlag, false, "Chain the records of the audit log by their hashes, so that modifications can be detected with audit verify")
+	rootCmd.PersistentFlags().String(rulesFlag, "", "File with rules allowing, denying or making read-only paths of the mount, optionally per uid or gid (disabled if empty)")
+	rootCmd.PersistentFlags().String(quotaDBFlag, "", "Database tracking the usage of the quotas of users and directories, which are enforced if set (disabled if empty)")
+	rootCmd.PersistentFlags().Bool(blockCacheFlag, false, "Cache file content in memory, reading ahead of sequential reads and writing back when files are flushed")
+	rootCmd.PersistentFlags().Int(blockSizeFlag, filesystem.DefaultBlockCache.BlockSize, "Size of the blocks of the block cache in bytes")
+	rootCmd.PersistentFlags().Int64(blockCacheMemoryFlag, filesystem.DefaultBlockCache.Memory, "Memory used by the block cache in bytes")
+	rootCmd.PersistentFlags().Int(readAheadFlag, filesystem.DefaultBlockCache.ReadAhead, "Blocks read ahead of sequential reads (negative disables read-ahead)")
+	rootCmd.PersistentFlags().StringSlice(directIOFlag, []string{}, "Pattern of paths of the mount to read and write bypassing the page cache, e.g. /logs/** (can be specified multiple times)")
+	rootCmd.PersistentFlags().Bool(keepPageCacheFlag, false, "Keep the page cache of files across opens as long as their modification time and size don't change")
+	rootCmd.PersistentFlags().String(controlSocketFlag, "", "Unix socket to manage the mount through, e.g. to take snapshots (defaults to one derived from the mountpoint)")
 
 	if err := viper.BindPFlags(rootCmd.PersistentFlags()); err != nil {
 		return err
@@ -57,4 +89,11 @@ func Execute() error {
 func init() {
 	rootCmd.AddCommand(memFsCmd)
 	rootCmd.AddCommand(osFsCmd)
+	rootCmd.AddCommand(s3Cmd)
+	rootCmd.AddCommand(dedupCmd)
+	rootCmd.AddCommand(snapshotCmd)
+	rootCmd.AddCommand(trashCmd)
+	rootCmd.AddCommand(invalidateCmd)
+	rootCmd.AddCommand(auditCmd)
+	rootCmd.AddCommand(quotaCmd)
 }
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/JakWai01/sile-fystem/pkg/rules"
+	"github.com/spf13/viper"
+)
+
+const (
+	rulesFlag = "rules"
+)
+
+// rulesOptions returns the option restricting access to the mount if a rules file was selected by the global flags.
+func rulesOptions() ([]filesystem.Option, error) {
+	name := viper.GetString(rulesFlag)
+	if name == "" {
+		return nil, nil
+	}
+
+	r, err := rules.Load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return []filesystem.Option{filesystem.WithRules(r)}, nil
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/JakWai01/sile-fystem/pkg/logging"
+	"github.com/JakWai01/sile-fystem/pkg/posix"
+	"github.com/spf13/viper"
+)
+
+const (
+	journalFlag = "journal"
+)
+
+// serverOptions returns the options of a filesystem serving root, including those selected by the global flags.
+func serverOptions(logger logging.StructuredLogger, root string) ([]filesystem.Option, error) {
+	options := []filesystem.Option{
+		filesystem.WithOwner(posix.CurrentUid(), posix.CurrentGid()),
+		filesystem.WithRoot(root),
+		filesystem.WithLogger(logger),
+		filesystem.WithCacheTTL(cacheTTLs()),
+	}
+	options = append(options, blockCacheOptions()...)
+
+	openPolicy, err := openPolicyOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	audit, err := auditOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := rulesOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	quotas, err := quotaOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	options = append(options, openPolicy...)
+	options = append(options, audit...)
+	options = append(options, rules...)
+
+	return append(options, quotas...), nil
+}
+
+// configureServer applies the features selected by the global flags to a filesystem before it is mounted.
+func configureServer(server *filesystem.Server) error {
+	if viper.GetBool(journalFlag) {
+		if err := server.EnableJournal(); err != nil {
+			return err
+		}
+	}
+
+	configureVersioning(server)
+
+	return configureTrash(server)
+}
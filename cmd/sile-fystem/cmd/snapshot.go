@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var errMissingSnapshotName = errors.New("missing snapshot name")
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage the snapshots of a mounted filesystem, which are exposed under .snapshots",
+	Long: `Manage the snapshots of a mounted filesystem, which are exposed under .snapshots.
+
+Snapshots only last as long as the mount: the content kept for them is
+deleted when the storage is mounted again.`,
+}
+
+var snapshotCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Freeze the current state of the mounted filesystem",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errMissingSnapshotName
+		}
+
+		client, err := dialControl()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		return client.CreateSnapshot(args[0])
+	},
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the snapshots of the mounted filesystem",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := dialControl()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		infos, err := client.ListSnapshots()
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			fmt.Printf("%v\t%v\n", info.Name, info.Created.Format(time.RFC3339))
+		}
+
+		return nil
+	},
+}
+
+var snapshotDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a snapshot of the mounted filesystem",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errMissingSnapshotName
+		}
+
+		client, err := dialControl()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		return client.DeleteSnapshot(args[0])
+	},
+}
+
+func init() {
+	snapshotCmd.AddCommand(snapshotCreateCmd)
+	snapshotCmd.AddCommand(snapshotListCmd)
+	snapshotCmd.AddCommand(snapshotDeleteCmd)
+}
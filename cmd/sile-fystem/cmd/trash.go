@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/JakWai01/sile-fystem/pkg/trash"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	trashFlag       = "trash"
+	trashMaxAgeFlag = "trash-max-age"
+	olderThanFlag   = "older-than"
+)
+
+var errMissingTrashID = errors.New("missing trash entry ID")
+
+// configureTrash enables the trash if it was selected by the global flags.
+func configureTrash(server *filesystem.Server) error {
+	if !viper.GetBool(trashFlag) {
+		return nil
+	}
+
+	return server.EnableTrash(viper.GetDuration(trashMaxAgeFlag))
+}
+
+// openTrash opens the trash of the storage folder, which must not be mounted.
+func openTrash() (*trash.Trash, error) {
+	backend, root, err := storageBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	return trash.New(backend, root), nil
+}
+
+var trashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "Manage the trash of a storage folder while it isn't mounted",
+}
+
+var trashListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the deleted files and directories",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		t, err := openTrash()
+		if err != nil {
+			return err
+		}
+
+		entries, err := t.List()
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			fmt.Printf("%v\t%v\t%v\n", entry.ID, entry.Deleted.Format(time.RFC3339), entry.Path)
+		}
+
+		return nil
+	},
+}
+
+var trashRestoreCmd = &cobra.Command{
+	Use:   "restore <id>",
+	Short: "Move a deleted file or directory back to its original path",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errMissingTrashID
+		}
+
+		t, err := openTrash()
+		if err != nil {
+			return err
+		}
+
+		return t.Restore(args[0])
+	},
+}
+
+var trashEmptyCmd = &cobra.Command{
+	Use:   "empty",
+	Short: "Remove deleted files and directories for good",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		t, err := openTrash()
+		if err != nil {
+			return err
+		}
+
+		removed, err := t.Empty(time.Now().Add(-viper.GetDuration(olderThanFlag)))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Removed %v entries\n", removed)
+
+		return nil
+	},
+}
+
+func init() {
+	trashEmptyCmd.PersistentFlags().Duration(olderThanFlag, 0, "Only remove entries deleted longer ago than this duration")
+
+	if err := viper.BindPFlags(trashEmptyCmd.PersistentFlags()); err != nil {
+		log.Fatal("could not bind flags:", err)
+	}
+
+	trashCmd.AddCommand(trashListCmd)
+	trashCmd.AddCommand(trashRestoreCmd)
+	trashCmd.AddCommand(trashEmptyCmd)
+}
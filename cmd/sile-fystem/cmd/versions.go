@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/viper"
+)
+
+const (
+	versioningFlag     = "versioning"
+	versionsKeepFlag   = "versions-keep"
+	versionsMaxAgeFlag = "versions-max-age"
+)
+
+// configureVersioning enables the version history of files if it was selected by the global flags.
+func configureVersioning(server *filesystem.Server) {
+	if !viper.GetBool(versioningFlag) {
+		return
+	}
+
+	server.EnableVersioning(filesystem.Retention{
+		Count:  viper.GetInt(versionsKeepFlag),
+		MaxAge: viper.GetDuration(versionsMaxAgeFlag),
+	})
+}
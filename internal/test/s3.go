@@ -0,0 +1,384 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeS3 is an in-process stand-in for an S3-compatible object store.
+// It implements the subset of the API used by s3fs and does not verify
+// request signatures.
+type FakeS3 struct {
+	Bucket string
+
+	// MultipartUploads counts the multipart uploads completed so far.
+	MultipartUploads int
+
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	uploads map[string]*fakeUpload
+	nextID  int
+
+	streaming bool
+}
+
+type fakeObject struct {
+	data     []byte
+	meta     http.Header
+	modified time.Time
+}
+
+type fakeUpload struct {
+	key   string
+	meta  http.Header
+	parts map[int][]byte
+}
+
+type fakeListResult struct {
+	XMLName               xml.Name           `xml:"ListBucketResult"`
+	Contents              []fakeListContent  `xml:"Contents"`
+	CommonPrefixes        []fakeCommonPrefix `xml:"CommonPrefixes"`
+	IsTruncated           bool               `xml:"IsTruncated"`
+	NextContinuationToken string             `xml:"NextContinuationToken,omitempty"`
+}
+
+type fakeListContent struct {
+	Key          string `xml:"Key"`
+	Size         int64  `xml:"Size"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+}
+
+type fakeCommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type fakeCompleteUpload struct {
+	Parts []struct {
+		PartNumber int `xml:"PartNumber"`
+	} `xml:"Part"`
+}
+
+func NewFakeS3(bucket string) *FakeS3 {
+	return &FakeS3{
+		Bucket:  bucket,
+		objects: make(map[string]*fakeObject),
+		uploads: make(map[string]*fakeUpload),
+	}
+}
+
+// SetStreaming omits the length of objects in HEAD responses, like gateways
+// streaming objects from elsewhere.
+func (s *FakeS3) SetStreaming(streaming bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.streaming = streaming
+}
+
+func (s *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if segments[0] != s.Bucket {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	key := ""
+	if len(segments) > 1 {
+		key = segments[1]
+	}
+
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		s.list(w, query)
+	case r.Method == http.MethodHead:
+		s.head(w, key)
+	case r.Method == http.MethodGet:
+		s.get(w, r, key)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		s.uploadPart(w, r, query)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copy(w, r, key)
+	case r.Method == http.MethodPut:
+		s.put(w, r, key)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createUpload(w, r, key)
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		s.completeUpload(w, r, key, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+func (s *FakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	token := query.Get("continuation-token")
+
+	max := 1000
+	if m, err := strconv.Atoi(query.Get("max-keys")); err == nil {
+		max = m
+	}
+
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := fakeListResult{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= token {
+			continue
+		}
+
+		if len(result.Contents)+len(result.CommonPrefixes) >= max {
+			result.IsTruncated = true
+			break
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, fakeCommonPrefix{Prefix: common})
+				}
+
+				result.NextContinuationToken = common + "\xff"
+				continue
+			}
+		}
+
+		result.Contents = append(result.Contents, fakeListContent{
+			Key:          key,
+			Size:         int64(len(s.objects[key].data)),
+			LastModified: s.objects[key].modified.Format(time.RFC3339),
+			ETag:         etag(s.objects[key].data),
+		})
+		result.NextContinuationToken = key
+	}
+
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+
+	writeXML(w, result)
+}
+
+func (s *FakeS3) head(w http.ResponseWriter, key string) {
+	object, ok := s.objects[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeObjectHeader(w, object)
+	if !s.streaming {
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FakeS3) get(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := s.objects[key]
+	if !ok {
+		http.Error(w, "NoSuchKey", http.StatusNotFound)
+		return
+	}
+
+	data := object.data
+	status := http.StatusOK
+
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || start >= len(data) {
+			http.Error(w, "InvalidRange", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+
+	writeObjectHeader(w, object)
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (s *FakeS3) put(w http.ResponseWriter, r *http.Request, key string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.objects[key] = &fakeObject{
+		data:     data,
+		meta:     metadata(r.Header),
+		modified: time.Now(),
+	}
+
+	w.Header().Set("ETag", etag(data))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FakeS3) copy(w http.ResponseWriter, r *http.Request, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	object, ok := s.objects[strings.TrimPrefix(source, "/"+s.Bucket+"/")]
+	if !ok {
+		http.Error(w, "NoSuchKey", http.StatusNotFound)
+		return
+	}
+
+	meta := object.meta
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		meta = metadata(r.Header)
+	}
+
+	s.objects[key] = &fakeObject{
+		data:     append([]byte{}, object.data...),
+		meta:     meta,
+		modified: time.Now(),
+	}
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CopyObjectResult"`
+		ETag    string   `xml:"ETag"`
+	}{ETag: etag(object.data)})
+}
+
+func (s *FakeS3) createUpload(w http.ResponseWriter, r *http.Request, key string) {
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+
+	s.uploads[id] = &fakeUpload{
+		key:   key,
+		meta:  metadata(r.Header),
+		parts: make(map[int][]byte),
+	}
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		UploadID string   `xml:"UploadId"`
+	}{UploadID: id})
+}
+
+func (s *FakeS3) uploadPart(w http.ResponseWriter, r *http.Request, query url.Values) {
+	upload, ok := s.uploads[query.Get("uploadId")]
+	if !ok {
+		http.Error(w, "NoSuchUpload", http.StatusNotFound)
+		return
+	}
+
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload.parts[number] = data
+
+	w.Header().Set("ETag", etag(data))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FakeS3) completeUpload(w http.ResponseWriter, r *http.Request, key string, id string) {
+	upload, ok := s.uploads[id]
+	if !ok || upload.key != key {
+		http.Error(w, "NoSuchUpload", http.StatusNotFound)
+		return
+	}
+
+	var complete fakeCompleteUpload
+	if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var data bytes.Buffer
+	for _, part := range complete.Parts {
+		data.Write(upload.parts[part.PartNumber])
+	}
+
+	s.objects[key] = &fakeObject{
+		data:     data.Bytes(),
+		meta:     upload.meta,
+		modified: time.Now(),
+	}
+	delete(s.uploads, id)
+
+	s.MultipartUploads++
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string   `xml:"Key"`
+	}{Key: key})
+}
+
+func metadata(header http.Header) http.Header {
+	meta := http.Header{}
+	for k, v := range header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			meta[k] = v
+		}
+	}
+
+	return meta
+}
+
+func writeObjectHeader(w http.ResponseWriter, object *fakeObject) {
+	for k, v := range object.meta {
+		w.Header()[k] = v
+	}
+
+	w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", etag(object.data))
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func etag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(data))
+}
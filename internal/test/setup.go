@@ -7,37 +7,24 @@ import (
 
 	"github.com/JakWai01/sile-fystem/pkg/filesystem"
 	"github.com/JakWai01/sile-fystem/pkg/logging"
-	"github.com/JakWai01/sile-fystem/pkg/posix"
-	"github.com/jacobsa/fuse"
 	"github.com/spf13/afero"
 )
 
 type TestSetup struct {
-	Server      fuse.Server
-	MountConfig fuse.MountConfig
-	Ctx         context.Context
-	Dir         string
-	TestDir     string
-	mfs         *fuse.MountedFileSystem
+	Server  *filesystem.MountedFileSystem
+	Ctx     context.Context
+	Dir     string
+	TestDir string
 }
 
-func (t *TestSetup) Setup(l logging.StructuredLogger, osfs bool) error {
-	t.MountConfig.DisableWritebackCaching = true
-
-	cfg := t.MountConfig
-
-	err := t.initialize(context.Background(), &cfg, l, osfs)
-
-	return err
+// Setup mounts a filesystem for a test. The options are applied after the defaults.
+func (t *TestSetup) Setup(l logging.StructuredLogger, osfs bool, extra ...filesystem.Option) error {
+	return t.initialize(context.Background(), l, osfs, extra)
 }
 
-func (t *TestSetup) initialize(ctx context.Context, config *fuse.MountConfig, l logging.StructuredLogger, osfs bool) error {
+func (t *TestSetup) initialize(ctx context.Context, l logging.StructuredLogger, osfs bool, extra []filesystem.Option) error {
 	t.Ctx = ctx
 
-	if config.OpContext == nil {
-		config.OpContext = ctx
-	}
-
 	var err error
 	t.Dir, err = ioutil.TempDir("", "fuse_test")
 	if err != nil {
@@ -49,15 +36,21 @@ func (t *TestSetup) initialize(ctx context.Context, config *fuse.MountConfig, l
 		return fmt.Errorf("TempDir2: %v", err)
 	}
 
-	if osfs {
-		t.Server = filesystem.NewFileSystem(posix.CurrentUid(), posix.CurrentGid(), t.Dir, t.TestDir, l, afero.NewOsFs(), false)
+	options := []filesystem.Option{
+		filesystem.WithLogger(l),
+		filesystem.WithoutWritebackCaching(),
 	}
 
-	if !osfs {
-		t.Server = filesystem.NewFileSystem(posix.CurrentUid(), posix.CurrentGid(), t.Dir, "/", l, afero.NewMemMapFs(), false)
+	var backend afero.Fs
+	if osfs {
+		backend = afero.NewOsFs()
+		options = append(options, filesystem.WithRoot(t.TestDir))
+	} else {
+		backend = afero.NewMemMapFs()
+		options = append(options, filesystem.WithRoot("/"))
 	}
 
-	t.mfs, err = fuse.Mount(t.Dir, t.Server, config)
+	t.Server, err = filesystem.Mount(ctx, t.Dir, backend, append(options, extra...)...)
 	if err != nil {
 		return fmt.Errorf("Mount: %v", err)
 	}
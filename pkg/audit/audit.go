@@ -0,0 +1,191 @@
+// Package audit records the changes made to a filesystem in an append-only log of JSON lines.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrTampered is returned by Verify if the hash chain of a log is broken.
+var ErrTampered = errors.New("audit log was tampered with")
+
+// Record is a change made by a process.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Path    string    `json:"path"`
+	NewPath string    `json:"newPath,omitempty"`
+	// Bytes is the amount of content written for writes.
+	Bytes   int64  `json:"bytes,omitempty"`
+	Uid     uint32 `json:"uid"`
+	Gid     uint32 `json:"gid"`
+	Pid     uint32 `json:"pid"`
+	Process string `json:"process,omitempty"`
+	// Result is "ok" or the error the change failed with.
+	Result string `json:"result"`
+
+	// Prev is the hash of the previous record, and Hash the hash of this record including Prev.
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// Log appends records to a file.
+type Log struct {
+	mu    sync.Mutex
+	file  *os.File
+	chain bool
+	prev  string
+}
+
+// Open opens the log at name, creating it if it doesn't exist. If chain is
+// set, every record includes the hash of the previous one, so that changes
+// to the log can be detected by Verify.
+func Open(name string, chain bool) (*Log, error) {
+	l := &Log{chain: chain}
+
+	if chain {
+		last, err := lastRecord(name)
+		if err != nil {
+			return nil, err
+		}
+
+		l.prev = last.Hash
+	}
+
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	l.file = file
+
+	return l, nil
+}
+
+// Write appends a record to the log and syncs it to stable storage.
+func (l *Log) Write(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.Prev, r.Hash = "", ""
+	if l.chain {
+		r.Prev = l.prev
+
+		hash, err := hashRecord(r)
+		if err != nil {
+			return err
+		}
+
+		r.Hash = hash
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	l.prev = r.Hash
+
+	return l.file.Sync()
+}
+
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// Verify checks the hash chain of a log written with chaining and returns the number of records in it.
+func Verify(r io.Reader) (int, error) {
+	prev := ""
+	n := 0
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		n++
+
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return n, fmt.Errorf("%w: record %d: %v", ErrTampered, n, err)
+		}
+
+		hash := record.Hash
+		if record.Prev != prev {
+			return n, fmt.Errorf("%w: record %d doesn't follow the previous one", ErrTampered, n)
+		}
+
+		record.Hash = ""
+		expected, err := hashRecord(record)
+		if err != nil {
+			return n, err
+		}
+
+		if hash != expected {
+			return n, fmt.Errorf("%w: record %d was changed", ErrTampered, n)
+		}
+
+		prev = hash
+	}
+
+	return n, scanner.Err()
+}
+
+func hashRecord(r Record) (string, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lastRecord returns the last record of the log at name, or an empty record if there is none.
+func lastRecord(name string) (Record, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Record{}, nil
+		}
+
+		return Record{}, err
+	}
+	defer file.Close()
+
+	var last []byte
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Record{}, err
+	}
+
+	var record Record
+	if last == nil {
+		return record, nil
+	}
+
+	if err := json.Unmarshal(last, &record); err != nil {
+		return Record{}, err
+	}
+
+	return record, nil
+}
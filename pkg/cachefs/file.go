@@ -0,0 +1,218 @@
+package cachefs
+
+import (
+	"io"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// cachedFile is a read-only handle to the cached content of a file, which
+// reports the name and metadata of the file in the backend.
+type cachedFile struct {
+	*os.File
+
+	name string
+	info os.FileInfo
+}
+
+func (f *cachedFile) Name() string {
+	return f.name
+}
+
+func (f *cachedFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// writeFile is a handle to a file of the backend opened for writing. The file
+// is forgotten once more when the handle is closed, since it might have been
+// read into the cache while it was written.
+type writeFile struct {
+	afero.File
+
+	fs   *Fs
+	name string
+}
+
+func (f *writeFile) Close() error {
+	err := f.File.Close()
+
+	if ferr := f.fs.forget(f.name); err == nil {
+		err = ferr
+	}
+
+	return err
+}
+
+// dir is a directory of the backend remembering its entries while it is listed.
+type dir struct {
+	afero.File
+
+	fs   *Fs
+	name string
+}
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	if err != nil && err != io.EOF {
+		return infos, err
+	}
+
+	if lerr := d.fs.list(d.name, infos, count <= 0); lerr != nil {
+		return infos, lerr
+	}
+
+	return infos, err
+}
+
+func (d *dir) Readdirnames(n int) ([]string, error) {
+	infos, err := d.Readdir(n)
+
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+
+	return names, err
+}
+
+// offlineDir lists the remembered entries of a directory while the backend
+// can't be reached.
+type offlineDir struct {
+	fs     *Fs
+	name   string
+	info   os.FileInfo
+	offset int
+}
+
+func (d *offlineDir) Readdir(count int) ([]os.FileInfo, error) {
+	d.fs.mu.Lock()
+	entries, err := d.fs.children(clean(d.name))
+	d.fs.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].path < entries[j].path
+	})
+
+	if d.offset > len(entries) {
+		d.offset = len(entries)
+	}
+	entries = entries[d.offset:]
+
+	if count > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+
+		if len(entries) > count {
+			entries = entries[:count]
+		}
+	}
+
+	d.offset += len(entries)
+
+	infos := make([]os.FileInfo, len(entries))
+	for i, e := range entries {
+		infos[i] = e.info()
+	}
+
+	return infos, nil
+}
+
+func (d *offlineDir) Readdirnames(n int) ([]string, error) {
+	infos, err := d.Readdir(n)
+
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+
+	return names, err
+}
+
+func (d *offlineDir) Name() string {
+	return d.name
+}
+
+func (d *offlineDir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *offlineDir) Close() error {
+	return nil
+}
+
+func (d *offlineDir) Sync() error {
+	return nil
+}
+
+func (d *offlineDir) Read(p []byte) (int, error) {
+	return 0, syscall.EISDIR
+}
+
+func (d *offlineDir) ReadAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EISDIR
+}
+
+func (d *offlineDir) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, syscall.EINVAL
+	}
+
+	d.offset = 0
+
+	return 0, nil
+}
+
+func (d *offlineDir) Write(p []byte) (int, error) {
+	return 0, syscall.EISDIR
+}
+
+func (d *offlineDir) WriteAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EISDIR
+}
+
+func (d *offlineDir) WriteString(s string) (int, error) {
+	return 0, syscall.EISDIR
+}
+
+func (d *offlineDir) Truncate(size int64) error {
+	return syscall.EISDIR
+}
+
+type fileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.mtime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
@@ -0,0 +1,487 @@
+package cachefs
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/afero"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	metadataFile = "metadata.sqlite"
+	contentDir   = "content"
+	spoolDir     = "tmp"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS entries (
+	path TEXT PRIMARY KEY,
+	parent TEXT NOT NULL,
+	mode INTEGER NOT NULL,
+	size INTEGER NOT NULL,
+	mtime INTEGER NOT NULL,
+	etag TEXT NOT NULL DEFAULT '',
+	stored INTEGER NOT NULL DEFAULT 0,
+	used INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS entries_parent ON entries (parent);
+CREATE INDEX IF NOT EXISTS entries_used ON entries (stored, used);
+
+CREATE TABLE IF NOT EXISTS pins (
+	path TEXT PRIMARY KEY
+);
+`
+
+// Config selects where content is cached and how much of it.
+type Config struct {
+	// Dir is the local directory the content and its metadata are kept in.
+	Dir string
+	// Size is the amount of content kept in bytes. The least recently used
+	// files are evicted first, pinned ones never. Zero is unlimited.
+	Size int64
+}
+
+// ETagger is implemented by the os.FileInfo of backends which identify the
+// content of files, like the ETag of an object store. Cached content is
+// validated by the ETag instead of its size and modification time if the
+// backend reports one.
+type ETagger interface {
+	ETag() string
+}
+
+// Fs is an afero.Fs keeping a copy of the files read from a remote backend
+// in a local directory. Files are fetched as a whole when they are opened for
+// reading, and read from the disk for as long as their size and modification
+// time or ETag don't change in the backend. The metadata of the files seen is
+// kept in a SQLite database next to the content, so that the cache survives
+// remounts.
+//
+// Changes are written through to the backend. If the backend can't be
+// reached, the cached content and metadata are served instead, which keeps
+// pinned paths available offline.
+type Fs struct {
+	backend afero.Fs
+	dir     string
+	size    int64
+	db      *sql.DB
+
+	// mu guards the index and the content below dir.
+	mu   sync.Mutex
+	used int64
+	pins map[string]bool
+}
+
+// NewFs opens the cache in cfg.Dir, creating it if it doesn't exist yet.
+func NewFs(backend afero.Fs, cfg Config) (*Fs, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("missing cache directory")
+	}
+
+	if cfg.Size < 0 {
+		return nil, errors.New("negative cache size")
+	}
+
+	// Fetches interrupted by a crash are left behind in the spool.
+	if err := os.RemoveAll(filepath.Join(cfg.Dir, spoolDir)); err != nil {
+		return nil, err
+	}
+
+	for _, d := range []string{cfg.Dir, filepath.Join(cfg.Dir, contentDir), filepath.Join(cfg.Dir, spoolDir)} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open("sqlite", filepath.Join(cfg.Dir, metadataFile)+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite serializes writers anyway; a single connection avoids busy errors
+	// between the connections of the pool.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	fs := &Fs{
+		backend: backend,
+		dir:     cfg.Dir,
+		size:    cfg.Size,
+		db:      db,
+		pins:    map[string]bool{},
+	}
+
+	if err := fs.load(); err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+// Close closes the metadata database.
+func (fs *Fs) Close() error {
+	return fs.db.Close()
+}
+
+// Pin keeps p and everything below it in the cache, fetching what isn't
+// cached yet. Pinned content is never evicted and is available while the
+// backend can't be reached.
+func (fs *Fs) Pin(p string) error {
+	p = clean(p)
+
+	fs.mu.Lock()
+	if _, err := fs.db.Exec(`INSERT OR IGNORE INTO pins (path) VALUES (?)`, p); err != nil {
+		fs.mu.Unlock()
+
+		return err
+	}
+	fs.pins[p] = true
+	fs.mu.Unlock()
+
+	return afero.Walk(fs, p, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		file, err := fs.Open(name)
+		if err != nil {
+			return err
+		}
+
+		return file.Close()
+	})
+}
+
+// Unpin allows the content below p to be evicted again.
+func (fs *Fs) Unpin(p string) error {
+	p = clean(p)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, err := fs.db.Exec(`DELETE FROM pins WHERE path = ?`, p); err != nil {
+		return err
+	}
+	delete(fs.pins, p)
+
+	return fs.evict()
+}
+
+// Pins returns the pinned paths.
+func (fs *Fs) Pins() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	pins := []string{}
+	for p := range fs.pins {
+		pins = append(pins, p)
+	}
+
+	return pins
+}
+
+func (fs *Fs) Name() string {
+	return "cachefs"
+}
+
+func (fs *Fs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *Fs) Mkdir(name string, perm os.FileMode) error {
+	return fs.backend.Mkdir(name, perm)
+}
+
+func (fs *Fs) MkdirAll(p string, perm os.FileMode) error {
+	return fs.backend.MkdirAll(p, perm)
+}
+
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		return fs.open(name)
+	}
+
+	if err := fs.forget(name); err != nil {
+		return nil, err
+	}
+
+	file, err := fs.backend.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writeFile{File: file, fs: fs, name: name}, nil
+}
+
+func (fs *Fs) Remove(name string) error {
+	if err := fs.backend.Remove(name); err != nil {
+		return err
+	}
+
+	return fs.forget(name)
+}
+
+func (fs *Fs) RemoveAll(p string) error {
+	if err := fs.backend.RemoveAll(p); err != nil {
+		return err
+	}
+
+	return fs.forget(p)
+}
+
+func (fs *Fs) Rename(oldname, newname string) error {
+	if err := fs.backend.Rename(oldname, newname); err != nil {
+		return err
+	}
+
+	if err := fs.forget(oldname); err != nil {
+		return err
+	}
+
+	return fs.forget(newname)
+}
+
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.backend.Stat(name)
+	if err == nil {
+		if err := fs.record(name, info); err != nil {
+			return nil, err
+		}
+
+		return info, nil
+	}
+
+	if errors.Is(err, os.ErrNotExist) {
+		if ferr := fs.forget(name); ferr != nil {
+			return nil, ferr
+		}
+
+		return nil, err
+	}
+
+	// The backend can't be reached, so fall back to what is known about the file.
+	if e, ok, lerr := fs.lookup(name); lerr == nil && ok {
+		return e.info(), nil
+	}
+
+	return nil, err
+}
+
+func (fs *Fs) Chmod(name string, mode os.FileMode) error {
+	if err := fs.backend.Chmod(name, mode); err != nil {
+		return err
+	}
+
+	return fs.refresh(name)
+}
+
+func (fs *Fs) Chown(name string, uid, gid int) error {
+	if err := fs.backend.Chown(name, uid, gid); err != nil {
+		return err
+	}
+
+	return fs.refresh(name)
+}
+
+func (fs *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := fs.backend.Chtimes(name, atime, mtime); err != nil {
+		return err
+	}
+
+	return fs.refresh(name)
+}
+
+// StatFS forwards the capacity of the backend if it is able to report it.
+func (fs *Fs) StatFS() (filesystem.Usage, error) {
+	if statfser, ok := fs.backend.(filesystem.StatFSer); ok {
+		return statfser.StatFS()
+	}
+
+	return filesystem.Usage{}, errors.New("backend does not report its capacity")
+}
+
+// SyncDir forwards syncing a directory to the backend.
+func (fs *Fs) SyncDir(name string) error {
+	return filesystem.SyncDir(fs.backend, name)
+}
+
+// open opens name for reading, fetching it into the cache if it is a file
+// which isn't cached or has changed in the backend.
+func (fs *Fs) open(name string) (afero.File, error) {
+	info, err := fs.backend.Stat(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			if ferr := fs.forget(name); ferr != nil {
+				return nil, ferr
+			}
+
+			return nil, err
+		}
+
+		// The backend can't be reached, so fall back to what is cached.
+		return fs.openOffline(name, err)
+	}
+
+	if err := fs.record(name, info); err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		file, err := fs.backend.Open(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return &dir{File: file, fs: fs, name: name}, nil
+	}
+
+	if !info.Mode().IsRegular() {
+		return fs.backend.Open(name)
+	}
+
+	if file, err := fs.openStored(name, info); file != nil || err != nil {
+		return file, err
+	}
+
+	return fs.fetch(name, info)
+}
+
+// openOffline opens what is cached of name, or returns err if nothing is.
+func (fs *Fs) openOffline(name string, err error) (afero.File, error) {
+	e, ok, lerr := fs.lookup(name)
+	if lerr != nil || !ok {
+		return nil, err
+	}
+
+	if e.mode.IsDir() {
+		return &offlineDir{fs: fs, name: name, info: e.info()}, nil
+	}
+
+	file, serr := fs.openStored(name, e.info())
+	if serr != nil || file == nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// openStored opens the cached content of name, if there is any.
+func (fs *Fs) openStored(name string, info os.FileInfo) (afero.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	e, ok, err := fs.get(clean(name))
+	if err != nil || !ok || !e.stored {
+		return nil, err
+	}
+
+	file, err := os.Open(fs.contentPath(e.path))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// The content was removed from the cache directory behind our back.
+			return nil, fs.drop(e)
+		}
+
+		return nil, err
+	}
+
+	if err := fs.touch(e.path); err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	return &cachedFile{File: file, name: name, info: info}, nil
+}
+
+// fetch copies name from the backend into the cache and opens the copy.
+func (fs *Fs) fetch(name string, info os.FileInfo) (afero.File, error) {
+	src, err := fs.backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Join(fs.dir, spoolDir), "fetch-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	p := clean(name)
+
+	if err := os.MkdirAll(filepath.Dir(fs.contentPath(p)), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), fs.contentPath(p)); err != nil {
+		return nil, err
+	}
+
+	if err := fs.store(p, info, size); err != nil {
+		return nil, err
+	}
+
+	// Files opened before they are evicted stay readable.
+	file, err := os.Open(fs.contentPath(p))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.evict(); err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	return &cachedFile{File: file, name: name, info: info}, nil
+}
+
+// refresh updates the metadata of name after it was changed in place,
+// keeping its content cached.
+func (fs *Fs) refresh(name string) error {
+	info, err := fs.backend.Stat(name)
+	if err != nil {
+		return fs.forget(name)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.update(clean(name), info)
+}
+
+func clean(p string) string {
+	return path.Clean("/" + p)
+}
@@ -0,0 +1,358 @@
+package cachefs
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// entry is what is known about a file of the backend.
+type entry struct {
+	path   string
+	mode   os.FileMode
+	size   int64
+	mtime  int64
+	etag   string
+	stored bool
+}
+
+// matches reports whether info still describes the content of e.
+func (e entry) matches(info os.FileInfo) bool {
+	if etag := etagOf(info); etag != "" || e.etag != "" {
+		return etag == e.etag
+	}
+
+	return e.size == info.Size() && e.mtime == info.ModTime().UnixNano()
+}
+
+func (e entry) info() os.FileInfo {
+	return &fileInfo{
+		name:  path.Base(e.path),
+		size:  e.size,
+		mode:  e.mode,
+		mtime: time.Unix(0, e.mtime),
+	}
+}
+
+func etagOf(info os.FileInfo) string {
+	if etagger, ok := info.(ETagger); ok {
+		return etagger.ETag()
+	}
+
+	return ""
+}
+
+// load reads the pins and the size of the cached content.
+func (fs *Fs) load() error {
+	rows, err := fs.db.Query(`SELECT path FROM pins`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return err
+		}
+
+		fs.pins[p] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return fs.db.QueryRow(`SELECT COALESCE(SUM(size), 0) FROM entries WHERE stored = 1`).Scan(&fs.used)
+}
+
+func (fs *Fs) lookup(name string) (entry, bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.get(clean(name))
+}
+
+func (fs *Fs) get(p string) (entry, bool, error) {
+	e := entry{path: p}
+
+	var mode uint32
+	if err := fs.db.QueryRow(
+		`SELECT mode, size, mtime, etag, stored FROM entries WHERE path = ?`, p,
+	).Scan(&mode, &e.size, &e.mtime, &e.etag, &e.stored); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return e, false, nil
+		}
+
+		return e, false, err
+	}
+
+	e.mode = os.FileMode(mode)
+
+	return e, true, nil
+}
+
+// record remembers the metadata of name as reported by the backend, dropping
+// its content if it doesn't match anymore.
+func (fs *Fs) record(name string, info os.FileInfo) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	p := clean(name)
+
+	e, ok, err := fs.get(p)
+	if err != nil {
+		return err
+	}
+
+	if ok && e.mode == info.Mode() && e.size == info.Size() && e.mtime == info.ModTime().UnixNano() && e.etag == etagOf(info) {
+		return nil
+	}
+
+	if ok && e.stored && !e.matches(info) {
+		if err := fs.drop(e); err != nil {
+			return err
+		}
+	}
+
+	return fs.update(p, info)
+}
+
+// update writes the metadata of p, keeping its content.
+func (fs *Fs) update(p string, info os.FileInfo) error {
+	_, err := fs.db.Exec(
+		`INSERT INTO entries (path, parent, mode, size, mtime, etag) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET mode = excluded.mode, size = excluded.size, mtime = excluded.mtime, etag = excluded.etag`,
+		p, path.Dir(p), uint32(info.Mode()), info.Size(), info.ModTime().UnixNano(), etagOf(info),
+	)
+
+	return err
+}
+
+// list remembers the entries of a directory for listing it while the backend
+// can't be reached. Known entries are kept as they are, since listings might
+// report their metadata less precisely than Stat. If the listing is complete,
+// entries which aren't part of it anymore are forgotten.
+func (fs *Fs) list(dir string, infos []os.FileInfo, complete bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir = clean(dir)
+
+	listed := map[string]bool{}
+	for _, info := range infos {
+		p := path.Join(dir, info.Name())
+		listed[p] = true
+
+		if _, err := fs.db.Exec(
+			`INSERT OR IGNORE INTO entries (path, parent, mode, size, mtime, etag) VALUES (?, ?, ?, ?, ?, ?)`,
+			p, dir, uint32(info.Mode()), info.Size(), info.ModTime().UnixNano(), etagOf(info),
+		); err != nil {
+			return err
+		}
+	}
+
+	if !complete {
+		return nil
+	}
+
+	children, err := fs.children(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if !listed[child.path] {
+			if err := fs.remove(child.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (fs *Fs) children(dir string) ([]entry, error) {
+	rows, err := fs.db.Query(`SELECT path, mode, size, mtime, etag, stored FROM entries WHERE parent = ? AND path != parent ORDER BY path`, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []entry{}
+	for rows.Next() {
+		var (
+			e    entry
+			mode uint32
+		)
+		if err := rows.Scan(&e.path, &mode, &e.size, &e.mtime, &e.etag, &e.stored); err != nil {
+			return nil, err
+		}
+
+		e.mode = os.FileMode(mode)
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// store marks the content of p as cached, after it was moved into place.
+func (fs *Fs) store(p string, info os.FileInfo, size int64) error {
+	e, ok, err := fs.get(p)
+	if err != nil {
+		return err
+	}
+
+	if ok && e.stored {
+		fs.used -= e.size
+	}
+
+	if _, err := fs.db.Exec(
+		`INSERT INTO entries (path, parent, mode, size, mtime, etag, stored, used) VALUES (?, ?, ?, ?, ?, ?, 1, ?)
+		ON CONFLICT (path) DO UPDATE SET mode = excluded.mode, size = excluded.size, mtime = excluded.mtime, etag = excluded.etag, stored = 1, used = excluded.used`,
+		p, path.Dir(p), uint32(info.Mode()), size, info.ModTime().UnixNano(), etagOf(info), time.Now().UnixNano(),
+	); err != nil {
+		return err
+	}
+
+	fs.used += size
+
+	return nil
+}
+
+func (fs *Fs) touch(p string) error {
+	_, err := fs.db.Exec(`UPDATE entries SET used = ? WHERE path = ?`, time.Now().UnixNano(), p)
+
+	return err
+}
+
+// forget removes name and everything below it from the cache.
+func (fs *Fs) forget(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.remove(clean(name))
+}
+
+func (fs *Fs) remove(p string) error {
+	// '0' follows '/', so the range covers exactly the paths below p.
+	lower, upper := strings.TrimSuffix(p, "/")+"/", strings.TrimSuffix(p, "/")+"0"
+
+	rows, err := fs.db.Query(`SELECT path, size FROM entries WHERE stored = 1 AND (path = ? OR (path >= ? AND path < ?))`, p, lower, upper)
+	if err != nil {
+		return err
+	}
+
+	stored := []entry{}
+	for rows.Next() {
+		e := entry{stored: true}
+		if err := rows.Scan(&e.path, &e.size); err != nil {
+			rows.Close()
+
+			return err
+		}
+
+		stored = append(stored, e)
+	}
+
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, e := range stored {
+		if err := fs.drop(e); err != nil {
+			return err
+		}
+	}
+
+	_, err = fs.db.Exec(`DELETE FROM entries WHERE path = ? OR (path >= ? AND path < ?)`, p, lower, upper)
+
+	return err
+}
+
+// drop removes the content of e from the cache, keeping its metadata.
+func (fs *Fs) drop(e entry) error {
+	if err := os.Remove(fs.contentPath(e.path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if _, err := fs.db.Exec(`UPDATE entries SET stored = 0 WHERE path = ?`, e.path); err != nil {
+		return err
+	}
+
+	fs.used -= e.size
+
+	return nil
+}
+
+// evict drops the least recently used content which isn't pinned until the
+// cache fits into its size.
+func (fs *Fs) evict() error {
+	if fs.size == 0 || fs.used <= fs.size {
+		return nil
+	}
+
+	rows, err := fs.db.Query(`SELECT path, size FROM entries WHERE stored = 1 ORDER BY used`)
+	if err != nil {
+		return err
+	}
+
+	victims := []entry{}
+	for excess := fs.used - fs.size; excess > 0 && rows.Next(); {
+		e := entry{stored: true}
+		if err := rows.Scan(&e.path, &e.size); err != nil {
+			rows.Close()
+
+			return err
+		}
+
+		if fs.pinned(e.path) {
+			continue
+		}
+
+		victims = append(victims, e)
+		excess -= e.size
+	}
+
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, e := range victims {
+		if err := fs.drop(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pinned reports whether p or one of its parents is pinned.
+func (fs *Fs) pinned(p string) bool {
+	for {
+		if fs.pins[p] {
+			return true
+		}
+
+		if p == "/" {
+			return false
+		}
+
+		p = path.Dir(p)
+	}
+}
+
+// contentPath returns where the content of p is cached, named by the hash of
+// its path so that the layout doesn't depend on the names of the backend.
+func (fs *Fs) contentPath(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	hash := hex.EncodeToString(sum[:])
+
+	return filepath.Join(fs.dir, contentDir, hash[:2], hash)
+}
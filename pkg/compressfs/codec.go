@@ -0,0 +1,126 @@
+package compressfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Algorithm identifies the compression algorithm of the frames of a file.
+// It is stored in every file, so changing the configured algorithm doesn't
+// affect the readability of existing files.
+type Algorithm byte
+
+const (
+	Zstd Algorithm = iota + 1
+	LZ4
+	Gzip
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// ParseAlgorithm looks up an algorithm by its name.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch name {
+	case "zstd":
+		return Zstd, nil
+	case "lz4":
+		return LZ4, nil
+	case "gzip":
+		return Gzip, nil
+	}
+
+	return 0, fmt.Errorf("unknown compression algorithm %q", name)
+}
+
+func (a Algorithm) String() string {
+	switch a {
+	case Zstd:
+		return "zstd"
+	case LZ4:
+		return "lz4"
+	case Gzip:
+		return "gzip"
+	}
+
+	return fmt.Sprintf("Algorithm(%d)", byte(a))
+}
+
+// compress compresses a frame. It returns nil if the frame is incompressible.
+func (a Algorithm) compress(src []byte) ([]byte, error) {
+	var dst []byte
+
+	switch a {
+	case Zstd:
+		dst = zstdEncoder.EncodeAll(src, nil)
+	case LZ4:
+		dst = make([]byte, lz4.CompressBlockBound(len(src)))
+
+		n, err := lz4.CompressBlock(src, dst, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		dst = dst[:n]
+	case Gzip:
+		var buf bytes.Buffer
+
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(src); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		dst = buf.Bytes()
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %v", a)
+	}
+
+	if len(dst) == 0 || len(dst) >= len(src) {
+		return nil, nil
+	}
+
+	return dst, nil
+}
+
+// decompress decompresses a frame holding size bytes of content.
+func (a Algorithm) decompress(src []byte, size int) ([]byte, error) {
+	switch a {
+	case Zstd:
+		return zstdDecoder.DecodeAll(src, make([]byte, 0, size))
+	case LZ4:
+		dst := make([]byte, size)
+
+		n, err := lz4.UncompressBlock(src, dst)
+		if err != nil {
+			return nil, err
+		}
+
+		return dst[:n], nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		dst := make([]byte, size)
+		if _, err := io.ReadFull(r, dst); err != nil {
+			return nil, err
+		}
+
+		return dst, nil
+	}
+
+	return nil, fmt.Errorf("unknown compression algorithm %v", a)
+}
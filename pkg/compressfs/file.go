@@ -0,0 +1,582 @@
+package compressfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	magic = "SFCOMP01"
+
+	// footerSize is the algorithm, the frame size, the number of frames,
+	// the uncompressed size and the magic at the end of a compressed file.
+	footerSize = 1 + 4 + 4 + 8 + len(magic)
+
+	// storedFlag marks index entries of frames stored uncompressed.
+	storedFlag = 1 << 31
+)
+
+var (
+	errCorrupted   = errors.New("compressed file is corrupted")
+	errNotWritable = errors.New("file not opened for writing")
+)
+
+type footer struct {
+	algorithm Algorithm
+	frameSize int64
+	frames    int64
+	size      int64
+}
+
+// extent is the location of a frame in the backend.
+type extent struct {
+	offset int64
+	length int64
+	stored bool
+}
+
+// File is a handle to a compressed file.
+//
+// Frames modified through the handle are kept in memory until the file is
+// synced or closed. The frames following the first modified one are then
+// rewritten together with the index, so appending only rewrites the last
+// frame.
+type File struct {
+	fs   *Fs
+	file afero.File
+	name string
+	flag int
+
+	mu        sync.Mutex
+	algorithm Algorithm
+	frameSize int64
+	extents   []extent
+	dirty     map[int64][]byte
+	changed   bool
+	size      int64
+	offset    int64
+
+	cached      int64
+	cachedFrame []byte
+}
+
+func newFile(fs *Fs, file afero.File, name string, flag int, ftr footer, compressed bool) (*File, error) {
+	f := &File{
+		fs:        fs,
+		file:      file,
+		name:      name,
+		flag:      flag,
+		algorithm: fs.algorithm,
+		frameSize: fs.frameSize,
+		dirty:     map[int64][]byte{},
+		cached:    -1,
+	}
+
+	if !compressed {
+		return f, nil
+	}
+
+	f.algorithm = ftr.algorithm
+	f.frameSize = ftr.frameSize
+	f.size = ftr.size
+
+	index := make([]byte, 4*ftr.frames)
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.ReadAt(index, info.Size()-int64(footerSize)-int64(len(index))); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	f.extents = make([]extent, ftr.frames)
+
+	offset := int64(0)
+	for i := range f.extents {
+		entry := binary.BigEndian.Uint32(index[4*i:])
+
+		f.extents[i] = extent{
+			offset: offset,
+			length: int64(entry &^ storedFlag),
+			stored: entry&storedFlag != 0,
+		}
+
+		offset += f.extents[i].length
+	}
+
+	if offset+int64(len(index)+footerSize) != info.Size() || int64(len(f.extents)) != f.frames() {
+		return nil, errCorrupted
+	}
+
+	return f, nil
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	err := f.flush()
+	f.mu.Unlock()
+
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.readAt(p, off)
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	off := f.offset
+	if f.flag&os.O_APPEND != 0 {
+		off = f.size
+	}
+
+	n, err := f.writeAt(p, off)
+	f.offset = off + int64(n)
+
+	return n, err
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.writeAt(p, off)
+}
+
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	return f.file.Readdir(count)
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	return f.file.Readdirnames(n)
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return &fileInfo{FileInfo: info, size: f.size}, nil
+}
+
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.flush(); err != nil {
+		return err
+	}
+
+	return f.file.Sync()
+}
+
+func (f *File) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	if err := f.checkWritable("truncate"); err != nil {
+		return err
+	}
+
+	if size >= f.size {
+		return f.extend(size)
+	}
+
+	frames := (size + f.frameSize - 1) / f.frameSize
+
+	var last []byte
+	if within := size % f.frameSize; within > 0 {
+		data, err := f.frame(frames - 1)
+		if err != nil {
+			return err
+		}
+
+		last = append([]byte{}, data[:within]...)
+	}
+
+	for index := range f.dirty {
+		if index >= frames {
+			delete(f.dirty, index)
+		}
+	}
+
+	if int64(len(f.extents)) > frames {
+		f.extents = f.extents[:frames]
+	}
+
+	if last != nil {
+		f.dirty[frames-1] = last
+	}
+
+	f.size = size
+	f.changed = true
+	f.cached = -1
+
+	return nil
+}
+
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off < f.size {
+		data, err := f.frame(off / f.frameSize)
+		if err != nil {
+			return n, err
+		}
+
+		c := copy(p[n:], data[off%f.frameSize:])
+		n += c
+		off += int64(c)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *File) writeAt(p []byte, off int64) (int, error) {
+	if err := f.checkWritable("write"); err != nil {
+		return 0, err
+	}
+
+	if off > f.size {
+		if err := f.extend(off); err != nil {
+			return 0, err
+		}
+	}
+
+	n := 0
+	for n < len(p) {
+		index := off / f.frameSize
+		within := off % f.frameSize
+
+		data, err := f.frame(index)
+		if err != nil {
+			return n, err
+		}
+
+		end := within + int64(len(p)-n)
+		if end > f.frameSize {
+			end = f.frameSize
+		}
+		if end < int64(len(data)) {
+			end = int64(len(data))
+		}
+
+		buf := make([]byte, end)
+		copy(buf, data)
+		c := copy(buf[within:], p[n:])
+
+		f.setFrame(index, buf)
+
+		n += c
+		off += int64(c)
+	}
+
+	return n, nil
+}
+
+// extend zero-fills the file up to size, completing the last frame on the way.
+func (f *File) extend(size int64) error {
+	for f.size < size {
+		index := f.size / f.frameSize
+
+		data, err := f.frame(index)
+		if err != nil {
+			return err
+		}
+
+		end := size - index*f.frameSize
+		if end > f.frameSize {
+			end = f.frameSize
+		}
+
+		buf := make([]byte, end)
+		copy(buf, data)
+
+		f.setFrame(index, buf)
+	}
+
+	return nil
+}
+
+func (f *File) setFrame(index int64, data []byte) {
+	f.dirty[index] = data
+	f.changed = true
+
+	if f.cached == index {
+		f.cached = -1
+	}
+
+	if size := index*f.frameSize + int64(len(data)); size > f.size {
+		f.size = size
+	}
+}
+
+// frame returns the content of a frame, which is empty past the end of the file.
+func (f *File) frame(index int64) ([]byte, error) {
+	if data, ok := f.dirty[index]; ok {
+		return data, nil
+	}
+
+	if index >= f.frames() {
+		return nil, nil
+	}
+
+	if index == f.cached {
+		return f.cachedFrame, nil
+	}
+
+	raw, err := f.readExtent(f.extents[index])
+	if err != nil {
+		return nil, err
+	}
+
+	length := f.size - index*f.frameSize
+	if length > f.frameSize {
+		length = f.frameSize
+	}
+
+	data := raw
+	if !f.extents[index].stored {
+		if data, err = f.algorithm.decompress(raw, int(length)); err != nil {
+			return nil, err
+		}
+	}
+
+	if int64(len(data)) != length {
+		return nil, errCorrupted
+	}
+
+	f.cached = index
+	f.cachedFrame = data
+
+	return data, nil
+}
+
+func (f *File) readExtent(e extent) ([]byte, error) {
+	raw := make([]byte, e.length)
+	if n, err := f.file.ReadAt(raw, e.offset); n < len(raw) {
+		if err == nil || err == io.EOF {
+			err = errCorrupted
+		}
+
+		return nil, err
+	}
+
+	return raw, nil
+}
+
+// flush writes the modified frames and the index to the backend.
+func (f *File) flush() error {
+	if !f.changed {
+		return nil
+	}
+
+	frames := f.frames()
+
+	first := int64(len(f.extents))
+	for index := range f.dirty {
+		if index < first {
+			first = index
+		}
+	}
+
+	start := int64(0)
+	if first < int64(len(f.extents)) {
+		start = f.extents[first].offset
+	} else if len(f.extents) > 0 {
+		last := f.extents[len(f.extents)-1]
+		start = last.offset + last.length
+	}
+
+	var buf bytes.Buffer
+	extents := append([]extent{}, f.extents[:first]...)
+
+	for index := first; index < frames; index++ {
+		var (
+			raw    []byte
+			stored bool
+			err    error
+		)
+
+		if data, ok := f.dirty[index]; ok {
+			if raw, err = f.algorithm.compress(data); err != nil {
+				return err
+			}
+
+			if raw == nil {
+				raw = data
+				stored = true
+			}
+		} else {
+			stored = f.extents[index].stored
+			if raw, err = f.readExtent(f.extents[index]); err != nil {
+				return err
+			}
+		}
+
+		extents = append(extents, extent{
+			offset: start + int64(buf.Len()),
+			length: int64(len(raw)),
+			stored: stored,
+		})
+		buf.Write(raw)
+	}
+
+	entry := make([]byte, 4)
+	for _, e := range extents {
+		length := uint32(e.length)
+		if e.stored {
+			length |= storedFlag
+		}
+
+		binary.BigEndian.PutUint32(entry, length)
+		buf.Write(entry)
+	}
+
+	buf.Write(encodeFooter(footer{
+		algorithm: f.algorithm,
+		frameSize: f.frameSize,
+		frames:    frames,
+		size:      f.size,
+	}))
+
+	if _, err := f.file.WriteAt(buf.Bytes(), start); err != nil {
+		return err
+	}
+
+	if err := f.file.Truncate(start + int64(buf.Len())); err != nil {
+		return err
+	}
+
+	f.extents = extents
+	f.dirty = map[int64][]byte{}
+	f.changed = false
+
+	return nil
+}
+
+func (f *File) frames() int64 {
+	return (f.size + f.frameSize - 1) / f.frameSize
+}
+
+func (f *File) checkWritable(op string) error {
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: errNotWritable}
+	}
+
+	return nil
+}
+
+// readFooter reads the footer of a file of the given size. It reports
+// whether the file is compressed at all.
+func readFooter(r io.ReaderAt, size int64) (footer, bool, error) {
+	if size < int64(footerSize) {
+		return footer{}, false, nil
+	}
+
+	buf := make([]byte, footerSize)
+	if _, err := r.ReadAt(buf, size-int64(footerSize)); err != nil && err != io.EOF {
+		return footer{}, false, err
+	}
+
+	if string(buf[footerSize-len(magic):]) != magic {
+		return footer{}, false, nil
+	}
+
+	ftr := footer{
+		algorithm: Algorithm(buf[0]),
+		frameSize: int64(binary.BigEndian.Uint32(buf[1:])),
+		frames:    int64(binary.BigEndian.Uint32(buf[5:])),
+		size:      int64(binary.BigEndian.Uint64(buf[9:])),
+	}
+
+	if ftr.frameSize == 0 || ftr.frames*4 > size-int64(footerSize) {
+		return footer{}, false, errCorrupted
+	}
+
+	return ftr, true, nil
+}
+
+func encodeFooter(ftr footer) []byte {
+	buf := make([]byte, footerSize)
+
+	buf[0] = byte(ftr.algorithm)
+	binary.BigEndian.PutUint32(buf[1:], uint32(ftr.frameSize))
+	binary.BigEndian.PutUint32(buf[5:], uint32(ftr.frames))
+	binary.BigEndian.PutUint64(buf[9:], uint64(ftr.size))
+	copy(buf[footerSize-len(magic):], magic)
+
+	return buf
+}
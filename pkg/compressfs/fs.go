@@ -0,0 +1,260 @@
+package compressfs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/afero"
+)
+
+const (
+	defaultFrameSize = 128 * 1024
+	maxFrameSize     = 1 << 30
+)
+
+// DefaultSkipExtensions lists extensions of formats which are compressed already.
+var DefaultSkipExtensions = []string{
+	".gz", ".tgz", ".zst", ".lz4", ".xz", ".bz2", ".zip", ".7z", ".rar",
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".mp3", ".mp4", ".mkv", ".webm",
+}
+
+// Config selects how new files are compressed.
+type Config struct {
+	Algorithm Algorithm
+	// FrameSize is the amount of content compressed as an independent unit.
+	// Reads decompress whole frames, so smaller frames make random reads
+	// cheaper at the cost of the compression ratio.
+	FrameSize int
+	// SkipExtensions are stored as they are, matched case-insensitively.
+	SkipExtensions []string
+}
+
+// Fs is an afero.Fs compressing the content of files before handing it to
+// the wrapped backend. Files are stored as a sequence of independently
+// compressed frames followed by an index, so that reads only decompress the
+// frames they overlap and the uncompressed size can be read from the end of
+// the file. Files without an index, such as ones created before the
+// compression was enabled, are passed through unchanged.
+type Fs struct {
+	backend   afero.Fs
+	algorithm Algorithm
+	frameSize int64
+	skip      map[string]bool
+}
+
+func NewFs(backend afero.Fs, cfg Config) (*Fs, error) {
+	if _, err := cfg.Algorithm.compress(nil); err != nil {
+		return nil, err
+	}
+
+	frameSize := int64(cfg.FrameSize)
+	if frameSize <= 0 {
+		frameSize = defaultFrameSize
+	} else if frameSize > maxFrameSize {
+		return nil, errors.New("frame size too large")
+	}
+
+	skip := map[string]bool{}
+	for _, ext := range cfg.SkipExtensions {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+
+		skip[strings.ToLower(ext)] = true
+	}
+
+	return &Fs{
+		backend:   backend,
+		algorithm: cfg.Algorithm,
+		frameSize: frameSize,
+		skip:      skip,
+	}, nil
+}
+
+func (fs *Fs) Name() string {
+	return "compressfs"
+}
+
+func (fs *Fs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *Fs) Mkdir(name string, perm os.FileMode) error {
+	return fs.backend.Mkdir(name, perm)
+}
+
+func (fs *Fs) MkdirAll(p string, perm os.FileMode) error {
+	return fs.backend.MkdirAll(p, perm)
+}
+
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if info, err := fs.backend.Stat(name); err == nil && info.IsDir() {
+		file, err := fs.backend.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+
+		return &dir{File: file, fs: fs, name: name}, nil
+	}
+
+	// Frames are rewritten in place, which requires reading them back, and
+	// appending is done by the wrapper since the backend only sees frames.
+	backendFlag := flag &^ os.O_APPEND
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		backendFlag = backendFlag&^os.O_WRONLY | os.O_RDWR
+	}
+
+	file, err := fs.backend.OpenFile(name, backendFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	ftr, compressed, err := readFooter(file, info.Size())
+	if err != nil {
+		file.Close()
+
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if !compressed && (info.Size() > 0 || fs.skip[strings.ToLower(path.Ext(name))] || flag&(os.O_WRONLY|os.O_RDWR) == 0) {
+		if backendFlag == flag {
+			return file, nil
+		}
+
+		// Plain files are passed through, so reopen with the flags asked for.
+		// The file has been created and truncated already.
+		if err := file.Close(); err != nil {
+			return nil, err
+		}
+
+		return fs.backend.OpenFile(name, flag&^(os.O_CREATE|os.O_EXCL|os.O_TRUNC), perm)
+	}
+
+	f, err := newFile(fs, file, name, flag, ftr, compressed)
+	if err != nil {
+		file.Close()
+
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return f, nil
+}
+
+func (fs *Fs) Remove(name string) error {
+	return fs.backend.Remove(name)
+}
+
+func (fs *Fs) RemoveAll(p string) error {
+	return fs.backend.RemoveAll(p)
+}
+
+func (fs *Fs) Rename(oldname, newname string) error {
+	return fs.backend.Rename(oldname, newname)
+}
+
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.backend.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.withSize(name, info)
+}
+
+func (fs *Fs) Chmod(name string, mode os.FileMode) error {
+	return fs.backend.Chmod(name, mode)
+}
+
+func (fs *Fs) Chown(name string, uid, gid int) error {
+	return fs.backend.Chown(name, uid, gid)
+}
+
+func (fs *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fs.backend.Chtimes(name, atime, mtime)
+}
+
+// StatFS forwards the capacity of the backend if it is able to report it.
+func (fs *Fs) StatFS() (filesystem.Usage, error) {
+	if statfser, ok := fs.backend.(filesystem.StatFSer); ok {
+		return statfser.StatFS()
+	}
+
+	return filesystem.Usage{}, errors.New("backend does not report its capacity")
+}
+
+// SyncDir forwards syncing a directory to the backend.
+func (fs *Fs) SyncDir(name string) error {
+	return filesystem.SyncDir(fs.backend, name)
+}
+
+// withSize replaces the size of compressed files with their uncompressed size.
+func (fs *Fs) withSize(name string, info os.FileInfo) (os.FileInfo, error) {
+	if !info.Mode().IsRegular() || info.Size() < int64(footerSize) {
+		return info, nil
+	}
+
+	file, err := fs.backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ftr, compressed, err := readFooter(file, info.Size())
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	if !compressed {
+		return info, nil
+	}
+
+	return &fileInfo{FileInfo: info, size: ftr.size}, nil
+}
+
+// dir is a directory of the backend reporting the uncompressed size of its entries.
+type dir struct {
+	afero.File
+
+	fs   *Fs
+	name string
+}
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+
+	for i, info := range infos {
+		sized, serr := d.fs.withSize(path.Join("/", d.name, info.Name()), info)
+		if serr != nil {
+			return infos[:i], serr
+		}
+
+		infos[i] = sized
+	}
+
+	return infos, err
+}
+
+type fileInfo struct {
+	os.FileInfo
+
+	size int64
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
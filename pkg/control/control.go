@@ -0,0 +1,98 @@
+// Package control manages a mounted filesystem through a unix socket.
+package control
+
+import (
+	"net"
+	"net/rpc"
+	"os"
+
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+)
+
+const service = "Control"
+
+// Service is the remote interface served on the control socket.
+type Service struct {
+	server *filesystem.Server
+}
+
+// Empty is used for requests and replies without content.
+type Empty struct{}
+
+func (s *Service) CreateSnapshot(name string, reply *Empty) error {
+	return s.server.CreateSnapshot(name)
+}
+
+func (s *Service) ListSnapshots(args Empty, reply *[]filesystem.SnapshotInfo) error {
+	*reply = s.server.ListSnapshots()
+
+	return nil
+}
+
+func (s *Service) DeleteSnapshot(name string, reply *Empty) error {
+	return s.server.DeleteSnapshot(name)
+}
+
+func (s *Service) Invalidate(p string, reply *Empty) error {
+	return s.server.Invalidate(p)
+}
+
+// Listen creates the control socket, replacing a stale one left behind by a previous mount.
+func Listen(socket string) (net.Listener, error) {
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return net.Listen("unix", socket)
+}
+
+// Serve answers requests on the listener until it is closed.
+func Serve(listener net.Listener, server *filesystem.Server) error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName(service, &Service{server}); err != nil {
+		return err
+	}
+
+	srv.Accept(listener)
+
+	return nil
+}
+
+// Client sends requests to the control socket of a mount.
+type Client struct {
+	rpc *rpc.Client
+}
+
+func Dial(socket string) (*Client, error) {
+	c, err := rpc.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{c}, nil
+}
+
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
+
+func (c *Client) CreateSnapshot(name string) error {
+	return c.rpc.Call(service+".CreateSnapshot", name, &Empty{})
+}
+
+func (c *Client) ListSnapshots() ([]filesystem.SnapshotInfo, error) {
+	var infos []filesystem.SnapshotInfo
+	if err := c.rpc.Call(service+".ListSnapshots", Empty{}, &infos); err != nil {
+		return nil, err
+	}
+
+	return infos, nil
+}
+
+func (c *Client) DeleteSnapshot(name string) error {
+	return c.rpc.Call(service+".DeleteSnapshot", name, &Empty{})
+}
+
+func (c *Client) Invalidate(p string) error {
+	return c.rpc.Call(service+".Invalidate", p, &Empty{})
+}
@@ -0,0 +1,492 @@
+package cryptfs
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	magic = "SFCRYPT1"
+
+	// chunkSize is the amount of plaintext authenticated as a unit.
+	chunkSize = 64 * 1024
+	// overhead is the nonce and tag stored with every chunk.
+	overhead = chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+	// headerSize is the magic followed by the wrapped per-file key.
+	headerSize = len(magic) + chacha20poly1305.NonceSizeX + chacha20poly1305.KeySize + chacha20poly1305.Overhead
+)
+
+var (
+	errCorrupted   = errors.New("encrypted file is corrupted")
+	errNotWritable = errors.New("file not opened for writing")
+)
+
+// File is a handle to an encrypted file or a directory of the backend.
+//
+// Encrypted files consist of a header holding the file key wrapped with the
+// master key, followed by chunks of at most chunkSize bytes of plaintext,
+// each stored as nonce || ciphertext || tag with the chunk index as
+// additional data. All chunks but the last are full, so the plaintext size
+// follows from the size of the backend file alone.
+type File struct {
+	fs   *Fs
+	file afero.File
+	name string
+	flag int
+	dir  bool
+
+	mu     sync.Mutex
+	aead   cipher.AEAD
+	size   int64
+	offset int64
+}
+
+func newFile(fs *Fs, file afero.File, name string, flag int) (*File, error) {
+	f := &File{
+		fs:   fs,
+		file: file,
+		name: name,
+		flag: flag,
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case info.Size() == 0 && f.writable():
+		err = f.writeHeader()
+	case info.Size() == 0:
+		// An empty file without a header can only be read from, which yields nothing.
+	case info.Size() < int64(headerSize):
+		err = errCorrupted
+	default:
+		err = f.readHeader()
+		f.size = plainSize(info.Size())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Close() error {
+	return f.file.Close()
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.readAt(p, off)
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	off := f.offset
+	if f.flag&os.O_APPEND != 0 {
+		off = f.size
+	}
+
+	n, err := f.writeAt(p, off)
+	f.offset = off + int64(n)
+
+	return n, err
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.writeAt(p, off)
+}
+
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.file.Readdir(count)
+
+	root := path.Clean("/"+f.name) == "/"
+
+	res := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if root && info.Name() == KeyFile {
+			continue
+		}
+
+		name, err := f.fs.plainName(info.Name())
+		if err != nil {
+			// Skip entries which were not created through this layer.
+			continue
+		}
+
+		res = append(res, newFileInfo(info, name))
+	}
+
+	return res, err
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	infos, err := f.Readdir(n)
+
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+
+	return names, err
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if f.dir {
+		return newFileInfo(info, path.Base(f.name)), nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return &fileInfo{FileInfo: info, name: path.Base(f.name), size: f.size}, nil
+}
+
+func (f *File) Sync() error {
+	return f.file.Sync()
+}
+
+func (f *File) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	if err := f.checkWritable("truncate"); err != nil {
+		return err
+	}
+
+	if size >= f.size {
+		return f.extend(size)
+	}
+
+	index := size / chunkSize
+	within := size % chunkSize
+
+	if within > 0 {
+		chunk, err := f.readChunk(index)
+		if err != nil {
+			return err
+		}
+
+		if err := f.writeChunk(index, chunk[:within]); err != nil {
+			return err
+		}
+
+		if err := f.file.Truncate(chunkOffset(index) + overhead + within); err != nil {
+			return err
+		}
+	} else if err := f.file.Truncate(chunkOffset(index)); err != nil {
+		return err
+	}
+
+	f.size = size
+
+	return nil
+}
+
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	if f.dir {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	n := 0
+	for n < len(p) && off < f.size {
+		chunk, err := f.readChunk(off / chunkSize)
+		if err != nil {
+			return n, err
+		}
+
+		c := copy(p[n:], chunk[off%chunkSize:])
+		n += c
+		off += int64(c)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *File) writeAt(p []byte, off int64) (int, error) {
+	if err := f.checkWritable("write"); err != nil {
+		return 0, err
+	}
+
+	if off > f.size {
+		if err := f.extend(off); err != nil {
+			return 0, err
+		}
+	}
+
+	n := 0
+	for n < len(p) {
+		index := off / chunkSize
+		within := int(off % chunkSize)
+
+		chunk, err := f.readChunk(index)
+		if err != nil {
+			return n, err
+		}
+
+		end := within + len(p) - n
+		if end > chunkSize {
+			end = chunkSize
+		}
+
+		if len(chunk) < end {
+			chunk = append(chunk, make([]byte, end-len(chunk))...)
+		}
+
+		c := copy(chunk[within:], p[n:])
+		if err := f.writeChunk(index, chunk); err != nil {
+			return n, err
+		}
+
+		n += c
+		off += int64(c)
+
+		if size := index*chunkSize + int64(len(chunk)); size > f.size {
+			f.size = size
+		}
+	}
+
+	return n, nil
+}
+
+// extend zero-fills the file up to size, completing the last chunk on the way.
+func (f *File) extend(size int64) error {
+	for f.size < size {
+		index := f.size / chunkSize
+
+		chunk, err := f.readChunk(index)
+		if err != nil {
+			return err
+		}
+
+		end := size - index*chunkSize
+		if end > chunkSize {
+			end = chunkSize
+		}
+
+		chunk = append(chunk, make([]byte, end-int64(len(chunk)))...)
+		if err := f.writeChunk(index, chunk); err != nil {
+			return err
+		}
+
+		f.size = index*chunkSize + end
+	}
+
+	return nil
+}
+
+// readChunk returns the plaintext of a chunk, which is empty past the end of the file.
+func (f *File) readChunk(index int64) ([]byte, error) {
+	start := index * chunkSize
+	if start >= f.size {
+		return nil, nil
+	}
+
+	length := f.size - start
+	if length > chunkSize {
+		length = chunkSize
+	}
+
+	buf := make([]byte, length+overhead)
+	if n, err := f.file.ReadAt(buf, chunkOffset(index)); n < len(buf) {
+		if err == nil || err == io.EOF {
+			err = errCorrupted
+		}
+
+		return nil, err
+	}
+
+	nonce := buf[:chacha20poly1305.NonceSizeX]
+
+	chunk, err := f.aead.Open(nil, nonce, buf[len(nonce):], chunkAD(index))
+	if err != nil {
+		return nil, errCorrupted
+	}
+
+	return chunk, nil
+}
+
+func (f *File) writeChunk(index int64, chunk []byte) error {
+	buf := make([]byte, chacha20poly1305.NonceSizeX, len(chunk)+overhead)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return err
+	}
+
+	buf = f.aead.Seal(buf, buf, chunk, chunkAD(index))
+
+	_, err := f.file.WriteAt(buf, chunkOffset(index))
+
+	return err
+}
+
+func (f *File) writeHeader() error {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+
+	header := make([]byte, len(magic)+chacha20poly1305.NonceSizeX, headerSize)
+	copy(header, magic)
+
+	nonce := header[len(magic):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	header = f.fs.keys.Seal(header, nonce, key, []byte(magic))
+
+	if _, err := f.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	return f.setKey(key)
+}
+
+func (f *File) readHeader() error {
+	header := make([]byte, headerSize)
+	if _, err := f.file.ReadAt(header, 0); err != nil && err != io.EOF {
+		return err
+	}
+
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		return errCorrupted
+	}
+
+	nonce := header[len(magic) : len(magic)+chacha20poly1305.NonceSizeX]
+
+	key, err := f.fs.keys.Open(nil, nonce, header[len(magic)+len(nonce):], []byte(magic))
+	if err != nil {
+		return errCorrupted
+	}
+
+	return f.setKey(key)
+}
+
+func (f *File) setKey(key []byte) error {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+
+	f.aead = aead
+
+	return nil
+}
+
+func (f *File) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (f *File) checkWritable(op string) error {
+	if f.dir || !f.writable() || f.aead == nil {
+		return &os.PathError{Op: op, Path: f.name, Err: errNotWritable}
+	}
+
+	return nil
+}
+
+// plainSize calculates the plaintext size of an encrypted file of the given size.
+func plainSize(size int64) int64 {
+	if size <= int64(headerSize) {
+		return 0
+	}
+
+	body := size - int64(headerSize)
+	full := body / (chunkSize + overhead)
+	rest := body % (chunkSize + overhead)
+
+	plain := full * chunkSize
+	if rest > overhead {
+		plain += rest - overhead
+	}
+
+	return plain
+}
+
+func chunkOffset(index int64) int64 {
+	return int64(headerSize) + index*(chunkSize+overhead)
+}
+
+func chunkAD(index int64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, uint64(index))
+
+	return ad
+}
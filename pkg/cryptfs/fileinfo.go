@@ -0,0 +1,34 @@
+package cryptfs
+
+import (
+	"os"
+)
+
+// fileInfo reports the plaintext name and size of an entry of the backend.
+type fileInfo struct {
+	os.FileInfo
+
+	name string
+	size int64
+}
+
+func newFileInfo(info os.FileInfo, name string) *fileInfo {
+	size := info.Size()
+	if info.Mode().IsRegular() {
+		size = plainSize(size)
+	}
+
+	return &fileInfo{
+		FileInfo: info,
+		name:     name,
+		size:     size,
+	}
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
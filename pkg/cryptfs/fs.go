@@ -0,0 +1,260 @@
+package cryptfs
+
+import (
+	"crypto/cipher"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Config selects the age keys used to unlock the master key of a backend.
+type Config struct {
+	// Identities decrypt the master key.
+	Identities []age.Identity
+	// Recipients are used to encrypt a newly created master key.
+	Recipients []age.Recipient
+	// EncryptNames encrypts file and directory names in addition to their content.
+	// Encrypted names grow by roughly 40%, so plaintext names longer than about
+	// 140 bytes can no longer be stored on backends limiting names to 255 bytes.
+	EncryptNames bool
+}
+
+// Fs is an afero.Fs encrypting file content, and optionally names, before
+// handing it to the wrapped backend. Content is split into independently
+// authenticated chunks, so random reads and writes only touch the chunks
+// they overlap.
+type Fs struct {
+	backend afero.Fs
+	keys    cipher.AEAD
+	names   cipher.AEAD
+	nameKey []byte
+}
+
+func NewFs(backend afero.Fs, cfg Config) (*Fs, error) {
+	master, err := loadMasterKey(backend, cfg.Identities, cfg.Recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := chacha20poly1305.NewX(deriveKey(master, "files"))
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &Fs{
+		backend: backend,
+		keys:    keys,
+	}
+
+	if cfg.EncryptNames {
+		if fs.names, err = chacha20poly1305.NewX(deriveKey(master, "names")); err != nil {
+			return nil, err
+		}
+
+		fs.nameKey = deriveKey(master, "name-nonces")
+	}
+
+	return fs, nil
+}
+
+func (fs *Fs) Name() string {
+	return "cryptfs"
+}
+
+func (fs *Fs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *Fs) Mkdir(name string, perm os.FileMode) error {
+	real, err := fs.realPath("mkdir", name)
+	if err != nil {
+		return err
+	}
+
+	return fs.backend.Mkdir(real, perm)
+}
+
+func (fs *Fs) MkdirAll(p string, perm os.FileMode) error {
+	real, err := fs.realPath("mkdir", p)
+	if err != nil {
+		return err
+	}
+
+	return fs.backend.MkdirAll(real, perm)
+}
+
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	real, err := fs.realPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := fs.backend.Stat(real); err == nil && info.IsDir() {
+		file, err := fs.backend.OpenFile(real, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+
+		return &File{fs: fs, file: file, name: name, flag: flag, dir: true}, nil
+	}
+
+	// Chunks are rewritten in place, which requires reading them back, and
+	// appending is done by the wrapper since the backend only sees ciphertext.
+	backendFlag := flag &^ os.O_APPEND
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		backendFlag = backendFlag&^os.O_WRONLY | os.O_RDWR
+	}
+
+	file, err := fs.backend.OpenFile(real, backendFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := newFile(fs, file, name, flag)
+	if err != nil {
+		file.Close()
+
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return f, nil
+}
+
+func (fs *Fs) Remove(name string) error {
+	real, err := fs.realPath("remove", name)
+	if err != nil {
+		return err
+	}
+
+	return fs.backend.Remove(real)
+}
+
+func (fs *Fs) RemoveAll(p string) error {
+	real, err := fs.realPath("removeall", p)
+	if err != nil {
+		return err
+	}
+
+	return fs.backend.RemoveAll(real)
+}
+
+func (fs *Fs) Rename(oldname, newname string) error {
+	oldReal, err := fs.realPath("rename", oldname)
+	if err != nil {
+		return err
+	}
+
+	newReal, err := fs.realPath("rename", newname)
+	if err != nil {
+		return err
+	}
+
+	return fs.backend.Rename(oldReal, newReal)
+}
+
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	real, err := fs.realPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := fs.backend.Stat(real)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := info.Name()
+	if fs.names != nil && real != "" && real != "/" {
+		plain = path.Base(name)
+	}
+
+	return newFileInfo(info, plain), nil
+}
+
+func (fs *Fs) Chmod(name string, mode os.FileMode) error {
+	real, err := fs.realPath("chmod", name)
+	if err != nil {
+		return err
+	}
+
+	return fs.backend.Chmod(real, mode)
+}
+
+func (fs *Fs) Chown(name string, uid, gid int) error {
+	real, err := fs.realPath("chown", name)
+	if err != nil {
+		return err
+	}
+
+	return fs.backend.Chown(real, uid, gid)
+}
+
+func (fs *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	real, err := fs.realPath("chtimes", name)
+	if err != nil {
+		return err
+	}
+
+	return fs.backend.Chtimes(real, atime, mtime)
+}
+
+// StatFS forwards the capacity of the backend if it is able to report it.
+func (fs *Fs) StatFS() (filesystem.Usage, error) {
+	if statfser, ok := fs.backend.(filesystem.StatFSer); ok {
+		return statfser.StatFS()
+	}
+
+	return filesystem.Usage{}, errors.New("backend does not report its capacity")
+}
+
+// SyncDir forwards syncing a directory to the backend.
+func (fs *Fs) SyncDir(name string) error {
+	real, err := fs.realPath("syncdir", name)
+	if err != nil {
+		return err
+	}
+
+	return filesystem.SyncDir(fs.backend, real)
+}
+
+// realPath translates a plaintext path to the path in the backend.
+func (fs *Fs) realPath(op string, name string) (string, error) {
+	if path.Clean("/"+name) == "/"+KeyFile {
+		return "", &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+
+	if fs.names == nil {
+		return name, nil
+	}
+
+	components := strings.Split(name, "/")
+	for i, component := range components {
+		if component == "" || component == "." || component == ".." {
+			continue
+		}
+
+		components[i] = fs.encryptName(component)
+	}
+
+	return strings.Join(components, "/"), nil
+}
+
+// plainName translates a name listed in the backend back to plaintext.
+func (fs *Fs) plainName(name string) (string, error) {
+	if fs.names == nil {
+		return name, nil
+	}
+
+	return fs.decryptName(name)
+}
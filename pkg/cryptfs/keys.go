@@ -0,0 +1,118 @@
+package cryptfs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"filippo.io/age"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// KeyFile is the name of the file in the root of the backend holding the
+// age-encrypted master key. It is hidden from directory listings.
+const KeyFile = ".sile-fystem.key.age"
+
+var errNoRecipients = errors.New("no recipients to encrypt the master key to")
+
+// loadMasterKey decrypts the master key of backend, creating it if it does not exist yet.
+func loadMasterKey(backend afero.Fs, identities []age.Identity, recipients []age.Recipient) ([]byte, error) {
+	data, err := afero.ReadFile(backend, "/"+KeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return createMasterKey(backend, recipients)
+	} else if err != nil {
+		return nil, err
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(data), identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, errors.New("invalid master key")
+	}
+
+	return key, nil
+}
+
+func createMasterKey(backend afero.Fs, recipients []age.Recipient) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errNoRecipients
+	}
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(key); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := afero.WriteFile(backend, "/"+KeyFile, buf.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// deriveKey derives a subkey of the master key for the given purpose.
+func deriveKey(master []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, master)
+	h.Write([]byte(purpose))
+
+	return h.Sum(nil)
+}
+
+// encryptName deterministically encrypts a single path component, so that
+// lookups by name keep working. The nonce is derived from the name itself.
+func (fs *Fs) encryptName(name string) string {
+	h := hmac.New(sha256.New, fs.nameKey)
+	h.Write([]byte(name))
+	nonce := h.Sum(nil)[:chacha20poly1305.NonceSizeX]
+
+	sealed := fs.names.Seal(append([]byte{}, nonce...), nonce, []byte(name), nil)
+
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func (fs *Fs) decryptName(name string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < chacha20poly1305.NonceSizeX {
+		return "", errors.New("invalid encrypted name")
+	}
+
+	plain, err := fs.names.Open(nil, sealed[:chacha20poly1305.NonceSizeX], sealed[chacha20poly1305.NonceSizeX:], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
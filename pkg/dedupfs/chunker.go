@@ -0,0 +1,91 @@
+package dedupfs
+
+import (
+	"io"
+)
+
+const (
+	minChunkSize = 16 * 1024
+	maxChunkSize = 256 * 1024
+
+	// chunkMask yields an average chunk size of 64 KiB on top of the minimum.
+	chunkMask = 1<<16 - 1
+)
+
+// gear maps bytes to random values for the rolling hash. It is generated
+// deterministically, as changing it would change all chunk boundaries and
+// thereby defeat deduplication against existing chunks.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+
+	state := uint64(0x5349_4c45_4659_5354)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks using a gear hash, so
+// that inserting or removing bytes only changes the chunks around the edit.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:   r,
+		buf: make([]byte, 0, maxChunkSize),
+	}
+}
+
+// next returns the next chunk, which is only valid until the following call.
+func (c *chunker) next() ([]byte, error) {
+	if !c.eof && len(c.buf) < maxChunkSize {
+		n, err := io.ReadFull(c.r, c.buf[len(c.buf):maxChunkSize])
+		c.buf = c.buf[:len(c.buf)+n]
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	cut := boundary(c.buf)
+
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf)
+
+	c.buf = c.buf[:copy(c.buf, c.buf[cut:])]
+
+	return chunk, nil
+}
+
+// boundary finds the end of the first chunk of buf.
+func boundary(buf []byte) int {
+	if len(buf) <= minChunkSize {
+		return len(buf)
+	}
+
+	var h uint64
+	for i := minChunkSize; i < len(buf); i++ {
+		h = h<<1 + gear[buf[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+
+	return len(buf)
+}
@@ -0,0 +1,462 @@
+package dedupfs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errNotWritable = errors.New("file not opened for writing")
+
+type chunkRef struct {
+	hash   string
+	offset int64
+	size   int64
+}
+
+// File is a handle to a file of the store.
+//
+// Writes go to a spool file holding the content from the start of the first
+// chunk they touch onwards; the chunks before it are left alone. On Sync or
+// Close the spool is split into chunks again. Content-defined chunking
+// yields the same boundaries for unchanged content, so appending to a file
+// only stores its last chunk anew.
+type File struct {
+	fs   *Fs
+	id   int64
+	name string
+	flag int
+
+	mu     sync.Mutex
+	chunks []chunkRef
+	size   int64
+	offset int64
+
+	spool *os.File
+	base  int64
+	dirty bool
+
+	cached      string
+	cachedChunk []byte
+}
+
+func newFile(fs *Fs, name string, flag int, info *fileInfo) (*File, error) {
+	f := &File{
+		fs:   fs,
+		id:   info.id,
+		name: name,
+		flag: flag,
+		size: info.size,
+	}
+
+	rows, err := fs.db.Query(`SELECT hash, size FROM file_chunks WHERE inode = ? ORDER BY seq`, info.id)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	defer rows.Close()
+
+	offset := int64(0)
+	for rows.Next() {
+		ref := chunkRef{offset: offset}
+		if err := rows.Scan(&ref.hash, &ref.size); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		f.chunks = append(f.chunks, ref)
+		offset += ref.size
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return f, nil
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.flush()
+
+	if f.spool != nil {
+		f.spool.Close()
+		os.Remove(f.spool.Name())
+		f.spool = nil
+	}
+
+	return err
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.readAt(p, off)
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	off := f.offset
+	if f.flag&os.O_APPEND != 0 {
+		off = f.size
+	}
+
+	n, err := f.writeAt(p, off)
+	f.offset = off + int64(n)
+
+	return n, err
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.writeAt(p, off)
+}
+
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	return nil, &os.PathError{Op: "readdirnames", Path: f.name, Err: errors.New("not a directory")}
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	info, err := f.fs.inode(f.id)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: err}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info.size = f.size
+
+	return info, nil
+}
+
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.flush()
+}
+
+func (f *File) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	if err := f.checkWritable("truncate"); err != nil {
+		return err
+	}
+
+	if err := f.spoolFrom(size); err != nil {
+		return err
+	}
+
+	if err := f.spool.Truncate(size - f.base); err != nil {
+		return err
+	}
+
+	f.size = size
+	f.dirty = true
+
+	return nil
+}
+
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off < f.size {
+		want := p[n:]
+		if rest := f.size - off; int64(len(want)) > rest {
+			want = want[:rest]
+		}
+
+		var (
+			c   int
+			err error
+		)
+
+		if f.spool != nil && off >= f.base {
+			if c, err = f.spool.ReadAt(want, off-f.base); err == io.EOF && c == len(want) {
+				err = nil
+			}
+		} else {
+			ref := f.chunks[f.chunkAt(off)]
+
+			var data []byte
+			if data, err = f.chunk(ref); err == nil {
+				c = copy(want, data[off-ref.offset:])
+			}
+		}
+
+		n += c
+		off += int64(c)
+
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *File) writeAt(p []byte, off int64) (int, error) {
+	if err := f.checkWritable("write"); err != nil {
+		return 0, err
+	}
+
+	if err := f.spoolFrom(off); err != nil {
+		return 0, err
+	}
+
+	n, err := f.spool.WriteAt(p, off-f.base)
+	if end := off + int64(n); end > f.size {
+		f.size = end
+	}
+
+	f.dirty = true
+
+	return n, err
+}
+
+// spoolFrom makes sure the spool covers the content from the start of the chunk holding off.
+func (f *File) spoolFrom(off int64) error {
+	base := int64(0)
+	if len(f.chunks) > 0 {
+		if off >= f.size {
+			off = f.size - 1
+		}
+
+		if f.spool != nil && f.base <= off {
+			return nil
+		}
+
+		if off >= 0 {
+			base = f.chunks[f.chunkAt(off)].offset
+		}
+	}
+
+	if f.spool != nil && f.base <= base {
+		return nil
+	}
+
+	spool, err := ioutil.TempFile(f.fs.spool, "spool-")
+	if err != nil {
+		return err
+	}
+
+	end := f.size
+	if f.spool != nil {
+		end = f.base
+	}
+
+	// Copy the chunks between the new and the previous start of the spool,
+	// followed by what the previous spool held.
+	for i := f.chunkAt(base); i < len(f.chunks) && f.chunks[i].offset < end; i++ {
+		data, err := f.chunk(f.chunks[i])
+		if err == nil {
+			_, err = spool.WriteAt(data, f.chunks[i].offset-base)
+		}
+
+		if err != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+
+			return err
+		}
+	}
+
+	if f.spool != nil {
+		_, err = f.spool.Seek(0, io.SeekStart)
+		if err == nil {
+			_, err = spool.Seek(f.base-base, io.SeekStart)
+		}
+		if err == nil {
+			_, err = io.Copy(spool, f.spool)
+		}
+
+		f.spool.Close()
+		os.Remove(f.spool.Name())
+
+		if err != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+			f.spool = nil
+
+			return err
+		}
+	}
+
+	f.spool = spool
+	f.base = base
+
+	return nil
+}
+
+// flush splits the spool into chunks and replaces the chunks following its start.
+func (f *File) flush() error {
+	if !f.dirty {
+		return nil
+	}
+
+	keep := f.chunks[:f.chunkAt(f.base)]
+	chunks := append([]chunkRef{}, keep...)
+
+	c := newChunker(io.NewSectionReader(f.spool, 0, f.size-f.base))
+	offset := f.base
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		hash, err := f.fs.chunks.put(data)
+		if err != nil {
+			return err
+		}
+
+		chunks = append(chunks, chunkRef{hash: hash, offset: offset, size: int64(len(data))})
+		offset += int64(len(data))
+	}
+
+	tx, err := f.fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE inodes SET size = ?, mtime = ? WHERE id = ?`, f.size, time.Now().UnixNano(), f.id)
+	if err != nil {
+		return err
+	}
+
+	if updated, err := res.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		// The file has been removed while it was open.
+		f.dirty = false
+
+		return nil
+	}
+
+	if _, err := tx.Exec(`DELETE FROM file_chunks WHERE inode = ? AND seq >= ?`, f.id, len(keep)); err != nil {
+		return err
+	}
+
+	for seq := len(keep); seq < len(chunks); seq++ {
+		if _, err := tx.Exec(
+			`INSERT INTO file_chunks (inode, seq, hash, size) VALUES (?, ?, ?, ?)`,
+			f.id, seq, chunks[seq].hash, chunks[seq].size,
+		); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	f.chunks = chunks
+	f.dirty = false
+
+	return nil
+}
+
+// chunkAt returns the index of the chunk holding off, or the number of chunks if it is past the end.
+func (f *File) chunkAt(off int64) int {
+	return sort.Search(len(f.chunks), func(i int) bool {
+		return f.chunks[i].offset+f.chunks[i].size > off
+	})
+}
+
+func (f *File) chunk(ref chunkRef) ([]byte, error) {
+	if ref.hash == f.cached {
+		return f.cachedChunk, nil
+	}
+
+	data, err := f.fs.chunks.get(ref.hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) != ref.size {
+		return nil, &os.PathError{Op: "read", Path: f.name, Err: errors.New("chunk has unexpected size")}
+	}
+
+	f.cached = ref.hash
+	f.cachedChunk = data
+
+	return data, nil
+}
+
+func (f *File) checkWritable(op string) error {
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: errNotWritable}
+	}
+
+	return nil
+}
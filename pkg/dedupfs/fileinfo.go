@@ -0,0 +1,144 @@
+package dedupfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+type fileInfo struct {
+	id    int64
+	name  string
+	mode  os.FileMode
+	mtime time.Time
+	size  int64
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.mtime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// dir is a handle to a directory of the store.
+type dir struct {
+	fs   *Fs
+	name string
+	info *fileInfo
+
+	entries []os.FileInfo
+	read    bool
+}
+
+func (d *dir) Name() string {
+	return d.name
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		children, err := d.fs.children(d.info.id)
+		if err != nil {
+			return nil, &os.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+
+		for _, child := range children {
+			d.entries = append(d.entries, child)
+		}
+
+		d.read = true
+	}
+
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+
+	return entries, nil
+}
+
+func (d *dir) Readdirnames(n int) ([]string, error) {
+	infos, err := d.Readdir(n)
+
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+
+	return names, err
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	return d.fs.Stat(d.name)
+}
+
+func (d *dir) Sync() error {
+	return nil
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, d.isDir("read")
+}
+
+func (d *dir) ReadAt(p []byte, off int64) (int, error) {
+	return 0, d.isDir("read")
+}
+
+func (d *dir) Seek(offset int64, whence int) (int64, error) {
+	return 0, d.isDir("seek")
+}
+
+func (d *dir) Write(p []byte) (int, error) {
+	return 0, d.isDir("write")
+}
+
+func (d *dir) WriteAt(p []byte, off int64) (int, error) {
+	return 0, d.isDir("write")
+}
+
+func (d *dir) WriteString(s string) (int, error) {
+	return 0, d.isDir("write")
+}
+
+func (d *dir) Truncate(size int64) error {
+	return d.isDir("truncate")
+}
+
+func (d *dir) isDir(op string) error {
+	return &os.PathError{Op: op, Path: d.name, Err: errors.New("is a directory")}
+}
@@ -0,0 +1,512 @@
+package dedupfs
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	rootID = 1
+
+	metadataFile = "metadata.sqlite"
+	chunksDir    = "chunks"
+	spoolDir     = "tmp"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS inodes (
+	id INTEGER PRIMARY KEY,
+	parent INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	mode INTEGER NOT NULL,
+	mtime INTEGER NOT NULL,
+	size INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (parent, name)
+);
+
+CREATE TABLE IF NOT EXISTS file_chunks (
+	inode INTEGER NOT NULL,
+	seq INTEGER NOT NULL,
+	hash TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	PRIMARY KEY (inode, seq)
+);
+
+CREATE INDEX IF NOT EXISTS file_chunks_hash ON file_chunks (hash);
+`
+
+// Fs is an afero.Fs storing file content as deduplicated, content-defined
+// chunks in a local directory. The directory tree and the chunk list of each
+// file are kept in a SQLite database next to the chunks.
+//
+// Chunks are never removed while files are written; unreferenced chunks are
+// reclaimed by GC.
+type Fs struct {
+	db     *sql.DB
+	chunks *chunkStore
+	spool  string
+}
+
+// NewFs opens the store in dir, creating it if it doesn't exist yet.
+func NewFs(dir string) (*Fs, error) {
+	for _, d := range []string{dir, filepath.Join(dir, chunksDir), filepath.Join(dir, spoolDir)} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open("sqlite", filepath.Join(dir, metadataFile)+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite serializes writers anyway; a single connection avoids busy errors
+	// between the connections of the pool.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	if _, err := db.Exec(
+		`INSERT OR IGNORE INTO inodes (id, parent, name, mode, mtime) VALUES (?, 0, '', ?, ?)`,
+		rootID, uint32(os.ModeDir|0755), time.Now().UnixNano(),
+	); err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	return &Fs{
+		db:     db,
+		chunks: &chunkStore{dir: filepath.Join(dir, chunksDir)},
+		spool:  filepath.Join(dir, spoolDir),
+	}, nil
+}
+
+// Close closes the metadata database.
+func (fs *Fs) Close() error {
+	return fs.db.Close()
+}
+
+// GC removes chunks no longer referenced by any file. Chunks written within
+// the grace period are kept, as they might belong to a file which is being
+// written concurrently. It returns the number of chunks removed and the bytes
+// freed.
+func (fs *Fs) GC(grace time.Duration) (int, int64, error) {
+	before := time.Now().Add(-grace)
+
+	rows, err := fs.db.Query(`SELECT DISTINCT hash FROM file_chunks`)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	referenced := map[string]bool{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+
+			return 0, 0, err
+		}
+
+		referenced[hash] = true
+	}
+
+	if err := rows.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	return fs.chunks.sweep(referenced, before)
+}
+
+func (fs *Fs) Name() string {
+	return "dedupfs"
+}
+
+func (fs *Fs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *Fs) Mkdir(name string, perm os.FileMode) error {
+	parent, base, err := fs.resolveParent(name)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	if _, err := fs.insert(parent, base, os.ModeDir|perm.Perm()); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (fs *Fs) MkdirAll(p string, perm os.FileMode) error {
+	current := ""
+	for _, component := range components(p) {
+		current += "/" + component
+
+		info, err := fs.Stat(current)
+		if err == nil {
+			if !info.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: current, Err: syscall.ENOTDIR}
+			}
+
+			continue
+		}
+
+		if err := fs.Mkdir(current, perm); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	info, err := fs.lookup(name)
+	if errors.Is(err, os.ErrNotExist) && flag&os.O_CREATE != 0 {
+		parent, base, perr := fs.resolveParent(name)
+		if perr != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: perr}
+		}
+
+		if _, err := fs.insert(parent, base, perm.Perm()); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		info, err = fs.lookup(name)
+	} else if err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if info.IsDir() {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+
+		return &dir{fs: fs, name: name, info: info}, nil
+	}
+
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 && info.size > 0 {
+		if err := fs.truncate(info.id); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		info.size = 0
+	}
+
+	return newFile(fs, name, flag, info)
+}
+
+func (fs *Fs) Remove(name string) error {
+	info, err := fs.lookup(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	if info.id == rootID {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+
+	if info.IsDir() {
+		var children int
+		if err := fs.db.QueryRow(`SELECT COUNT(*) FROM inodes WHERE parent = ?`, info.id).Scan(&children); err != nil {
+			return &os.PathError{Op: "remove", Path: name, Err: err}
+		}
+
+		if children > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	if err := fs.delete(info.id); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (fs *Fs) RemoveAll(p string) error {
+	info, err := fs.lookup(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return &os.PathError{Op: "removeall", Path: p, Err: err}
+	}
+
+	if info.id == rootID {
+		return &os.PathError{Op: "removeall", Path: p, Err: os.ErrPermission}
+	}
+
+	if err := fs.delete(info.id); err != nil {
+		return &os.PathError{Op: "removeall", Path: p, Err: err}
+	}
+
+	return nil
+}
+
+func (fs *Fs) Rename(oldname, newname string) error {
+	info, err := fs.lookup(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	// A directory can't be moved into itself.
+	oldPath, newPath := path.Clean("/"+oldname), path.Clean("/"+newname)
+	if info.IsDir() && strings.HasPrefix(newPath, oldPath+"/") {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+	}
+
+	parent, base, err := fs.resolveParent(newname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	if target, err := fs.lookup(newname); err == nil {
+		if target.id == info.id {
+			return nil
+		}
+
+		if target.IsDir() != info.IsDir() {
+			if target.IsDir() {
+				return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EISDIR}
+			}
+
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.ENOTDIR}
+		}
+
+		if err := fs.Remove(newname); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+	}
+
+	if _, err := fs.db.Exec(`UPDATE inodes SET parent = ?, name = ? WHERE id = ?`, parent, base, info.id); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	return nil
+}
+
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.lookup(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return info, nil
+}
+
+func (fs *Fs) Chmod(name string, mode os.FileMode) error {
+	info, err := fs.lookup(name)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+
+	if _, err := fs.db.Exec(`UPDATE inodes SET mode = ? WHERE id = ?`, uint32(info.mode.Type()|mode.Perm()), info.id); err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// Chown is a no-op, as the store doesn't keep track of owners.
+func (fs *Fs) Chown(name string, uid, gid int) error {
+	if _, err := fs.lookup(name); err != nil {
+		return &os.PathError{Op: "chown", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (fs *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	info, err := fs.lookup(name)
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+
+	if _, err := fs.db.Exec(`UPDATE inodes SET mtime = ? WHERE id = ?`, mtime.UnixNano(), info.id); err != nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// lookup resolves a path to its inode.
+func (fs *Fs) lookup(name string) (*fileInfo, error) {
+	info, err := fs.inode(rootID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, component := range components(name) {
+		if !info.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+
+		if info, err = fs.child(info.id, component); err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
+
+// resolveParent resolves the parent directory of a path and returns it with the base name.
+func (fs *Fs) resolveParent(name string) (int64, string, error) {
+	parts := components(name)
+	if len(parts) == 0 {
+		return 0, "", os.ErrExist
+	}
+
+	parent, err := fs.lookup(strings.Join(parts[:len(parts)-1], "/"))
+	if err != nil {
+		return 0, "", err
+	}
+
+	if !parent.IsDir() {
+		return 0, "", syscall.ENOTDIR
+	}
+
+	return parent.id, parts[len(parts)-1], nil
+}
+
+func (fs *Fs) inode(id int64) (*fileInfo, error) {
+	return scanInfo(fs.db.QueryRow(`SELECT id, name, mode, mtime, size FROM inodes WHERE id = ?`, id))
+}
+
+func (fs *Fs) child(parent int64, name string) (*fileInfo, error) {
+	return scanInfo(fs.db.QueryRow(`SELECT id, name, mode, mtime, size FROM inodes WHERE parent = ? AND name = ?`, parent, name))
+}
+
+func (fs *Fs) children(parent int64) ([]*fileInfo, error) {
+	rows, err := fs.db.Query(`SELECT id, name, mode, mtime, size FROM inodes WHERE parent = ? ORDER BY name`, parent)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	infos := []*fileInfo{}
+	for rows.Next() {
+		info, err := scanInfo(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, rows.Err()
+}
+
+func (fs *Fs) insert(parent int64, name string, mode os.FileMode) (int64, error) {
+	res, err := fs.db.Exec(
+		`INSERT INTO inodes (parent, name, mode, mtime) VALUES (?, ?, ?, ?)`,
+		parent, name, uint32(mode), time.Now().UnixNano(),
+	)
+	if err != nil {
+		if _, lerr := fs.child(parent, name); lerr == nil {
+			return 0, os.ErrExist
+		}
+
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+// delete removes an inode, its descendants and their chunk lists.
+func (fs *Fs) delete(id int64) error {
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const subtree = `WITH RECURSIVE subtree (id) AS (
+		SELECT ?
+		UNION ALL
+		SELECT inodes.id FROM inodes JOIN subtree ON inodes.parent = subtree.id
+	)`
+
+	if _, err := tx.Exec(subtree+` DELETE FROM file_chunks WHERE inode IN (SELECT id FROM subtree)`, id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(subtree+` DELETE FROM inodes WHERE id IN (SELECT id FROM subtree)`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (fs *Fs) truncate(id int64) error {
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM file_chunks WHERE inode = ?`, id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE inodes SET size = 0, mtime = ? WHERE id = ?`, time.Now().UnixNano(), id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanInfo(row scanner) (*fileInfo, error) {
+	var (
+		info  fileInfo
+		mode  uint32
+		mtime int64
+	)
+
+	if err := row.Scan(&info.id, &info.name, &mode, &mtime, &info.size); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, os.ErrNotExist
+		}
+
+		return nil, err
+	}
+
+	info.mode = os.FileMode(mode)
+	info.mtime = time.Unix(0, mtime)
+
+	return &info, nil
+}
+
+func components(name string) []string {
+	clean := strings.Trim(path.Clean("/"+name), "/")
+	if clean == "" {
+		return nil
+	}
+
+	return strings.Split(clean, "/")
+}
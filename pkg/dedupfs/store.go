@@ -0,0 +1,95 @@
+package dedupfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// chunkStore keeps chunks as files named by the SHA-256 of their content.
+type chunkStore struct {
+	dir string
+}
+
+func (s *chunkStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// put stores a chunk unless it exists already and returns its hash.
+func (s *chunkStore) put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	p := s.path(hash)
+
+	// Touch existing chunks, so that a concurrent GC treats them as new.
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err == nil {
+		return hash, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+func (s *chunkStore) get(hash string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(hash))
+}
+
+// sweep removes all chunks which aren't referenced and were last written
+// before the given time. It returns the number of chunks removed and the
+// bytes freed.
+func (s *chunkStore) sweep(referenced map[string]bool, before time.Time) (int, int64, error) {
+	removed := 0
+	freed := int64(0)
+
+	err := filepath.Walk(s.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || referenced[info.Name()] || !info.ModTime().Before(before) {
+			return nil
+		}
+
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+
+		removed++
+		freed += info.Size()
+
+		return nil
+	})
+
+	return removed, freed, err
+}
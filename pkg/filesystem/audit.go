@@ -0,0 +1,173 @@
+package filesystem
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/audit"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// WithAuditLog records every operation changing the filesystem, including
+// the ones which failed, in log. Writes are recorded once per opened file.
+func WithAuditLog(log *audit.Log) Option {
+	return func(fs *fileSystem) {
+		fs.audit = log
+	}
+}
+
+// auditor is the interceptor writing the audit log.
+type auditor struct {
+	fs  *fileSystem
+	log *audit.Log
+
+	mu      sync.Mutex
+	handles map[fuseops.HandleID]*auditedHandle
+}
+
+// auditedHandle collects the writes to an opened file.
+type auditedHandle struct {
+	path   string
+	opener fuseops.OpContext
+	bytes  int64
+	writes int
+	err    error
+}
+
+func newAuditor(fs *fileSystem) *auditor {
+	return &auditor{
+		fs:      fs,
+		log:     fs.audit,
+		handles: make(map[fuseops.HandleID]*auditedHandle),
+	}
+}
+
+func (a *auditor) Intercept(ctx context.Context, op interface{}, next Handler) error {
+	switch op := op.(type) {
+	case *fuseops.MkDirOp:
+		return a.record(ctx, "mkdir", a.fs.childPath(op.Parent, op.Name), "", op.OpContext, next)
+	case *fuseops.MkNodeOp:
+		return a.record(ctx, "mknod", a.fs.childPath(op.Parent, op.Name), "", op.OpContext, next)
+	case *fuseops.CreateFileOp:
+		p := a.fs.childPath(op.Parent, op.Name)
+
+		err := a.record(ctx, "create", p, "", op.OpContext, next)
+		if err == nil {
+			a.open(op.Handle, p, op.OpContext)
+		}
+
+		return err
+	case *fuseops.CreateSymlinkOp:
+		return a.record(ctx, "symlink", a.fs.childPath(op.Parent, op.Name), "", op.OpContext, next)
+	case *fuseops.CreateLinkOp:
+		return a.record(ctx, "link", a.fs.inodePath(op.Target), a.fs.childPath(op.Parent, op.Name), op.OpContext, next)
+	case *fuseops.RenameOp:
+		return a.record(ctx, "rename", a.fs.childPath(op.OldParent, op.OldName), a.fs.childPath(op.NewParent, op.NewName), op.OpContext, next)
+	case *fuseops.UnlinkOp:
+		return a.record(ctx, "unlink", a.fs.childPath(op.Parent, op.Name), "", op.OpContext, next)
+	case *fuseops.RmDirOp:
+		return a.record(ctx, "rmdir", a.fs.childPath(op.Parent, op.Name), "", op.OpContext, next)
+	case *fuseops.SetInodeAttributesOp:
+		return a.record(ctx, "setattr", a.fs.inodePath(op.Inode), "", op.OpContext, next)
+	case *fuseops.SetXattrOp:
+		return a.record(ctx, "setxattr", a.fs.inodePath(op.Inode), "", op.OpContext, next)
+	case *fuseops.RemoveXattrOp:
+		return a.record(ctx, "removexattr", a.fs.inodePath(op.Inode), "", op.OpContext, next)
+	case *fuseops.OpenFileOp:
+		err := next(ctx)
+		if err == nil {
+			a.open(op.Handle, a.fs.inodePath(op.Inode), op.OpContext)
+		}
+
+		return err
+	case *fuseops.WriteFileOp:
+		err := next(ctx)
+		a.write(op.Handle, int64(len(op.Data)), err)
+
+		return err
+	case *fuseops.ReleaseFileHandleOp:
+		a.release(ctx, op.Handle)
+
+		return next(ctx)
+	default:
+		return next(ctx)
+	}
+}
+
+// record dispatches an operation and writes its result to the log.
+func (a *auditor) record(ctx context.Context, name string, p string, newPath string, caller fuseops.OpContext, next Handler) error {
+	err := next(ctx)
+
+	a.writeRecord(ctx, audit.Record{
+		Op:      name,
+		Path:    p,
+		NewPath: newPath,
+	}, caller, err)
+
+	return err
+}
+
+func (a *auditor) open(id fuseops.HandleID, p string, opener fuseops.OpContext) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.handles[id] = &auditedHandle{path: p, opener: opener}
+}
+
+func (a *auditor) write(id fuseops.HandleID, bytes int64, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	h, ok := a.handles[id]
+	if !ok {
+		return
+	}
+
+	h.writes++
+	h.bytes += bytes
+	if h.err == nil {
+		h.err = err
+	}
+}
+
+// release records the writes to a file once it is closed.
+func (a *auditor) release(ctx context.Context, id fuseops.HandleID) {
+	a.mu.Lock()
+	h, ok := a.handles[id]
+	delete(a.handles, id)
+	a.mu.Unlock()
+
+	if !ok || h.writes == 0 {
+		return
+	}
+
+	a.writeRecord(ctx, audit.Record{
+		Op:    "write",
+		Path:  h.path,
+		Bytes: h.bytes,
+	}, h.opener, h.err)
+}
+
+func (a *auditor) writeRecord(ctx context.Context, record audit.Record, caller fuseops.OpContext, err error) {
+	record.Time = time.Now()
+	record.Uid = caller.Uid
+	record.Pid = caller.Pid
+	record.Result = "ok"
+	if err != nil {
+		record.Result = err.Error()
+	}
+
+	if process, err := lookUpCaller(ctx, caller.Pid); err == nil {
+		record.Process = process.Name
+		record.Gid = process.Gid
+	}
+
+	if err := a.log.Write(record); err != nil {
+		a.fs.log.Error("FUSE.audit", map[string]interface{}{
+			"op":   record.Op,
+			"path": record.Path,
+			"err":  err,
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package filesystem
+
+import (
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// Xattrer is an optional interface for backends supporting extended attributes.
+// Backends not implementing it silently ignore xattr operations.
+type Xattrer interface {
+	GetXattr(name string, attr string) ([]byte, error)
+	ListXattr(name string) ([]string, error)
+	SetXattr(name string, attr string, value []byte, flags int) error
+	RemoveXattr(name string, attr string) error
+}
+
+// Usage describes the capacity of a backend in bytes and inodes.
+type Usage struct {
+	TotalBytes  uint64
+	FreeBytes   uint64
+	TotalInodes uint64
+	FreeInodes  uint64
+}
+
+// StatFSer is an optional interface for backends able to report their capacity.
+type StatFSer interface {
+	StatFS() (Usage, error)
+}
+
+// Streamer is an optional interface for backends serving files whose size
+// isn't known before they are read, like streams. They are opened with direct
+// I/O, so that reads aren't cut off at the size reported by their attributes.
+type Streamer interface {
+	IsStream(name string) bool
+}
+
+// DirSyncer is an optional interface for backends which persist created and
+// renamed entries of a directory only once the directory itself is synced.
+type DirSyncer interface {
+	SyncDir(name string) error
+}
+
+// SyncDir syncs the directory name of backend if the backend requires it.
+// The filesystem of the OS does, so afero.OsFs is synced even though it
+// doesn't implement DirSyncer. Layers wrapping a backend forward to it.
+func SyncDir(backend afero.Fs, name string) error {
+	switch b := backend.(type) {
+	case DirSyncer:
+		return b.SyncDir(name)
+	case *afero.OsFs:
+		dir, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+
+		return dir.Sync()
+	}
+
+	return nil
+}
+
+// HardLinker is an optional interface for backends supporting hard links.
+// Links to files of other backends only exist in the index until the
+// filesystem is unmounted.
+type HardLinker interface {
+	Link(oldname string, newname string) error
+}
+
+// hardLinker returns the function linking files of backend if it supports
+// hard links. The filesystem of the OS does, so afero.OsFs is linked even
+// though it doesn't implement HardLinker.
+func hardLinker(backend afero.Fs) (func(oldname string, newname string) error, bool) {
+	switch b := backend.(type) {
+	case HardLinker:
+		return b.Link, true
+	case *afero.OsFs:
+		return os.Link, true
+	}
+
+	return nil, false
+}
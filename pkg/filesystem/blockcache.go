@@ -0,0 +1,717 @@
+package filesystem
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/spf13/afero"
+)
+
+// BlockCache configures the cache of file content in memory, which keeps the
+// files of the backend open while they are opened through the mount, reads
+// ahead of sequential reads and coalesces writes until the file is flushed.
+type BlockCache struct {
+	// BlockSize is the unit content is read, cached and written back in.
+	BlockSize int
+	// Memory is the budget of all cached blocks, including the ones which
+	// weren't written back yet.
+	Memory int64
+	// ReadAhead is the number of blocks read in advance of sequential reads.
+	ReadAhead int
+}
+
+// DefaultBlockCache is used for the fields of a BlockCache which are zero.
+var DefaultBlockCache = BlockCache{
+	BlockSize: 128 * 1024,
+	Memory:    64 * 1024 * 1024,
+	ReadAhead: 8,
+}
+
+// WithBlockCache caches the content of files in memory. It is ignored in sync
+// mode, which keeps the opened file itself.
+func WithBlockCache(config BlockCache) Option {
+	return func(fs *fileSystem) {
+		if config.BlockSize <= 0 {
+			config.BlockSize = DefaultBlockCache.BlockSize
+		}
+
+		if config.Memory <= 0 {
+			config.Memory = DefaultBlockCache.Memory
+		}
+
+		if config.ReadAhead < 0 {
+			config.ReadAhead = 0
+		} else if config.ReadAhead == 0 {
+			config.ReadAhead = DefaultBlockCache.ReadAhead
+		}
+
+		fs.cache = newBlockCache(config)
+	}
+}
+
+// blockCache caches the content of opened files. A nil cache caches nothing,
+// so that the operations fall back to the backend.
+//
+// The lock of a cached file guards its blocks and the backend I/O on it, mu
+// guards the files, the LRU list and the budget. A file is locked before mu,
+// which is never held during backend I/O.
+type blockCache struct {
+	config BlockCache
+
+	mu    sync.Mutex
+	files map[fuseops.InodeID]*cachedFile
+	lru   *list.List
+	used  int64
+
+	// written is called with the path of a file after blocks were written back to it.
+	written func(p string)
+}
+
+// cachedFile is a file of the backend kept open while it is opened through
+// the mount. It is opened read-only, and only reopened for writing once blocks
+// are written back to it.
+type cachedFile struct {
+	file     afero.File
+	writable bool
+	// backend and path are where the file is reopened for writing. The path is
+	// guarded by the lock of the file.
+	backend afero.Fs
+	path    string
+	// reopened is set once the file was reopened for writing.
+	reopened bool
+	// refs is guarded by the lock of the cache.
+	refs int
+
+	mu     sync.Mutex
+	blocks map[int64]*list.Element
+	// closed is set once the file was dropped from the cache.
+	closed bool
+
+	// size includes writes which weren't written back yet.
+	size int64
+	// next is the offset a sequential read continues at.
+	next int64
+}
+
+type block struct {
+	file  *cachedFile
+	index int64
+	data  []byte
+	dirty bool
+}
+
+func newBlockCache(config BlockCache) *blockCache {
+	return &blockCache{
+		config: config,
+		files:  map[fuseops.InodeID]*cachedFile{},
+		lru:    list.New(),
+	}
+}
+
+// open keeps the backend file at p open until the last handle of the inode is
+// released. Inodes which can't be opened aren't cached.
+func (c *blockCache) open(id fuseops.InodeID, backend afero.Fs, p string, writable bool) {
+	if c == nil {
+		return
+	}
+
+	if c.ref(id) {
+		return
+	}
+
+	file, err := backend.OpenFile(p, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The inode may have been opened concurrently.
+	if f, ok := c.files[id]; ok {
+		f.refs++
+		file.Close()
+
+		return
+	}
+
+	c.files[id] = &cachedFile{
+		file:     file,
+		writable: writable,
+		backend:  backend,
+		path:     p,
+		refs:     1,
+		blocks:   map[int64]*list.Element{},
+		size:     info.Size(),
+	}
+}
+
+// ref adds a reference to a cached inode. It returns false if the inode isn't cached.
+func (c *blockCache) ref(id fuseops.InodeID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.files[id]
+	if ok {
+		f.refs++
+	}
+
+	return ok
+}
+
+// lock returns the cached file of an inode with its lock held. It returns
+// false if the inode isn't cached.
+func (c *blockCache) lock(id fuseops.InodeID) (*cachedFile, bool) {
+	for {
+		c.mu.Lock()
+		f, ok := c.files[id]
+		c.mu.Unlock()
+
+		if !ok {
+			return nil, false
+		}
+
+		f.mu.Lock()
+		if !f.closed {
+			return f, true
+		}
+		f.mu.Unlock()
+
+		// The file was dropped while waiting for it, the inode may have been opened again meanwhile.
+	}
+}
+
+// release writes back the blocks of an inode, and closes its file and drops
+// its blocks once the last handle is released.
+func (c *blockCache) release(id fuseops.InodeID) error {
+	if c == nil {
+		return nil
+	}
+
+	f, ok := c.lock(id)
+	if !ok {
+		return nil
+	}
+	defer f.mu.Unlock()
+
+	err := c.flushFile(f)
+
+	c.mu.Lock()
+	f.refs--
+	last := f.refs == 0
+	if last {
+		c.dropFile(id, f)
+	}
+	c.mu.Unlock()
+
+	if !last {
+		return err
+	}
+
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// move follows a rename of an inode in the path its file is reopened at.
+func (c *blockCache) move(id fuseops.InodeID, p string) {
+	if c == nil {
+		return
+	}
+
+	f, ok := c.lock(id)
+	if !ok {
+		return
+	}
+	defer f.mu.Unlock()
+
+	f.path = p
+}
+
+// read reads from the cache. It returns false if the inode isn't cached.
+func (c *blockCache) read(id fuseops.InodeID, dst []byte, off int64) (int, bool, error) {
+	if c == nil {
+		return 0, false, nil
+	}
+
+	f, ok := c.lock(id)
+	if !ok {
+		return 0, false, nil
+	}
+
+	n, err := c.readFile(f, dst, off)
+	f.mu.Unlock()
+
+	if err != nil {
+		return n, true, err
+	}
+
+	return n, true, c.evict()
+}
+
+func (c *blockCache) readFile(f *cachedFile, dst []byte, off int64) (int, error) {
+	sequential := off == f.next
+
+	bs := int64(c.config.BlockSize)
+
+	n := 0
+	for n < len(dst) && off+int64(n) < f.size {
+		pos := off + int64(n)
+		index := pos / bs
+
+		ahead := 0
+		if sequential {
+			ahead = c.config.ReadAhead
+		}
+
+		b, err := c.load(f, index, ahead)
+		if err != nil {
+			return n, err
+		}
+
+		start := int(pos - index*bs)
+		if start >= len(b.data) {
+			break
+		}
+
+		n += copy(dst[n:], b.data[start:])
+	}
+
+	f.next = off + int64(n)
+
+	return n, nil
+}
+
+// write writes into the cache, where the content stays until it is flushed or
+// evicted. It returns false if the inode isn't cached or not writable.
+func (c *blockCache) write(id fuseops.InodeID, data []byte, off int64) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+
+	f, ok := c.lock(id)
+	if !ok {
+		return false, nil
+	}
+
+	if !f.writable {
+		f.mu.Unlock()
+
+		return false, nil
+	}
+
+	err := c.writeFile(f, data, off)
+	f.mu.Unlock()
+
+	if err != nil {
+		return true, err
+	}
+
+	return true, c.evict()
+}
+
+func (c *blockCache) writeFile(f *cachedFile, data []byte, off int64) error {
+	bs := int64(c.config.BlockSize)
+
+	n := 0
+	for n < len(data) {
+		pos := off + int64(n)
+		index := pos / bs
+		start := pos - index*bs
+		end := start + int64(len(data)-n)
+		if end > bs {
+			end = bs
+		}
+
+		var b *block
+		if _, ok := f.blocks[index]; ok || (start != 0 || end != bs) && index*bs < f.size {
+			var err error
+			if b, err = c.load(f, index, 0); err != nil {
+				return err
+			}
+		} else {
+			// Nothing of the block has to be read if it is overwritten as a whole or beyond the end.
+			c.mu.Lock()
+			b = c.insert(f, index, nil)
+			c.mu.Unlock()
+		}
+
+		if int64(len(b.data)) < end {
+			grown := make([]byte, end, bs)
+			copy(grown, b.data)
+
+			b.data = grown
+		}
+
+		n += copy(b.data[start:end], data[n:])
+		b.dirty = true
+
+		if pos+(end-start) > f.size {
+			f.size = pos + (end - start)
+		}
+	}
+
+	return nil
+}
+
+// size returns the size of an inode including content which wasn't written back yet.
+func (c *blockCache) size(id fuseops.InodeID) (int64, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	f, ok := c.lock(id)
+	if !ok {
+		return 0, false
+	}
+	defer f.mu.Unlock()
+
+	return f.size, true
+}
+
+// flush writes back the blocks of an inode.
+func (c *blockCache) flush(id fuseops.InodeID) error {
+	if c == nil {
+		return nil
+	}
+
+	f, ok := c.lock(id)
+	if !ok {
+		return nil
+	}
+	defer f.mu.Unlock()
+
+	return c.flushFile(f)
+}
+
+// sync writes back the blocks of an inode and syncs its file in the backend.
+// It returns false if the inode isn't cached.
+func (c *blockCache) sync(id fuseops.InodeID) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+
+	f, ok := c.lock(id)
+	if !ok {
+		return false, nil
+	}
+	defer f.mu.Unlock()
+
+	if err := c.flushFile(f); err != nil {
+		return true, err
+	}
+
+	return true, f.file.Sync()
+}
+
+// flushAll writes back the blocks of all inodes.
+func (c *blockCache) flushAll() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	files := make([]*cachedFile, 0, len(c.files))
+	for _, f := range c.files {
+		files = append(files, f)
+	}
+	c.mu.Unlock()
+
+	for _, f := range files {
+		f.mu.Lock()
+		err := c.flushFile(f)
+		f.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// invalidate drops the blocks of an inode which was changed in the backend,
+// keeping the ones which weren't written back yet.
+func (c *blockCache) invalidate(id fuseops.InodeID) {
+	if c == nil {
+		return
+	}
+
+	f, ok := c.lock(id)
+	if !ok {
+		return
+	}
+	defer f.mu.Unlock()
+
+	var dirty int64
+
+	c.mu.Lock()
+	for index, e := range f.blocks {
+		b := e.Value.(*block)
+		if b.dirty {
+			if end := index*int64(c.config.BlockSize) + int64(len(b.data)); end > dirty {
+				dirty = end
+			}
+
+			continue
+		}
+
+		c.remove(e)
+	}
+	c.mu.Unlock()
+
+	if info, err := f.file.Stat(); err == nil {
+		f.size = info.Size()
+	}
+	if dirty > f.size {
+		f.size = dirty
+	}
+}
+
+// drop forgets an inode which was removed, including what wasn't written back yet.
+func (c *blockCache) drop(id fuseops.InodeID) {
+	if c == nil {
+		return
+	}
+
+	f, ok := c.lock(id)
+	if !ok {
+		return
+	}
+	defer f.mu.Unlock()
+
+	c.mu.Lock()
+	c.dropFile(id, f)
+	c.mu.Unlock()
+
+	f.file.Close()
+}
+
+// load returns a block, reading it and up to ahead blocks following it from
+// the backend in a single read if it isn't cached. The caller must hold the
+// lock of the file.
+func (c *blockCache) load(f *cachedFile, index int64, ahead int) (*block, error) {
+	if e, ok := f.blocks[index]; ok {
+		c.mu.Lock()
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+
+		return e.Value.(*block), nil
+	}
+
+	bs := int64(c.config.BlockSize)
+
+	count := int64(1)
+	for count <= int64(ahead) && (index+count)*bs < f.size {
+		if _, ok := f.blocks[index+count]; ok {
+			break
+		}
+
+		count++
+	}
+
+	buf := make([]byte, count*bs)
+	n, err := f.file.ReadAt(buf, index*bs)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// Content beyond the end of the backend which is within the size are
+	// holes left by writes beyond the end, which read as zeros.
+	valid := f.size - index*bs
+	if valid > int64(len(buf)) {
+		valid = int64(len(buf))
+	}
+	if int64(n) < valid {
+		n = int(valid)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The requested block is inserted last, so that it is the most recently used one.
+	var b *block
+	for i := count - 1; i >= 0; i-- {
+		start := i * bs
+		if start >= int64(n) && i > 0 {
+			continue
+		}
+
+		end := start + bs
+		if end > int64(n) {
+			end = int64(n)
+		}
+
+		b = c.insert(f, index+i, buf[start:end:start+bs])
+	}
+
+	return b, nil
+}
+
+// insert adds a block to a file. The caller must hold the lock of the file and mu.
+func (c *blockCache) insert(f *cachedFile, index int64, data []byte) *block {
+	b := &block{file: f, index: index, data: data}
+
+	f.blocks[index] = c.lru.PushFront(b)
+	c.used += int64(c.config.BlockSize)
+
+	return b
+}
+
+// remove drops a block. The caller must hold the lock of its file and mu.
+func (c *blockCache) remove(e *list.Element) {
+	b := e.Value.(*block)
+
+	delete(b.file.blocks, b.index)
+	c.lru.Remove(e)
+	c.used -= int64(c.config.BlockSize)
+}
+
+// evict drops the least recently used blocks until the cache fits into its
+// budget, writing them back first if necessary. The most recently used
+// block is always kept. The caller must not hold the lock of any file.
+func (c *blockCache) evict() error {
+	for {
+		c.mu.Lock()
+		if c.used <= c.config.Memory || c.lru.Len() <= 1 {
+			c.mu.Unlock()
+
+			return nil
+		}
+
+		e := c.lru.Back()
+		f := e.Value.(*block).file
+		c.mu.Unlock()
+
+		if err := c.evictBlock(f, e); err != nil {
+			return err
+		}
+	}
+}
+
+// evictBlock drops a block of a file unless it was dropped or used meanwhile.
+func (c *blockCache) evictBlock(f *cachedFile, e *list.Element) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b := e.Value.(*block)
+	if f.blocks[b.index] != e {
+		return nil
+	}
+
+	if b.dirty {
+		if err := c.flushFile(f); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lru.Front() != e {
+		c.remove(e)
+	}
+
+	return nil
+}
+
+// flushFile writes back the blocks of a file, coalescing adjacent blocks into
+// a single write. The caller must hold the lock of the file.
+func (c *blockCache) flushFile(f *cachedFile) error {
+	var dirty []*block
+	for _, e := range f.blocks {
+		if b := e.Value.(*block); b.dirty {
+			dirty = append(dirty, b)
+		}
+	}
+
+	sort.Slice(dirty, func(i, j int) bool {
+		return dirty[i].index < dirty[j].index
+	})
+
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	if err := f.reopen(); err != nil {
+		return err
+	}
+
+	bs := int64(c.config.BlockSize)
+
+	for i := 0; i < len(dirty); {
+		j := i + 1
+		for j < len(dirty) && dirty[j].index == dirty[j-1].index+1 && int64(len(dirty[j-1].data)) == bs {
+			j++
+		}
+
+		run := dirty[i:j]
+
+		data := run[0].data
+		if len(run) > 1 {
+			data = make([]byte, 0, int64(len(run))*bs)
+			for _, b := range run {
+				data = append(data, b.data...)
+			}
+		}
+
+		if _, err := f.file.WriteAt(data, run[0].index*bs); err != nil {
+			return err
+		}
+
+		for _, b := range run {
+			b.dirty = false
+		}
+
+		i = j
+	}
+
+	if c.written != nil {
+		c.written(f.path)
+	}
+
+	return nil
+}
+
+// reopen replaces the read-only file of a cached file with one opened for
+// writing. The caller must hold the lock of the file.
+func (f *cachedFile) reopen() error {
+	if f.reopened {
+		return nil
+	}
+
+	file, err := f.backend.OpenFile(f.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	f.file.Close()
+
+	f.file = file
+	f.reopened = true
+
+	return nil
+}
+
+// dropFile forgets a file. The caller must hold the lock of the file and mu.
+func (c *blockCache) dropFile(id fuseops.InodeID, f *cachedFile) {
+	for _, e := range f.blocks {
+		c.remove(e)
+	}
+
+	delete(c.files, id)
+	f.closed = true
+}
@@ -0,0 +1,197 @@
+package filesystem
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// EventType is the kind of change reported by an Event.
+type EventType string
+
+const (
+	// EventCreate reports a new file, device, symlink or hard link.
+	EventCreate EventType = "create"
+	// EventWrite reports that a file written to was closed.
+	EventWrite    EventType = "write"
+	EventRename   EventType = "rename"
+	EventUnlink   EventType = "unlink"
+	EventMkdir    EventType = "mkdir"
+	EventRmdir    EventType = "rmdir"
+	EventChmod    EventType = "chmod"
+	EventSetxattr EventType = "setxattr"
+)
+
+// Event is a change made through the mount.
+type Event struct {
+	Type EventType
+	// Path is the path of the file in the mount, e.g. /foo/bar.
+	Path string
+	// NewPath is the path a file was renamed to.
+	NewPath string
+	Inode   fuseops.InodeID
+	// Pid and Uid identify the process which made the change.
+	Pid  uint32
+	Uid  uint32
+	Time time.Time
+}
+
+// Subscription receives the events of a filesystem until it is closed.
+type Subscription struct {
+	// Events delivers the events. It is closed by Close.
+	Events <-chan Event
+
+	events   chan Event
+	prefixes []string
+	dropped  uint64
+
+	bus *eventBus
+}
+
+// eventBus passes events to the subscriptions.
+type eventBus struct {
+	mu            sync.Mutex
+	subscriptions map[*Subscription]struct{}
+}
+
+// Subscribe reports the changes made through the mount to files below any of
+// the prefixes, e.g. /foo, or to all files if there are none. Up to buffer
+// events are kept until they are received; further events are dropped.
+func (s *Server) Subscribe(buffer int, prefixes ...string) *Subscription {
+	return s.fs.events.subscribe(buffer, prefixes)
+}
+
+func (b *eventBus) subscribe(buffer int, prefixes []string) *Subscription {
+	events := make(chan Event, buffer)
+
+	sub := &Subscription{
+		Events: events,
+		events: events,
+		bus:    b,
+	}
+
+	for _, prefix := range prefixes {
+		sub.prefixes = append(sub.prefixes, path.Clean("/"+prefix))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscriptions == nil {
+		b.subscriptions = make(map[*Subscription]struct{})
+	}
+
+	b.subscriptions[sub] = struct{}{}
+
+	return sub
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	return s.dropped
+}
+
+// Close stops the subscription and closes its channel.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if _, ok := s.bus.subscriptions[s]; !ok {
+		return
+	}
+
+	delete(s.bus.subscriptions, s)
+	close(s.events)
+}
+
+func (s *Subscription) matches(p string) bool {
+	if len(s.prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range s.prefixes {
+		if prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// publish passes an event to the matching subscriptions without blocking.
+func (b *eventBus) publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscriptions {
+		if !sub.matches(event.Path) && (event.NewPath == "" || !sub.matches(event.NewPath)) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// emit publishes a change made by a process to the paths of the backend.
+func (fs *fileSystem) emit(typ EventType, p string, newPath string, id fuseops.InodeID, ctx fuseops.OpContext) {
+	fs.noteChange(p)
+	if newPath != "" {
+		fs.noteChange(newPath)
+	}
+
+	event := Event{
+		Type:  typ,
+		Path:  fs.mountPath(p),
+		Inode: id,
+		Pid:   ctx.Pid,
+		Uid:   ctx.Uid,
+		Time:  time.Now(),
+	}
+
+	if newPath != "" {
+		event.NewPath = fs.mountPath(newPath)
+	}
+
+	fs.events.publish(event)
+}
+
+// mountPath maps a path of the backend to the path in the mount.
+func (fs *fileSystem) mountPath(p string) string {
+	root := fs.getInodeOrDie(fuseops.RootInodeID).path
+
+	return path.Join("/", strings.TrimPrefix(p, root))
+}
+
+// inodePath returns the path of an inode in the mount, or an empty path for unknown inodes.
+// It is used by interceptors, which resolve paths before the operation is dispatched.
+func (fs *fileSystem) inodePath(id fuseops.InodeID) string {
+	in, ok := fs.lookUpInode(id)
+	if !ok {
+		return ""
+	}
+
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+
+	return fs.mountPath(in.path)
+}
+
+// childPath returns the path of a child of an inode in the mount, or an empty path for unknown inodes.
+func (fs *fileSystem) childPath(parent fuseops.InodeID, name string) string {
+	p := fs.inodePath(parent)
+	if p == "" {
+		return ""
+	}
+
+	return path.Join(p, name)
+}
@@ -8,19 +8,47 @@ import (
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/JakWai01/sile-fystem/pkg/audit"
 	"github.com/JakWai01/sile-fystem/pkg/logging"
 	"github.com/JakWai01/sile-fystem/pkg/posix"
+	"github.com/JakWai01/sile-fystem/pkg/quota"
+	"github.com/JakWai01/sile-fystem/pkg/rules"
+	"github.com/JakWai01/sile-fystem/pkg/trash"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/spf13/afero"
 )
 
+const (
+	blockSize = 4096
+)
+
+// fileSystem serves the operations of the kernel concurrently. Each operation
+// locks the inodes it works on, so operations on independent files don't wait
+// for each other.
+//
+// Locks are taken in this order:
+//
+//  1. inode.mu of directories before the ones of their children. The parents
+//     of a rename are locked in the order of their IDs, as the kernel
+//     serializes renames between directories. The .snapshots directory is
+//     locked before the live tree it freezes.
+//  2. snapMu, versionMu, handlesMu, trashMu and openedMu, which are never held
+//     together.
+//  3. The locks of the block cache, the journal and the event bus.
+//
+// inodesMu only guards the inode table and is released before any other lock
+// is taken. mountedMu is only held while notifying the kernel, which happens
+// without holding any other lock.
 type fileSystem struct {
-	inodes  map[fuseops.InodeID]*inode
+	inodesMu sync.RWMutex
+	inodes   map[fuseops.InodeID]*inode
+
 	root    string
 	backend afero.Fs
 	fuseutil.NotImplementedFileSystem
@@ -28,64 +56,218 @@ type fileSystem struct {
 	uid uint32
 	gid uint32
 
-	mu sync.Mutex
-	op sync.Mutex
-
 	log logging.StructuredLogger
 
-	opened afero.File
+	sync             bool
+	readOnly         bool
+	disableWriteback bool
+
+	snapMu         sync.Mutex
+	snapshots      map[string]*snapshot
+	snapshotsInode fuseops.InodeID
+	cow            map[string][]fuseops.InodeID
+
+	versionMu     sync.Mutex
+	retention     *Retention
+	versionsInode fuseops.InodeID
+
+	handlesMu  sync.Mutex
+	handles    map[fuseops.HandleID]*handle
+	nextHandle fuseops.HandleID
+
+	trashMu     sync.Mutex
+	trash       *trash.Trash
+	trashMaxAge time.Duration
+
+	journal *journal
+
+	notifier *fuse.Notifier
+	changes  changeLog
+
+	mountedMu sync.RWMutex
+	mounted   bool
+
+	ttl CacheTTL
+
+	counters Stats
+
+	interceptors []Interceptor
+
+	audit  *audit.Log
+	rules  *rules.Rules
+	quotas *quota.Quotas
+
+	cache *blockCache
 
-	sync bool
+	openPolicy     OpenPolicy
+	openedMu       sync.Mutex
+	openedVersions map[fuseops.InodeID]openedVersion
+
+	events eventBus
+}
+
+// Server serves a filesystem to the kernel and manages it while it is mounted.
+type Server struct {
+	fuse.Server
+
+	fs *fileSystem
 }
 
+// NewFileSystem creates a filesystem serving the root directory of backend.
+// Use New to reach the management methods without a type assertion.
 func NewFileSystem(uid uint32, gid uint32, mountpoint string, root string, logger logging.StructuredLogger, backend afero.Fs, sync bool) fuse.Server {
+	options := []Option{WithOwner(uid, gid), WithRoot(root), WithLogger(logger)}
+	if sync {
+		options = append(options, WithSync())
+	}
+
+	return New(mountpoint, backend, options...)
+}
+
+// New creates a filesystem serving backend at mountpoint.
+func New(mountpoint string, backend afero.Fs, options ...Option) *Server {
 	fs := &fileSystem{
 		inodes:  make(map[fuseops.InodeID]*inode),
-		root:    root,
 		backend: backend,
-		uid:     uid,
-		gid:     gid,
 
-		log:  logger,
-		sync: sync,
+		snapshots: make(map[string]*snapshot),
+		cow:       make(map[string][]fuseops.InodeID),
+		handles:   make(map[fuseops.HandleID]*handle),
+
+		openedVersions: make(map[fuseops.InodeID]openedVersion),
+
+		notifier: fuse.NewNotifier(),
+	}
+
+	for _, option := range append(defaultOptions(), options...) {
+		option(fs)
+	}
+
+	if fs.sync {
+		fs.cache = nil
+	}
+
+	if fs.cache != nil {
+		fs.cache.written = fs.noteChange
 	}
 
+	root := fs.root
+
 	rootAttrs := fuseops.InodeAttributes{
 		Mode: 0700 | os.ModeDir,
-		Uid:  uid,
-		Gid:  gid,
+		Uid:  fs.uid,
+		Gid:  fs.gid,
 	}
 
-	fs.buildIndex(root)
+	// Snapshots don't outlive the mount, so drop the content kept for them by a previous one.
+	fs.backend.RemoveAll(concatPath(root, snapshotStore))
 
 	fs.inodes[fuseops.RootInodeID] = newInode(fuseops.RootInodeID, mountpoint, root, rootAttrs)
 
-	return fuseutil.NewFileSystemServer(fs)
+	fs.indexRoot()
+
+	snapshotsPath := concatPath(root, snapshotsDir)
+	fs.snapshotsInode = hash(snapshotsPath)
+	fs.inodes[fs.snapshotsInode] = newInode(fs.snapshotsInode, snapshotsDir, snapshotsPath, fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0555 | os.ModeDir,
+		Uid:   fs.uid,
+		Gid:   fs.gid,
+	})
+	fs.inodes[fs.snapshotsInode].frozen = true
+
+	// The operations are logged and audited before any other interceptor may reject them.
+	chain := []Interceptor{NewLoggingInterceptor(fs.log)}
+	if fs.audit != nil {
+		chain = append(chain, newAuditor(fs))
+	}
+	if fs.rules != nil {
+		chain = append(chain, &ruleEnforcer{fs})
+	}
+	chain = append(chain, fs.interceptors...)
+
+	return &Server{
+		Server: fuse.NewServerWithNotifier(fs.notifier, &serving{fuseutil.NewFileSystemServer(&intercepted{fs, chain}), fs}),
+		fs:     fs,
+	}
+}
+
+// Return statistics about the file system's capacity and available resources.
+// The kernel sends this in response to a statfs(2) call.
+func (fs *fileSystem) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
+	defer fs.statQuota(op)
+
+	statfser, ok := fs.backend.(StatFSer)
+	if !ok {
+		return nil
+	}
+
+	usage, err := statfser.StatFS()
+	if err != nil {
+		return errno(err)
+	}
+
+	op.BlockSize = blockSize
+	op.IoSize = blockSize
+	op.Blocks = usage.TotalBytes / blockSize
+	op.BlocksFree = usage.FreeBytes / blockSize
+	op.BlocksAvailable = op.BlocksFree
+	op.Inodes = usage.TotalInodes
+	op.InodesFree = usage.FreeInodes
+
+	return nil
 }
 
 // Look up a child by name within a parent directory.
 // The kernel sends this when resolving user paths to dentry structs, which are then cached.
 func (fs *fileSystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
-	fs.log.Debug("FUSE.LookUpInode", map[string]interface{}{
-		"parent":    op.Parent,
-		"name":      op.Name,
-		"entry":     op.Entry,
-		"OpContext": op.OpContext,
-	})
-
 	parent := fs.getInodeOrDie(op.Parent)
 
+	// Only one inode is locked at a time, as the .snapshots directory is locked before the root.
+	parent.mu.RLock()
 	childId, _, ok := parent.lookUpChild(op.Name)
+	parent.mu.RUnlock()
+
+	if op.Parent == fuseops.RootInodeID && op.Name == snapshotsDir {
+		// The snapshots are reachable, but not listed in the root directory.
+		childId, ok = fs.snapshotsInode, true
+	} else if op.Parent == fuseops.RootInodeID && op.Name == versionsDir && fs.retention != nil {
+		childId, ok = fs.versionsInode, true
+	} else if parent.versions {
+		parent.mu.RLock()
+		child, err := fs.lookUpVersion(parent, op.Name)
+		parent.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		childId, ok = child.id, true
+	}
+
 	if !ok {
+		if fs.ttl.Negative > 0 {
+			// An entry without a child lets the kernel cache that the name doesn't exist.
+			op.Entry.EntryExpiration = expiration(fs.ttl.Negative)
+
+			return nil
+		}
+
 		return fuse.ENOENT
 	}
 
-	child := fs.getInodeOrDie(childId)
+	child, ok := fs.lookUpInode(childId)
+	if !ok {
+		// The child was removed since it was looked up.
+		return fuse.ENOENT
+	}
 
+	child.mu.RLock()
 	op.Entry.Child = childId
 	op.Entry.Attributes = child.attrs
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	child.mu.RUnlock()
+
+	op.Entry.AttributesExpiration = fs.attributesExpiration()
+	op.Entry.EntryExpiration = fs.entryExpiration()
 
 	return nil
 }
@@ -94,31 +276,20 @@ func (fs *fileSystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 // The kernel sends this when the FUSE VFS layer's cache of inode attributes is stale.
 // This is controlled by the AttributesExpiration field of ChildInodeEntry, etc.
 func (fs *fileSystem) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) error {
-	fs.log.Debug("FUSE.GetInodeAttributes", map[string]interface{}{
-		"inode":                op.Inode,
-		"attributes":           op.Attributes,
-		"attributesExpiration": op.AttributesExpiration,
-		"opContext":            op.OpContext,
-	})
-
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
-	if !fs.sync {
-		fs.mu.Lock()
-		defer fs.mu.Unlock()
-
-		inode := fs.getInodeOrDie(op.Inode)
-
-		file, err := fs.backend.Open(inode.path)
-		if err != nil {
-			return err
-		}
+	inode := fs.getInodeOrDie(op.Inode)
 
-		defer file.Close()
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
 
-		info, err := file.Stat()
+	if inode.frozen || fs.sync {
+		op.Attributes = inode.attrs
+		op.AttributesExpiration = fs.attributesExpiration()
+	} else {
+		info, err := fs.stat(inode)
 		if err != nil {
 			return err
 		}
@@ -134,12 +305,12 @@ func (fs *fileSystem) GetInodeAttributes(ctx context.Context, op *fuseops.GetIno
 			Gid:    fs.gid,
 		}
 
-		op.AttributesExpiration = time.Now().Add(356 * 24 * time.Hour)
-	} else {
-		inode := fs.getInodeOrDie(op.Inode)
+		// Writes in the block cache aren't in the backend yet.
+		if size, ok := fs.cache.size(inode.id); ok && uint64(size) > op.Attributes.Size {
+			op.Attributes.Size = uint64(size)
+		}
 
-		op.Attributes = inode.attrs
-		op.AttributesExpiration = time.Now().Add(356 * 24 * time.Hour)
+		op.AttributesExpiration = fs.attributesExpiration()
 	}
 
 	return nil
@@ -148,27 +319,10 @@ func (fs *fileSystem) GetInodeAttributes(ctx context.Context, op *fuseops.GetIno
 // Change attributes for an inode.
 // The kernel sends this for obvious cases like chmod(2), and for less obvious cases like ftrunctate(2).
 func (fs *fileSystem) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
-	fs.log.Debug("FUSE.SetInodeAttributes", map[string]interface{}{
-		"inode":                op.Inode,
-		"handle":               op.Handle,
-		"size":                 op.Size,
-		"mode":                 op.Mode,
-		"aTime":                op.Atime,
-		"mTime":                op.Mtime,
-		"attributes":           op.Attributes,
-		"attributesExpiration": op.AttributesExpiration,
-		"opContext":            op.OpContext,
-	})
-
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
-	if !fs.sync {
-		fs.mu.Lock()
-		defer fs.mu.Unlock()
-	}
-
 	var err error
 	if op.Size != nil && op.Handle == nil && *op.Size != 0 {
 		// require that truncate to non-zero has to be ftruncate()
@@ -176,11 +330,48 @@ func (fs *fileSystem) SetInodeAttributes(ctx context.Context, op *fuseops.SetIno
 		err = syscall.EBADF
 	}
 
-	if fs.inodes[op.Inode] == nil {
+	inode, ok := fs.lookUpInode(op.Inode)
+	if !ok {
 		return fuse.EEXIST
 	}
 
-	inode := fs.getInodeOrDie(op.Inode)
+	if fs.readOnly || inode.frozen {
+		return syscall.EROFS
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	// A rejected truncate leaves the file alone.
+	truncate := op.Size != nil && err == nil
+
+	if truncate {
+		if err := fs.preserve(inode.path, inode.id); err != nil {
+			return errno(err)
+		}
+
+		if err := fs.keepVersion(inode.path, inode.id, op.Handle); err != nil {
+			return errno(err)
+		}
+
+		refund, err := fs.chargeSize(inode.path, *op.Size)
+		if err != nil {
+			return errno(err)
+		}
+
+		if err := fs.cache.flush(inode.id); err != nil {
+			refund()
+
+			return errno(err)
+		}
+		defer fs.cache.invalidate(inode.id)
+
+		if err := fs.truncate(inode, op.Handle, int64(*op.Size)); err != nil {
+			refund()
+
+			return errno(err)
+		}
+	}
 
 	if op.Mode != nil {
 		err = fs.backend.Chmod(inode.path, *op.Mode)
@@ -189,10 +380,12 @@ func (fs *fileSystem) SetInodeAttributes(ctx context.Context, op *fuseops.SetIno
 		}
 		op.Attributes.Mode = *op.Mode
 		inode.attrs.Mode = *op.Mode
+
+		fs.emit(EventChmod, inode.path, "", inode.id, op.OpContext)
 	}
 
 	if op.Atime != nil && op.Mtime != nil {
-		err = fs.backend.Chtimes(inode.path, op.Attributes.Atime, op.Attributes.Mtime)
+		err = fs.backend.Chtimes(inode.path, *op.Atime, *op.Mtime)
 		if err != nil {
 			return err
 		}
@@ -203,13 +396,15 @@ func (fs *fileSystem) SetInodeAttributes(ctx context.Context, op *fuseops.SetIno
 		inode.attrs.Mtime = *op.Mtime
 	}
 
-	if op.Size != nil {
+	if truncate {
 		op.Attributes.Size = *op.Size
 
 		inode.attrs.Size = *op.Size
 	}
 
-	op.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+	fs.noteChange(inode.path)
+
+	op.AttributesExpiration = fs.attributesExpiration()
 
 	return err
 }
@@ -217,24 +412,18 @@ func (fs *fileSystem) SetInodeAttributes(ctx context.Context, op *fuseops.SetIno
 // Create a directory inode as a child of an existing directory inode.
 // The kernel sends this in response to a mkdir(2) call.
 func (fs *fileSystem) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
-	fs.log.Debug("FUSE.MkDir", map[string]interface{}{
-		"parent":    op.Parent,
-		"name":      op.Name,
-		"mode":      op.Mode,
-		"entry":     op.Entry,
-		"opContext": op.OpContext,
-	})
-
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
-	if !fs.sync {
-		fs.mu.Lock()
-		defer fs.mu.Unlock()
+	parent := fs.getInodeOrDie(op.Parent)
+
+	if fs.isFrozen(parent, op.Name) {
+		return syscall.EROFS
 	}
 
-	parent := fs.getInodeOrDie(op.Parent)
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
 
 	_, _, ok := parent.lookUpChild(op.Name)
 	if ok {
@@ -243,9 +432,25 @@ func (fs *fileSystem) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
 
 	newPath := concatPath(parent.path, op.Name)
 
-	err := fs.backend.Mkdir(newPath, op.Mode)
+	seq, err := fs.journal.begin(intent{Op: opMkdir, Path: newPath, Mode: op.Mode})
 	if err != nil {
-		return err
+		return errno(err)
+	}
+	defer fs.commit(seq)
+
+	if err := fs.chargeInode(newPath, op.OpContext); err != nil {
+		return errno(err)
+	}
+
+	err = fs.backend.Mkdir(newPath, op.Mode)
+	if err != nil {
+		fs.releaseInode(newPath)
+
+		return errno(err)
+	}
+
+	if err := SyncDir(fs.backend, parent.path); err != nil {
+		return errno(err)
 	}
 
 	attrs := fuseops.InodeAttributes{
@@ -255,38 +460,34 @@ func (fs *fileSystem) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
 		Gid:   fs.gid,
 	}
 
-	fs.inodes[hash(newPath)] = newInode(hash(newPath), op.Name, newPath, attrs)
+	fs.putInode(newInode(hash(newPath), op.Name, newPath, attrs))
 
-	fs.getInodeOrDie(op.Parent).addChild(hash(newPath), op.Name, fuseutil.DT_Directory)
+	parent.addChild(hash(newPath), op.Name, fuseutil.DT_Directory)
+
+	fs.emit(EventMkdir, newPath, "", hash(newPath), op.OpContext)
 
 	op.Entry.Child = hash(newPath)
 	op.Entry.Attributes = attrs
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	op.Entry.AttributesExpiration = fs.attributesExpiration()
+	op.Entry.EntryExpiration = fs.entryExpiration()
 
 	return nil
 }
 
 // Create a file inode as a child of an existing directory inode. The kernel sends this in response to a mknod(2) call.
 func (fs *fileSystem) MkNode(ctx context.Context, op *fuseops.MkNodeOp) error {
-	fs.log.Debug("FUSE.MkNode", map[string]interface{}{
-		"parent":    op.Parent,
-		"name":      op.Name,
-		"mode":      op.Mode,
-		"entry":     op.Entry,
-		"opContext": op.OpContext,
-	})
-
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
-	if !fs.sync {
-		fs.mu.Lock()
-		defer fs.mu.Unlock()
+	parent := fs.getInodeOrDie(op.Parent)
+
+	if fs.isFrozen(parent, op.Name) {
+		return syscall.EROFS
 	}
 
-	parent := fs.getInodeOrDie(op.Parent)
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
 
 	_, _, ok := parent.lookUpChild(op.Name)
 	if ok {
@@ -295,9 +496,26 @@ func (fs *fileSystem) MkNode(ctx context.Context, op *fuseops.MkNodeOp) error {
 
 	newPath := concatPath(parent.path, op.Name)
 
-	_, err := fs.backend.Create(newPath)
+	seq, err := fs.journal.begin(intent{Op: opCreate, Path: newPath, Mode: op.Mode})
 	if err != nil {
-		return err
+		return errno(err)
+	}
+	defer fs.commit(seq)
+
+	if err := fs.chargeInode(newPath, op.OpContext); err != nil {
+		return errno(err)
+	}
+
+	file, err := fs.backend.Create(newPath)
+	if err != nil {
+		fs.releaseInode(newPath)
+
+		return errno(err)
+	}
+	file.Close()
+
+	if err := SyncDir(fs.backend, parent.path); err != nil {
+		return errno(err)
 	}
 
 	now := time.Now()
@@ -312,16 +530,18 @@ func (fs *fileSystem) MkNode(ctx context.Context, op *fuseops.MkNodeOp) error {
 		Gid:    fs.gid,
 	}
 
-	fs.inodes[hash(newPath)] = newInode(hash(newPath), op.Name, newPath, attrs)
+	fs.putInode(newInode(hash(newPath), op.Name, newPath, attrs))
 	parent.addChild(hash(newPath), op.Name, fuseutil.DT_File)
 
+	fs.emit(EventCreate, newPath, "", hash(newPath), op.OpContext)
+
 	var entry fuseops.ChildInodeEntry
 
 	entry.Child = hash(newPath)
 
 	entry.Attributes = attrs
-	entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	entry.EntryExpiration = entry.AttributesExpiration
+	entry.AttributesExpiration = fs.attributesExpiration()
+	entry.EntryExpiration = fs.entryExpiration()
 
 	op.Entry = entry
 
@@ -332,29 +552,18 @@ func (fs *fileSystem) MkNode(ctx context.Context, op *fuseops.MkNodeOp) error {
 // The kernel sends this when the user asks to open a file with the O_CREAT flag and the kernel
 // has observed that the file doesn't exist.
 func (fs *fileSystem) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) (err error) {
-	fs.log.Debug("FUSE.CreateFile", map[string]interface{}{
-		"parent":    op.Parent,
-		"name":      op.Name,
-		"mode":      op.Mode,
-		"entry":     op.Entry,
-		"handle":    op.Handle,
-		"opContext": op.OpContext,
-	})
-
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
-	if !fs.sync {
-		fs.mu.Lock()
-		defer fs.mu.Unlock()
-	}
+	parent := fs.getInodeOrDie(op.Parent)
 
-	if fs.sync {
-		fs.mu.Lock()
+	if fs.isFrozen(parent, op.Name) {
+		return syscall.EROFS
 	}
 
-	parent := fs.getInodeOrDie(op.Parent)
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
 
 	_, _, ok := parent.lookUpChild(op.Name)
 	if ok {
@@ -363,9 +572,37 @@ func (fs *fileSystem) CreateFile(ctx context.Context, op *fuseops.CreateFileOp)
 
 	newPath := concatPath(parent.path, op.Name)
 
-	fs.opened, err = fs.backend.Create(newPath)
+	seq, err := fs.journal.begin(intent{Op: opCreate, Path: newPath, Mode: op.Mode})
 	if err != nil {
-		return err
+		return errno(err)
+	}
+	defer fs.commit(seq)
+
+	if err := fs.chargeInode(newPath, op.OpContext); err != nil {
+		return errno(err)
+	}
+
+	file, err := fs.backend.Create(newPath)
+	if err != nil {
+		fs.releaseInode(newPath)
+
+		return errno(err)
+	}
+
+	// In sync mode, the file stays open for the handle.
+	var opened afero.File
+	if fs.sync {
+		opened = file
+
+		defer func() {
+			if err != nil {
+				file.Close()
+			}
+		}()
+	} else {
+		file.Close()
+
+		fs.cache.open(hash(newPath), fs.backend, newPath, true)
 	}
 
 	err = fs.backend.Chmod(newPath, op.Mode)
@@ -373,6 +610,10 @@ func (fs *fileSystem) CreateFile(ctx context.Context, op *fuseops.CreateFileOp)
 		return err
 	}
 
+	if err := SyncDir(fs.backend, parent.path); err != nil {
+		return errno(err)
+	}
+
 	now := time.Now()
 
 	attrs := fuseops.InodeAttributes{
@@ -386,17 +627,21 @@ func (fs *fileSystem) CreateFile(ctx context.Context, op *fuseops.CreateFileOp)
 		Gid:    fs.gid,
 	}
 
-	fs.inodes[hash(newPath)] = newInode(hash(newPath), op.Name, newPath, attrs)
+	fs.putInode(newInode(hash(newPath), op.Name, newPath, attrs))
+
+	parent.addChild(hash(newPath), op.Name, fuseutil.DT_File)
+
+	fs.emit(EventCreate, newPath, "", hash(newPath), op.OpContext)
 
-	fs.getInodeOrDie(op.Parent).addChild(hash(newPath), op.Name, fuseutil.DT_File)
+	op.Handle = fs.openHandle(hash(newPath), op.OpContext, opened)
 
 	var entry fuseops.ChildInodeEntry
 
 	entry.Child = hash(newPath)
 
 	entry.Attributes = attrs
-	entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	entry.EntryExpiration = entry.AttributesExpiration
+	entry.AttributesExpiration = fs.attributesExpiration()
+	entry.EntryExpiration = fs.entryExpiration()
 
 	op.Entry = entry
 
@@ -405,84 +650,113 @@ func (fs *fileSystem) CreateFile(ctx context.Context, op *fuseops.CreateFileOp)
 
 // Rename a file or directory, given the IDs of the original parent directory and the new one (which may be the same).
 func (fs *fileSystem) Rename(ctx context.Context, op *fuseops.RenameOp) error {
-	fs.log.Debug("FUSE.Rename", map[string]interface{}{
-		"oldParent": op.OldParent,
-		"oldName":   op.OldName,
-		"newParent": op.NewParent,
-		"newName":   op.NewName,
-		"opContext": op.OpContext,
-	})
-
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
-	if !fs.sync {
-		fs.mu.Lock()
-		defer fs.mu.Unlock()
-	}
-
 	oldParent := fs.getInodeOrDie(op.OldParent)
-	oldPath := concatPath(oldParent.path, op.OldName)
-
 	newParent := fs.getInodeOrDie(op.NewParent)
-	newPath := concatPath(newParent.path, op.NewName)
 
-	err := fs.backend.Rename(oldPath, newPath)
-	if err != nil {
-		return err
+	if fs.isFrozen(oldParent, op.OldName) || fs.isFrozen(newParent, op.NewName) {
+		return syscall.EROFS
 	}
 
+	unlock := lockParents(oldParent, newParent)
+	defer unlock()
+
 	childID, childType, ok := oldParent.lookUpChild(op.OldName)
 	if !ok {
 		return fuse.ENOENT
 	}
 
-	existingID, _, ok := newParent.lookUpChild(op.NewName)
-	if ok {
+	// The child is locked before it is moved in the backend, so that it isn't accessed at its old path meanwhile.
+	inode := fs.getInodeOrDie(childID)
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	// The target is checked and locked before anything is moved in the backend.
+	existingID, _, replaced := newParent.lookUpChild(op.NewName)
+	if replaced && existingID != childID {
+		// Links of the same file share the lock, which is held already.
 		existing := fs.getInodeOrDie(existingID)
 
+		existing.mu.Lock()
+		defer existing.mu.Unlock()
+
 		if len(existing.entries) > 0 {
 			return fuse.ENOTEMPTY
 		}
+	}
 
-		newParent.removeChild(op.NewName)
+	oldPath := concatPath(oldParent.path, op.OldName)
+	newPath := concatPath(newParent.path, op.NewName)
+
+	seq, err := fs.journal.begin(intent{Op: opRename, Path: oldPath, NewPath: newPath})
+	if err != nil {
+		return errno(err)
 	}
+	defer fs.commit(seq)
 
-	inode := fs.getInodeOrDie(childID)
+	// Renaming over a file drops its content.
+	if err := fs.preserve(newPath, existingID); err != nil {
+		return errno(err)
+	}
+
+	if err := fs.keepVersion(newPath, existingID, nil); err != nil {
+		return errno(err)
+	}
+
+	err = fs.backend.Rename(oldPath, newPath)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.syncDirs(oldParent.path, newParent.path); err != nil {
+		return errno(err)
+	}
+
+	fs.moveOrigins(oldPath, newPath)
+	fs.moveQuota(oldPath, newPath)
+
+	if replaced {
+		newParent.removeChild(op.NewName)
+		fs.cache.drop(existingID)
+		fs.forgetOpened(existingID)
+	}
 
 	inode.path = newPath
 	inode.name = op.NewName
 
+	fs.cache.move(childID, newPath)
+
+	if inode.isDir() {
+		fs.movePaths(inode, oldPath, newPath, existingID)
+	}
+
 	newParent.addChild(childID, op.NewName, childType)
 	oldParent.removeChild(op.OldName)
 
+	fs.emit(EventRename, oldPath, newPath, childID, op.OpContext)
+
 	return nil
 }
 
 // Unlink a directory from its parent.
 func (fs *fileSystem) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
-	fs.log.Debug("FUSE.RmDir", map[string]interface{}{
-		"parent":    op.Parent,
-		"name":      op.Name,
-		"opContext": op.OpContext,
-	})
-
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
-	if !fs.sync {
-		fs.mu.Lock()
-		defer fs.mu.Unlock()
-	}
-
 	parent := fs.getInodeOrDie(op.Parent)
 
-	if err := fs.backend.Remove(op.Name); err != nil {
-		return err
+	if fs.isFrozen(parent, op.Name) {
+		return syscall.EROFS
 	}
 
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
 	childID, _, ok := parent.lookUpChild(op.Name)
 	if !ok {
 		return fuse.ENOENT
@@ -490,15 +764,32 @@ func (fs *fileSystem) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
 
 	child := fs.getInodeOrDie(childID)
 
+	child.mu.Lock()
+	defer child.mu.Unlock()
+
 	if len(child.entries) > 0 {
 		return fuse.ENOTEMPTY
 	}
 
+	seq, err := fs.journal.begin(intent{Op: opUnlink, Path: child.path, Trash: fs.trash != nil})
+	if err != nil {
+		return errno(err)
+	}
+	defer fs.commit(seq)
+
+	if err := fs.remove(child.path); err != nil {
+		return errno(err)
+	}
+
+	fs.releaseInode(child.path)
+
 	parent.removeChild(op.Name)
-	delete(fs.inodes, childID)
+	fs.deleteInode(childID)
 
 	child.attrs.Nlink--
 
+	fs.emit(EventRmdir, child.path, "", childID, op.OpContext)
+
 	return nil
 }
 
@@ -506,31 +797,27 @@ func (fs *fileSystem) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
 // On Linux the kernel sends this when setting up a struct file for a particular inode with type directory,
 // usually in response to an open(2) call from a user-space process. On OS X it may not be sent for every open(2)
 func (fs *fileSystem) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error {
-	fs.log.Debug("FUSE.OpenDir", map[string]interface{}{
-		"inode":     op.Inode,
-		"handle":    op.Handle,
-		"opContext": op.OpContext,
-	})
-
-	var file afero.File
-	var err error
-
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
 	if fs.sync {
 		inode := fs.getInodeOrDie(op.Inode)
-		fs.mu.Lock()
-		file, err = fs.backend.Open(inode.path)
-		if err != nil {
-			return err
+
+		// Snapshots are served from the index alone.
+		if inode.frozen {
+			return nil
 		}
 
-		fs.op.Lock()
-		defer fs.op.Unlock()
+		inode.mu.RLock()
+		defer inode.mu.RUnlock()
 
-		fs.opened = file
+		// Directories are listed from the index, so the backend is only checked for the directory.
+		file, err := fs.backend.Open(inode.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
 
 		info, err := file.Stat()
 		if err != nil {
@@ -547,31 +834,38 @@ func (fs *fileSystem) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error
 
 // Read entries from a directory previously opened with OpenDir.
 func (fs *fileSystem) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
-	fs.log.Debug("FUSE.ReadDir", map[string]interface{}{
-		"inode":     op.Inode,
-		"handle":    op.Handle,
-		"offset":    op.Offset,
-		"bytesRead": op.BytesRead,
-		"opContext": op.OpContext,
-	})
-
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
-	if !fs.sync {
-		fs.mu.Lock()
-		defer fs.mu.Unlock()
-	}
-
 	inode := fs.getInodeOrDie(op.Inode)
 
+	// Listing a directory below .versions refreshes its entries from the store.
+	if inode.versions && op.Offset == 0 {
+		inode.mu.Lock()
+		defer inode.mu.Unlock()
+	} else {
+		inode.mu.RLock()
+		defer inode.mu.RUnlock()
+	}
+
 	if !inode.isDir() {
 		return errors.New("ReadDir called on non-directory")
 	}
 
+	if inode.versions && op.Offset == 0 {
+		if err := fs.listVersions(inode); err != nil {
+			return err
+		}
+	}
+
+	visible := fs.visibleTo(ctx, op.OpContext)
+
 	var n int
 	for i := int(op.Offset); i < len(inode.entries); i++ {
+		if !visible(concatPath(inode.path, inode.entries[i].Name)) {
+			continue
+		}
 
 		entry := fuseutil.Dirent{
 			Offset: fuseops.DirOffset(i + 1),
@@ -597,40 +891,48 @@ func (fs *fileSystem) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error
 // On Linux the kernel sends this when setting up a struct file for a particular inode with type file,
 // usually in response to an open(2) call from a user-space process. On OS X it may not be sent for every open(2)
 func (fs *fileSystem) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error {
-	fs.log.Debug("FUSE.OpenFile", map[string]interface{}{
-		"inode":         op.Inode,
-		"handle":        op.Handle,
-		"keepPageCache": op.KeepPageCache,
-		"useDirectID":   op.UseDirectIO,
-		"opContext":     op.OpContext,
-	})
-
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
-	if fs.sync {
-		fs.mu.Lock()
-		inode := fs.getInodeOrDie(op.Inode)
+	inode := fs.getInodeOrDie(op.Inode)
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
 
+	// In sync mode, the file stays open for the handle. Snapshots are read
+	// from content which may move on, so they are opened for every read.
+	var opened afero.File
+	if fs.sync && !inode.frozen {
 		file, err := fs.backend.OpenFile(inode.path, os.O_RDWR|os.O_APPEND, inode.attrs.Mode)
 		if err != nil {
 			return fuse.EEXIST
 		}
 
-		fs.op.Lock()
-		defer fs.op.Unlock()
-
-		fs.opened = file
-
 		info, err := file.Stat()
 		if err != nil {
+			file.Close()
+
 			return err
 		}
 
 		if info.IsDir() {
+			file.Close()
+
 			return errors.New("Found non-file")
 		}
+
+		opened = file
+	}
+
+	op.Handle = fs.openHandle(op.Inode, op.OpContext, opened)
+
+	stream := fs.isStream(inode)
+	fs.applyOpenPolicy(op, inode, stream)
+
+	// Snapshots are read from content which may move on, and streams have no size to cache up to.
+	if !inode.frozen && !stream {
+		fs.cache.open(op.Inode, fs.backend, inode.path, !fs.readOnly)
 	}
 
 	return nil
@@ -638,41 +940,49 @@ func (fs *fileSystem) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) erro
 
 // Read data from a file previously opened with CreateFile or OpenFile.
 func (fs *fileSystem) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
-	fs.log.Debug("FUSE.ReadFile", map[string]interface{}{
-		"inode":     op.Inode,
-		"handle":    op.Handle,
-		"offset":    op.Offset,
-		"bytesRead": op.BytesRead,
-		"opContext": op.OpContext,
-	})
-
 	var err error
 
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
-	fs.op.Lock()
-	defer fs.op.Unlock()
+	var cached bool
+	op.BytesRead, cached, err = fs.cache.read(op.Inode, op.Dst, op.Offset)
 
-	if !fs.sync {
-		inode := fs.getInodeOrDie(op.Inode)
+	inode := fs.getInodeOrDie(op.Inode)
 
-		file, err := fs.backend.Open(inode.path)
+	switch {
+	case cached:
+		// The block cache served the read.
+	case !fs.sync || inode.frozen:
+		inode.mu.RLock()
+		defer inode.mu.RUnlock()
+
+		p, unlock := fs.lockContent(inode)
+		defer unlock()
+
+		var file afero.File
+		file, err = fs.backend.Open(p)
 		if err != nil {
 			return err
 		}
 		defer file.Close()
 
 		op.BytesRead, err = file.ReadAt(op.Dst, op.Offset)
-		if err == io.EOF {
-			return nil
-		}
-	} else {
-		op.BytesRead, err = fs.opened.ReadAt(op.Dst, op.Offset)
-		if err == io.EOF {
-			return nil
+	default:
+		file, ok := fs.handleFile(op.Handle)
+		if !ok {
+			return syscall.EBADF
 		}
+
+		op.BytesRead, err = file.ReadAt(op.Dst, op.Offset)
+	}
+
+	atomic.AddUint64(&fs.counters.Reads, 1)
+	atomic.AddUint64(&fs.counters.BytesRead, uint64(op.BytesRead))
+
+	if err == io.EOF {
+		return nil
 	}
 
 	return err
@@ -680,64 +990,135 @@ func (fs *fileSystem) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) erro
 
 // Write data to a file previously opened with CreateFile or OpenFile.
 func (fs *fileSystem) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
-	fs.log.Debug("FUSE.WriteFile", map[string]interface{}{
-		"inode":     op.Inode,
-		"handle":    op.Handle,
-		"offset":    op.Offset,
-		"opContext": op.OpContext,
-		"data":      len(op.Data),
-	})
-
 	inode := fs.getInodeOrDie(op.Inode)
 
-	fs.op.Lock()
-	defer fs.op.Unlock()
+	if fs.readOnly || inode.frozen {
+		return syscall.EROFS
+	}
 
-	if !fs.sync {
-		file, err := fs.backend.OpenFile(inode.path, os.O_WRONLY, inode.attrs.Mode)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
 
-		_, err = file.WriteAt(op.Data, op.Offset)
-		if err != nil {
-			return err
-		}
-	} else {
-		_, err := fs.opened.WriteAt(op.Data, op.Offset)
-		if err != nil {
-			return err
-		}
+	if err := fs.preserve(inode.path, inode.id); err != nil {
+		return errno(err)
 	}
 
+	if err := fs.keepVersion(inode.path, inode.id, &op.Handle); err != nil {
+		return errno(err)
+	}
+
+	refund, err := fs.chargeWrite(inode.path, op.Offset+int64(len(op.Data)))
+	if err != nil {
+		return errno(err)
+	}
+
+	fs.markWritten(op.Handle)
+
+	if err := fs.writeAt(inode, op.Handle, op.Data, op.Offset); err != nil {
+		refund()
+
+		return err
+	}
+
+	atomic.AddUint64(&fs.counters.Writes, 1)
+	atomic.AddUint64(&fs.counters.BytesWritten, uint64(len(op.Data)))
+
 	inode.attrs.Mtime = time.Now()
 
 	return nil
 }
 
+// truncate resizes a file of the backend, through the file kept open for the
+// handle in sync mode. The caller must hold the inode lock.
+func (fs *fileSystem) truncate(inode *inode, handle *fuseops.HandleID, size int64) error {
+	if handle != nil {
+		if file, ok := fs.handleFile(*handle); ok {
+			return file.Truncate(size)
+		}
+	}
+
+	file, err := fs.backend.OpenFile(inode.path, os.O_WRONLY, inode.attrs.Mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Truncate(size)
+}
+
+// writeAt writes to the cache or the backend. The caller must hold the inode lock.
+func (fs *fileSystem) writeAt(inode *inode, handle fuseops.HandleID, data []byte, off int64) error {
+	if cached, err := fs.cache.write(inode.id, data, off); cached {
+		return errno(err)
+	}
+
+	if fs.sync {
+		file, ok := fs.handleFile(handle)
+		if !ok {
+			return syscall.EBADF
+		}
+
+		_, err := file.WriteAt(data, off)
+		fs.noteChange(inode.path)
+
+		return errno(err)
+	}
+
+	file, err := fs.backend.OpenFile(inode.path, os.O_WRONLY, inode.attrs.Mode)
+	if err != nil {
+		return errno(err)
+	}
+	defer file.Close()
+
+	_, err = file.WriteAt(data, off)
+	fs.noteChange(inode.path)
+
+	return errno(err)
+}
+
 // Create a hard link to an inode
 func (fs *fileSystem) CreateLink(ctx context.Context, op *fuseops.CreateLinkOp) error {
-	fs.log.Debug("FUSE.CreateLink", map[string]interface{}{
-		"parent":    op.Parent,
-		"name":      op.Name,
-		"target":    op.Target,
-		"entry":     op.Entry,
-		"opContext": op.OpContext,
-	})
-
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
 	parent := fs.getInodeOrDie(op.Parent)
+	target := fs.getInodeOrDie(op.Target)
+
+	if fs.isFrozen(parent, op.Name) || target.frozen {
+		return syscall.EROFS
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
 
 	_, _, exists := parent.lookUpChild(op.Name)
 	if exists {
 		return fuse.EEXIST
 	}
 
-	target := fs.getInodeOrDie(op.Target)
+	// Only files can be linked, so the target isn't an ancestor of the parent.
+	target.mu.Lock()
+	defer target.mu.Unlock()
+
+	// Links of backends without hard links only exist in the index.
+	if link, ok := hardLinker(fs.backend); ok {
+		newPath := concatPath(parent.path, op.Name)
+
+		seq, err := fs.journal.begin(intent{Op: opLink, Path: target.path, NewPath: newPath})
+		if err != nil {
+			return errno(err)
+		}
+		defer fs.commit(seq)
+
+		if err := link(target.path, newPath); err != nil {
+			return errno(err)
+		}
+
+		if err := SyncDir(fs.backend, parent.path); err != nil {
+			return errno(err)
+		}
+	}
 
 	now := time.Now()
 	target.attrs.Nlink++
@@ -745,175 +1126,328 @@ func (fs *fileSystem) CreateLink(ctx context.Context, op *fuseops.CreateLinkOp)
 
 	parent.addChild(op.Target, op.Name, fuseutil.DT_File)
 
+	fs.emit(EventCreate, concatPath(parent.path, op.Name), "", op.Target, op.OpContext)
+
 	op.Entry.Child = op.Target
 	op.Entry.Attributes = target.attrs
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	op.Entry.AttributesExpiration = fs.attributesExpiration()
+	op.Entry.EntryExpiration = fs.entryExpiration()
 
 	return nil
 }
 
-// Write data to a file previously opened with CreateFile or OpenFile.
+// Flush a file handle.
+// The kernel sends this when a file descriptor is closed, so that the content written through it is stored
+// before close(2) returns. Handles which weren't written to have nothing to store.
 func (fs *fileSystem) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) (err error) {
-	fs.log.Debug("FUSE.FlushFile", map[string]interface{}{
-		"inode":     op.Inode,
-		"handle":    op.Handle,
-		"opContext": op.OpContext,
-	})
-
 	if op.OpContext.Pid == 0 {
 		return fuse.EINVAL
 	}
 
-	return nil
+	if !fs.handleWritten(op.Handle) {
+		return nil
+	}
+
+	return errno(fs.syncFile(op.Inode, op.Handle))
+}
+
+// Write the content of a file to stable storage.
+// The kernel sends this in response to an fsync(2) call.
+func (fs *fileSystem) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) error {
+	return errno(fs.syncFile(op.Inode, op.Handle))
 }
 
 // Create a symlink inode.
 func (fs *fileSystem) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) error {
-	fs.log.Debug("FUSE.CreateSymlink", map[string]interface{}{
-		"parent":    op.Parent,
-		"name":      op.Name,
-		"target":    op.Target,
-		"entry":     op.Entry,
-		"opContext": op.OpContext,
-	})
+	if op.OpContext.Pid == 0 {
+		return fuse.EINVAL
+	}
+
+	linker, ok := fs.backend.(afero.Linker)
+	if !ok {
+		return fuse.ENOSYS
+	}
+
+	parent := fs.getInodeOrDie(op.Parent)
+
+	if fs.isFrozen(parent, op.Name) {
+		return syscall.EROFS
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	_, _, exists := parent.lookUpChild(op.Name)
+	if exists {
+		return fuse.EEXIST
+	}
+
+	newPath := concatPath(parent.path, op.Name)
+
+	if err := fs.chargeInode(newPath, op.OpContext); err != nil {
+		return errno(err)
+	}
+
+	err := linker.SymlinkIfPossible(op.Target, newPath)
+	if err != nil {
+		fs.releaseInode(newPath)
+
+		return err
+	}
+
+	if err := SyncDir(fs.backend, parent.path); err != nil {
+		return errno(err)
+	}
+
+	now := time.Now()
+	attrs := fuseops.InodeAttributes{
+		Nlink:  1,
+		Size:   uint64(len(op.Target)),
+		Mode:   0777 | os.ModeSymlink,
+		Atime:  now,
+		Mtime:  now,
+		Ctime:  now,
+		Crtime: now,
+		Uid:    fs.uid,
+		Gid:    fs.gid,
+	}
+
+	fs.putInode(newInode(hash(newPath), op.Name, newPath, attrs))
+	parent.addChild(hash(newPath), op.Name, fuseutil.DT_Link)
+
+	fs.emit(EventCreate, newPath, "", hash(newPath), op.OpContext)
+
+	op.Entry.Child = hash(newPath)
+	op.Entry.Attributes = attrs
+	op.Entry.AttributesExpiration = fs.attributesExpiration()
+	op.Entry.EntryExpiration = fs.entryExpiration()
 
 	return nil
 }
 
 // Unlink a file or symlink from its parent
 func (fs *fileSystem) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
-	fs.log.Debug("FUSE.Unlink", map[string]interface{}{
-		"parent":    op.Parent,
-		"name":      op.Name,
-		"opContext": op.OpContext,
-	})
-
-	// if fs.sync {
 	parent := fs.getInodeOrDie(op.Parent)
 
-	id, _, _ := parent.lookUpChild(op.Name)
+	if fs.isFrozen(parent, op.Name) {
+		return syscall.EROFS
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	id, _, ok := parent.lookUpChild(op.Name)
+	if !ok {
+		return fuse.ENOENT
+	}
 
 	child := fs.getInodeOrDie(id)
 
+	child.mu.Lock()
+	defer child.mu.Unlock()
+
+	seq, err := fs.journal.begin(intent{Op: opUnlink, Path: child.path, Trash: fs.trash != nil})
+	if err != nil {
+		return errno(err)
+	}
+	defer fs.commit(seq)
+
+	if err := fs.preserve(child.path, child.id); err != nil {
+		return errno(err)
+	}
+
+	// The file stays indexed if it can't be removed or moved into the trash.
+	if err := fs.remove(child.path); err != nil {
+		return errno(err)
+	}
+
 	parent.removeChild(child.name)
-	delete(fs.inodes, id)
+	fs.deleteInode(id)
+	fs.cache.drop(id)
+	fs.forgetOpened(id)
+
+	fs.releaseInode(child.path)
 
-	return fs.backend.Remove(child.path)
+	fs.emit(EventUnlink, child.path, "", id, op.OpContext)
+
+	return nil
 }
 
 // Read the target of a symlink inode.
 func (fs *fileSystem) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) error {
-	fs.log.Debug("FUSE.ReadSymlink", map[string]interface{}{
-		"inode":     op.Inode,
-		"target":    op.Target,
-		"opContext": op.OpContext,
-	})
+	inode := fs.getInodeOrDie(op.Inode)
+
+	if inode.frozen {
+		op.Target = inode.target
+
+		return nil
+	}
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
+
+	reader, ok := fs.backend.(afero.LinkReader)
+	if !ok {
+		return fuse.ENOSYS
+	}
+
+	target, err := reader.ReadlinkIfPossible(inode.path)
+	if err != nil {
+		return err
+	}
+
+	op.Target = target
 
 	return nil
 }
 
 // Get an extended attribute.
 func (fs *fileSystem) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error {
-	fs.log.Debug("FUSE.GetXattr", map[string]interface{}{
-		"inode":     op.Inode,
-		"name":      op.Name,
-		"bytesRead": op.BytesRead,
-		"opContext": op.OpContext,
-	})
+	xattrer, ok := fs.backend.(Xattrer)
+	if !ok {
+		return nil
+	}
 
-	return nil
+	inode := fs.getInodeOrDie(op.Inode)
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
+
+	p, unlock := fs.lockContent(inode)
+	defer unlock()
+
+	value, err := xattrer.GetXattr(p, op.Name)
+	if err != nil {
+		return err
+	}
+
+	return readXattr(op.Dst, value, &op.BytesRead)
 }
 
 // List all the extended attributes for a file.
 func (fs *fileSystem) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) error {
-	fs.log.Debug("FUSE.ListXattr", map[string]interface{}{
-		"inode":     op.Inode,
-		"bytesRead": op.BytesRead,
-		"opContext": op.OpContext,
-	})
+	xattrer, ok := fs.backend.(Xattrer)
+	if !ok {
+		return nil
+	}
 
-	return nil
+	inode := fs.getInodeOrDie(op.Inode)
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
+
+	p, unlock := fs.lockContent(inode)
+	defer unlock()
+
+	names, err := xattrer.ListXattr(p)
+	if err != nil {
+		return err
+	}
+
+	var value []byte
+	for _, name := range names {
+		value = append(value, name...)
+		value = append(value, 0)
+	}
+
+	return readXattr(op.Dst, value, &op.BytesRead)
 }
 
 // Remove an extended attribute.
 func (fs *fileSystem) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) error {
-	fs.log.Debug("FUSE.RemoveXattr", map[string]interface{}{
-		"inode":     op.Inode,
-		"name":      op.Name,
-		"opContext": op.OpContext,
-	})
+	xattrer, ok := fs.backend.(Xattrer)
+	if !ok {
+		return nil
+	}
 
-	return nil
+	inode := fs.getInodeOrDie(op.Inode)
+
+	if fs.readOnly || inode.frozen {
+		return syscall.EROFS
+	}
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
+
+	return xattrer.RemoveXattr(inode.path, op.Name)
 }
 
 // Set an extended attribute.
 func (fs *fileSystem) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error {
-	fs.log.Debug("FUSE.SetXattr", map[string]interface{}{
-		"inode":     op.Inode,
-		"name":      op.Name,
-		"value":     op.Value,
-		"flags":     op.Flags,
-		"opContext": op.OpContext,
-	})
+	xattrer, ok := fs.backend.(Xattrer)
+	if !ok {
+		return nil
+	}
+
+	inode := fs.getInodeOrDie(op.Inode)
+
+	if fs.readOnly || inode.frozen {
+		return syscall.EROFS
+	}
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
+
+	if err := xattrer.SetXattr(inode.path, op.Name, op.Value, int(op.Flags)); err != nil {
+		return err
+	}
+
+	fs.emit(EventSetxattr, inode.path, "", inode.id, op.OpContext)
 
 	return nil
 }
 
 func (fs *fileSystem) Fallocate(ctx context.Context, op *fuseops.FallocateOp) error {
-	fs.log.Debug("FUSE.Fallocate", map[string]interface{}{
-		"inode":     op.Inode,
-		"handle":    op.Handle,
-		"offset":    op.Offset,
-		"length":    op.Length,
-		"mode":      op.Mode,
-		"opContext": op.OpContext,
-	})
+	if fs.quotas == nil {
+		return nil
+	}
+
+	inode := fs.getInodeOrDie(op.Inode)
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
+
+	// Space isn't reserved in the backend, but allocating beyond a quota must fail.
+	if !fs.quotas.Fits(fs.mountPath(inode.path), int64(op.Offset+op.Length)) {
+		return syscall.EDQUOT
+	}
 
 	return nil
 }
 
 func (fs *fileSystem) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) error {
-	fs.log.Debug("FUSE.ReleaseFileHandle", map[string]interface{}{
-		"handle":    op.Handle,
-		"opContext": op.OpContext,
-	})
-
-	if fs.sync {
-		fs.op.Lock()
-		defer fs.op.Unlock()
-
-		if fs.opened != nil {
-			if err := fs.opened.Close(); err != nil {
-				return err
-			}
+	if id, ok := fs.handleInode(op.Handle); ok {
+		if err := fs.cache.release(id); err != nil {
+			fs.log.Error("FUSE.ReleaseFileHandle", map[string]interface{}{
+				"handle": op.Handle,
+				"err":    err,
+			})
 		}
-		fs.opened = nil
-		fs.mu.Unlock()
+	}
+
+	if err := fs.releaseHandle(op.Handle); err != nil {
+		fs.log.Error("FUSE.ReleaseFileHandle", map[string]interface{}{
+			"handle": op.Handle,
+			"err":    err,
+		})
 	}
 
 	return nil
 }
 
 func (fs *fileSystem) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseDirHandleOp) error {
-	fs.log.Debug("FUSE.ReleaseDirHandle", map[string]interface{}{
-		"handle":    op.Handle,
-		"opContext": op.OpContext,
-	})
-
-	if fs.sync {
-		fs.op.Lock()
-		defer fs.op.Unlock()
+	return nil
+}
 
-		if fs.opened != nil {
-			if err := fs.opened.Close(); err != nil {
-				return err
-			}
-		}
-		fs.opened = nil
-		fs.mu.Unlock()
+// indexRoot builds the index of everything below the root.
+func (fs *fileSystem) indexRoot() error {
+	if err := fs.buildIndex(fs.root); err != nil {
+		return err
 	}
 
+	// The root is indexed under the hash of its path, so let the root inode list what the backend contains.
+	fs.getInodeOrDie(fuseops.RootInodeID).entries = fs.getInodeOrDie(hash(fs.root)).entries
+
 	return nil
 }
 
@@ -944,7 +1478,10 @@ func (fs *fileSystem) buildIndex(root string) error {
 		Gid:    posix.CurrentGid(),
 	}
 
-	fs.inodes[hash(root)] = newInode(hash(root), info.Name(), root, attrs)
+	in := newInode(hash(root), info.Name(), root, attrs)
+
+	// The inode is added once its entries are complete, as directories are also indexed while the mount is in use.
+	defer fs.putInode(in)
 
 	if info.IsDir() {
 		children, err := file.Readdir(-1)
@@ -953,39 +1490,128 @@ func (fs *fileSystem) buildIndex(root string) error {
 		}
 
 		for _, child := range children {
+			childPath := concatPath(root, child.Name())
+
+			if fs.isReserved(childPath) {
+				continue
+			}
+
 			if child.IsDir() {
-				fs.getInodeOrDie(hash(root)).addChild(hash(concatPath(root, child.Name())), child.Name(), fuseutil.DT_Directory)
+				in.addChild(hash(childPath), child.Name(), fuseutil.DT_Directory)
+			} else if child.Mode()&os.ModeSymlink != 0 {
+				in.addChild(hash(childPath), child.Name(), fuseutil.DT_Link)
+
+				// Opening a symlink would follow it, so index it from its directory entry instead.
+				fs.putInode(newInode(hash(childPath), child.Name(), childPath, fuseops.InodeAttributes{
+					Size:   uint64(child.Size()),
+					Mode:   child.Mode(),
+					Atime:  child.ModTime(),
+					Mtime:  child.ModTime(),
+					Ctime:  child.ModTime(),
+					Crtime: child.ModTime(),
+					Uid:    posix.CurrentUid(),
+					Gid:    posix.CurrentGid(),
+				}))
+
+				continue
 			} else {
-				fs.getInodeOrDie(hash(root)).addChild(hash(concatPath(root, child.Name())), child.Name(), fuseutil.DT_File)
+				in.addChild(hash(childPath), child.Name(), fuseutil.DT_File)
 			}
-			fs.buildIndex(concatPath(root, child.Name()))
+			fs.buildIndex(childPath)
 		}
 	}
 
 	return nil
 }
 
-func (fs *fileSystem) getInodeOrDie(id fuseops.InodeID) *inode {
-	fs.log.Trace("FUSE.getInodeOrDie", map[string]interface{}{
-		"id": id,
-	})
+// isReserved reports whether a path of the backend holds the state of the filesystem instead of files.
+func (fs *fileSystem) isReserved(p string) bool {
+	return isReserved(fs.root, p)
+}
 
-	for _, inode := range fs.inodes {
-		fs.log.Trace("FUSE.getInodeOrDieInode", map[string]interface{}{
-			"id":   inode.id,
-			"name": inode.name,
-			"path": inode.path,
-		})
+func isReserved(root string, p string) bool {
+	return p == concatPath(root, snapshotStore) || p == concatPath(root, versionStore) || p == concatPath(root, trash.Dir) || p == concatPath(root, journalFile)
+}
+
+// stat returns the backend's file info for an inode without following symlinks.
+func (fs *fileSystem) stat(inode *inode) (os.FileInfo, error) {
+	if lstater, ok := fs.backend.(afero.Lstater); ok && inode.attrs.Mode&os.ModeSymlink != 0 {
+		info, _, err := lstater.LstatIfPossible(inode.path)
+
+		return info, err
 	}
 
-	inode := fs.inodes[id]
-	if inode == nil {
+	file, err := fs.backend.Open(inode.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return file.Stat()
+}
+
+func (fs *fileSystem) getInodeOrDie(id fuseops.InodeID) *inode {
+	inode, ok := fs.lookUpInode(id)
+	if !ok {
 		panic(fmt.Sprintf("Unknown inode: %v", id))
 	}
 
 	return inode
 }
 
+// lookUpInode returns the inode with an ID from the inode table.
+func (fs *fileSystem) lookUpInode(id fuseops.InodeID) (*inode, bool) {
+	fs.inodesMu.RLock()
+	defer fs.inodesMu.RUnlock()
+
+	inode, ok := fs.inodes[id]
+
+	return inode, ok
+}
+
+// putInode adds an inode to the inode table, replacing the inode with the same ID.
+func (fs *fileSystem) putInode(in *inode) {
+	fs.inodesMu.Lock()
+	defer fs.inodesMu.Unlock()
+
+	fs.inodes[in.id] = in
+}
+
+// deleteInode removes an inode from the inode table.
+func (fs *fileSystem) deleteInode(id fuseops.InodeID) {
+	fs.inodesMu.Lock()
+	defer fs.inodesMu.Unlock()
+
+	delete(fs.inodes, id)
+}
+
+// errno unwraps backend errors such as *os.PathError, as the kernel only understands a bare syscall.Errno.
+func errno(err error) error {
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		return e
+	}
+
+	return err
+}
+
+// readXattr copies an xattr value into dst following getxattr(2) semantics:
+// an empty dst queries the size of the value.
+func readXattr(dst []byte, value []byte, bytesRead *int) error {
+	if len(dst) == 0 {
+		*bytesRead = len(value)
+		return nil
+	}
+
+	if len(dst) < len(value) {
+		return syscall.ERANGE
+	}
+
+	*bytesRead = copy(dst, value)
+
+	return nil
+}
+
 func sanitize(path string) string {
 	if len(path) > 0 {
 		if path[0] == '/' && path[1] == '/' {
@@ -0,0 +1,57 @@
+package filesystem
+
+import (
+	"os"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// syncFile writes back what is cached of an inode and syncs its file in the
+// backend, or the file kept open for the handle in sync mode. This also drains
+// the layers of the backend writing back content themselves.
+func (fs *fileSystem) syncFile(id fuseops.InodeID, handle fuseops.HandleID) error {
+	if cached, err := fs.cache.sync(id); cached {
+		return err
+	}
+
+	if fs.sync {
+		file, ok := fs.handleFile(handle)
+		if !ok {
+			return nil
+		}
+
+		return file.Sync()
+	}
+
+	inode := fs.getInodeOrDie(id)
+
+	// Snapshots don't change, and their content is synced with the files they were taken of.
+	if inode.frozen {
+		return nil
+	}
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
+
+	// Content is written with a file of its own for each write, so syncing any file of the inode persists it.
+	file, err := fs.backend.OpenFile(fs.backendPath(inode), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// syncDirs syncs the directories an entry was moved between, so that the move survives a crash.
+func (fs *fileSystem) syncDirs(oldDir string, newDir string) error {
+	if err := SyncDir(fs.backend, newDir); err != nil {
+		return err
+	}
+
+	if oldDir == newDir {
+		return nil
+	}
+
+	return SyncDir(fs.backend, oldDir)
+}
@@ -2,6 +2,7 @@ package filesystem
 
 import (
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,12 +11,26 @@ import (
 )
 
 type inode struct {
-	id      fuseops.InodeID
+	id fuseops.InodeID
+
+	// mu guards the name, path, attributes and entries of the inode. The
+	// other fields don't change once the inode is in the inode table.
+	mu      sync.RWMutex
 	name    string
 	path    string
 	attrs   fuseops.InodeAttributes
 	entries []fuseutil.Dirent
-	mu      sync.Mutex
+
+	// frozen marks inodes below .snapshots, which can't be modified.
+	frozen bool
+	// origin is the live path a frozen file still shares its content with. It is guarded by snapMu.
+	origin string
+	// live is the inode of the live file at origin. It is guarded by snapMu.
+	live fuseops.InodeID
+	// target is the target of a frozen symlink.
+	target string
+	// versions marks inodes below .versions, which are resolved from the store on demand.
+	versions bool
 }
 
 func newInode(id fuseops.InodeID, name string, path string, attrs fuseops.InodeAttributes) *inode {
@@ -35,6 +50,7 @@ func (in *inode) isDir() bool {
 	return in.attrs.Mode&os.ModeDir != 0
 }
 
+// addChild, removeChild, lookUpChild and findChild must be called with in.mu held.
 func (in *inode) addChild(id fuseops.InodeID, name string, dt fuseutil.DirentType) {
 	var index int
 
@@ -62,9 +78,6 @@ func (in *inode) addChild(id fuseops.InodeID, name string, dt fuseutil.DirentTyp
 }
 
 func (in *inode) removeChild(name string) {
-	in.mu.Lock()
-	defer in.mu.Unlock()
-
 	in.attrs.Mtime = time.Now()
 
 	newEntries := make([]fuseutil.Dirent, 0)
@@ -81,9 +94,6 @@ func (in *inode) removeChild(name string) {
 }
 
 func (in *inode) lookUpChild(name string) (id fuseops.InodeID, typ fuseutil.DirentType, ok bool) {
-	in.mu.Lock()
-	defer in.mu.Unlock()
-
 	index, ok := in.findChild(name)
 	if ok {
 		id = in.entries[index].Inode
@@ -107,3 +117,70 @@ func (in *inode) findChild(name string) (i int, ok bool) {
 
 	return 0, false
 }
+
+// lockParents locks the parents of a rename and returns a function unlocking
+// them. A parent containing the other one is locked first, as directories are
+// locked before their children. Otherwise they are locked in the order of
+// their IDs.
+func lockParents(a *inode, b *inode) func() {
+	if a == b {
+		a.mu.Lock()
+
+		return a.mu.Unlock
+	}
+
+	if b.contains(a) || (!a.contains(b) && b.id < a.id) {
+		a, b = b, a
+	}
+
+	a.mu.Lock()
+	b.mu.Lock()
+
+	return func() {
+		b.mu.Unlock()
+		a.mu.Unlock()
+	}
+}
+
+// movePaths follows a rename of the directory dir from oldPath to newPath in
+// the paths of the inodes below it. The caller must hold the lock of dir; the
+// inode held is locked by the caller as well.
+func (fs *fileSystem) movePaths(dir *inode, oldPath string, newPath string, held fuseops.InodeID) {
+	for _, entry := range dir.entries {
+		child, ok := fs.lookUpInode(entry.Inode)
+		if entry.Type == fuseutil.DT_Unknown || !ok {
+			continue
+		}
+
+		if child.id != held {
+			child.mu.Lock()
+		}
+
+		// Links keep the path of the file they were created for, which may be outside of dir.
+		if strings.HasPrefix(child.path, oldPath+"/") {
+			child.path = newPath + strings.TrimPrefix(child.path, oldPath)
+
+			if child.isDir() {
+				fs.movePaths(child, oldPath, newPath, held)
+			} else {
+				fs.cache.move(child.id, child.path)
+			}
+		}
+
+		if child.id != held {
+			child.mu.Unlock()
+		}
+	}
+}
+
+// contains reports whether other is below the directory in.
+func (in *inode) contains(other *inode) bool {
+	in.mu.RLock()
+	p := in.path
+	in.mu.RUnlock()
+
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+
+	return strings.HasPrefix(other.path, p+"/") || (p == "/" && other.path != "/")
+}
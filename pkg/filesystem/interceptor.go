@@ -0,0 +1,282 @@
+package filesystem
+
+import (
+	"context"
+	"sync"
+
+	"github.com/JakWai01/sile-fystem/pkg/posix"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Handler dispatches an operation to the next interceptor or the filesystem.
+type Handler func(ctx context.Context) error
+
+// Interceptor wraps the operations of the filesystem. It receives the typed
+// operation, e.g. a *fuseops.LookUpInodeOp, dispatches it by calling next and
+// sees the result in the fields of the operation and the returned error.
+// Returning an error without calling next, e.g. syscall.EACCES, rejects the
+// operation.
+type Interceptor interface {
+	Intercept(ctx context.Context, op interface{}, next Handler) error
+}
+
+// InterceptorFunc adapts a function to an Interceptor.
+type InterceptorFunc func(ctx context.Context, op interface{}, next Handler) error
+
+func (f InterceptorFunc) Intercept(ctx context.Context, op interface{}, next Handler) error {
+	return f(ctx, op, next)
+}
+
+// WithInterceptors wraps the operations of the filesystem in interceptors,
+// which run in the order they are passed in, after the built-in logging.
+func WithInterceptors(interceptors ...Interceptor) Option {
+	return func(fs *fileSystem) {
+		fs.interceptors = append(fs.interceptors, interceptors...)
+	}
+}
+
+// intercepted passes the operations of a filesystem through a chain of interceptors.
+type intercepted struct {
+	fs    fuseutil.FileSystem
+	chain []Interceptor
+}
+
+func (i *intercepted) intercept(ctx context.Context, op interface{}, dispatch Handler) error {
+	ctx = context.WithValue(ctx, callersKey{}, &callers{processes: map[uint32]posix.Process{}})
+
+	next := dispatch
+	for j := len(i.chain) - 1; j >= 0; j-- {
+		interceptor, inner := i.chain[j], next
+
+		next = func(ctx context.Context) error {
+			return interceptor.Intercept(ctx, op, inner)
+		}
+	}
+
+	return next(ctx)
+}
+
+// callersKey is the context key of the callers of an operation.
+type callersKey struct{}
+
+// callers caches the processes looked up while an operation is dispatched,
+// so that /proc is read once per operation and not by every interceptor.
+type callers struct {
+	mu        sync.Mutex
+	processes map[uint32]posix.Process
+}
+
+// lookUpCaller returns the process with pid, which is cached for the operation of ctx.
+func lookUpCaller(ctx context.Context, pid uint32) (posix.Process, error) {
+	c, ok := ctx.Value(callersKey{}).(*callers)
+	if !ok {
+		return posix.LookUpProcess(pid)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if process, ok := c.processes[pid]; ok {
+		return process, nil
+	}
+
+	process, err := posix.LookUpProcess(pid)
+	if err != nil {
+		return posix.Process{}, err
+	}
+
+	c.processes[pid] = process
+
+	return process, nil
+}
+
+func (i *intercepted) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.StatFS(ctx, op)
+	})
+}
+
+func (i *intercepted) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.LookUpInode(ctx, op)
+	})
+}
+
+func (i *intercepted) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.GetInodeAttributes(ctx, op)
+	})
+}
+
+func (i *intercepted) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.SetInodeAttributes(ctx, op)
+	})
+}
+
+func (i *intercepted) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.ForgetInode(ctx, op)
+	})
+}
+
+func (i *intercepted) BatchForget(ctx context.Context, op *fuseops.BatchForgetOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.BatchForget(ctx, op)
+	})
+}
+
+func (i *intercepted) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.MkDir(ctx, op)
+	})
+}
+
+func (i *intercepted) MkNode(ctx context.Context, op *fuseops.MkNodeOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.MkNode(ctx, op)
+	})
+}
+
+func (i *intercepted) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.CreateFile(ctx, op)
+	})
+}
+
+func (i *intercepted) CreateLink(ctx context.Context, op *fuseops.CreateLinkOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.CreateLink(ctx, op)
+	})
+}
+
+func (i *intercepted) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.CreateSymlink(ctx, op)
+	})
+}
+
+func (i *intercepted) Rename(ctx context.Context, op *fuseops.RenameOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.Rename(ctx, op)
+	})
+}
+
+func (i *intercepted) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.RmDir(ctx, op)
+	})
+}
+
+func (i *intercepted) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.Unlink(ctx, op)
+	})
+}
+
+func (i *intercepted) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.OpenDir(ctx, op)
+	})
+}
+
+func (i *intercepted) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.ReadDir(ctx, op)
+	})
+}
+
+func (i *intercepted) ReadDirPlus(ctx context.Context, op *fuseops.ReadDirPlusOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.ReadDirPlus(ctx, op)
+	})
+}
+
+func (i *intercepted) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseDirHandleOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.ReleaseDirHandle(ctx, op)
+	})
+}
+
+func (i *intercepted) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.OpenFile(ctx, op)
+	})
+}
+
+func (i *intercepted) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.ReadFile(ctx, op)
+	})
+}
+
+func (i *intercepted) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.WriteFile(ctx, op)
+	})
+}
+
+func (i *intercepted) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.SyncFile(ctx, op)
+	})
+}
+
+func (i *intercepted) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.FlushFile(ctx, op)
+	})
+}
+
+func (i *intercepted) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.ReleaseFileHandle(ctx, op)
+	})
+}
+
+func (i *intercepted) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.ReadSymlink(ctx, op)
+	})
+}
+
+func (i *intercepted) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.RemoveXattr(ctx, op)
+	})
+}
+
+func (i *intercepted) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.GetXattr(ctx, op)
+	})
+}
+
+func (i *intercepted) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.ListXattr(ctx, op)
+	})
+}
+
+func (i *intercepted) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.SetXattr(ctx, op)
+	})
+}
+
+func (i *intercepted) Fallocate(ctx context.Context, op *fuseops.FallocateOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.Fallocate(ctx, op)
+	})
+}
+
+func (i *intercepted) SyncFS(ctx context.Context, op *fuseops.SyncFSOp) error {
+	return i.intercept(ctx, op, func(ctx context.Context) error {
+		return i.fs.SyncFS(ctx, op)
+	})
+}
+
+func (i *intercepted) Destroy() {
+	i.fs.Destroy()
+}
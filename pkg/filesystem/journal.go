@@ -0,0 +1,253 @@
+package filesystem
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/JakWai01/sile-fystem/pkg/trash"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/spf13/afero"
+)
+
+const (
+	// journalFile is the file in the root of the backend recording the intent of metadata operations.
+	journalFile = ".sile-fystem-journal"
+
+	// journalCompactRecords is the number of records after which the journal is truncated once no operation is in flight.
+	journalCompactRecords = 4096
+)
+
+const (
+	opCreate = "create"
+	opMkdir  = "mkdir"
+	opRename = "rename"
+	opUnlink = "unlink"
+	opLink   = "link"
+)
+
+// intent is a record of the journal. An operation is complete once a record
+// with the same sequence number and done set follows its intent.
+type intent struct {
+	Seq     uint64      `json:"seq"`
+	Op      string      `json:"op,omitempty"`
+	Path    string      `json:"path,omitempty"`
+	NewPath string      `json:"newPath,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	// Trash is set for removals which move the file into the trash.
+	Trash bool `json:"trash,omitempty"`
+	Done  bool `json:"done,omitempty"`
+}
+
+type journal struct {
+	mu       sync.Mutex
+	file     afero.File
+	seq      uint64
+	inflight int
+	records  int
+}
+
+// EnableJournal records the intent of multi-step metadata operations before
+// they reach the backend, so that operations interrupted by a crash are
+// completed on the next mount. It has to be called before the
+// filesystem is mounted.
+func (s *Server) EnableJournal() error {
+	return s.fs.enableJournal()
+}
+
+func (fs *fileSystem) enableJournal() error {
+	p := concatPath(fs.getInodeOrDie(fuseops.RootInodeID).path, journalFile)
+
+	pending, err := readJournal(fs.backend, p)
+	if err != nil {
+		return err
+	}
+
+	for _, in := range pending {
+		fs.log.Info("FUSE.recover", map[string]interface{}{
+			"op":      in.Op,
+			"path":    in.Path,
+			"newPath": in.NewPath,
+		})
+
+		if err := fs.recover(in); err != nil {
+			return err
+		}
+	}
+
+	file, err := fs.backend.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	fs.journal = &journal{file: file}
+
+	if len(pending) > 0 {
+		// The index was built before the backend was recovered.
+		return fs.indexRoot()
+	}
+
+	return nil
+}
+
+// recover completes an interrupted operation. Only the backend
+// has to be recovered, as the index is built from it on every mount.
+func (fs *fileSystem) recover(in intent) error {
+	switch in.Op {
+	case opCreate, opMkdir:
+		// The permissions are set after creating a file.
+		if _, err := fs.backend.Stat(in.Path); err == nil {
+			return fs.backend.Chmod(in.Path, in.Mode)
+		}
+	case opRename:
+		// Backends without an atomic rename copy before removing the source,
+		// so renaming again completes the operation.
+		if _, err := fs.backend.Stat(in.Path); err == nil {
+			return fs.backend.Rename(in.Path, in.NewPath)
+		}
+	case opUnlink:
+		// The kernel may have dropped the file already, so the removal is completed.
+		if _, err := fs.lstat(in.Path); err == nil {
+			if in.Trash {
+				return trash.New(fs.backend, fs.getInodeOrDie(fuseops.RootInodeID).path).Move(in.Path)
+			}
+
+			return fs.backend.Remove(in.Path)
+		}
+	case opLink:
+		// Links are only journaled for backends supporting them.
+		link, ok := hardLinker(fs.backend)
+		if !ok {
+			return nil
+		}
+
+		if _, err := fs.lstat(in.NewPath); !os.IsNotExist(err) {
+			return nil
+		}
+
+		if _, err := fs.lstat(in.Path); err == nil {
+			return link(in.Path, in.NewPath)
+		}
+	}
+
+	return nil
+}
+
+// readJournal returns the intents of a journal which weren't completed.
+func readJournal(backend afero.Fs, p string) ([]intent, error) {
+	file, err := backend.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer file.Close()
+
+	intents := []intent{}
+	done := map[uint64]bool{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var in intent
+		if err := json.Unmarshal(scanner.Bytes(), &in); err != nil {
+			// The last record may have been written partially.
+			break
+		}
+
+		if in.Done {
+			done[in.Seq] = true
+		} else {
+			intents = append(intents, in)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	pending := []intent{}
+	for _, in := range intents {
+		if !done[in.Seq] {
+			pending = append(pending, in)
+		}
+	}
+
+	return pending, nil
+}
+
+// begin records the intent of an operation and returns its sequence number.
+func (j *journal) begin(in intent) (uint64, error) {
+	if j == nil {
+		return 0, nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq++
+	in.Seq = j.seq
+
+	if err := j.write(in); err != nil {
+		return 0, err
+	}
+
+	j.inflight++
+
+	return in.Seq, nil
+}
+
+// commit marks an operation as complete.
+func (j *journal) commit(seq uint64) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.inflight--
+
+	if j.inflight == 0 && j.records >= journalCompactRecords {
+		j.records = 0
+
+		if err := j.file.Truncate(0); err != nil {
+			return err
+		}
+
+		// Not all backends honor O_APPEND.
+		_, err := j.file.Seek(0, io.SeekStart)
+
+		return err
+	}
+
+	return j.write(intent{Seq: seq, Done: true})
+}
+
+func (j *journal) write(in intent) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	j.records++
+
+	return j.file.Sync()
+}
+
+// commit marks an operation of the journal as complete, which only fails if the journal can't be written.
+func (fs *fileSystem) commit(seq uint64) {
+	if err := fs.journal.commit(seq); err != nil {
+		fs.log.Error("FUSE.commit", map[string]interface{}{
+			"seq": seq,
+			"err": err,
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package filesystem
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	"github.com/JakWai01/sile-fystem/pkg/logging"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewLoggingInterceptor logs every operation at the debug level before it is dispatched.
+func NewLoggingInterceptor(logger logging.StructuredLogger) Interceptor {
+	return InterceptorFunc(func(ctx context.Context, op interface{}, next Handler) error {
+		logger.Debug("FUSE."+opName(op), opFields(op))
+
+		return next(ctx)
+	})
+}
+
+// opName returns the name of an operation, e.g. LookUpInode for a *fuseops.LookUpInodeOp.
+func opName(op interface{}) string {
+	return strings.TrimSuffix(reflect.TypeOf(op).Elem().Name(), "Op")
+}
+
+// opFields returns the fields of an operation worth logging.
+func opFields(op interface{}) map[string]interface{} {
+	switch op := op.(type) {
+	case *fuseops.StatFSOp:
+		return map[string]interface{}{
+			"blockSize": op.BlockSize,
+			"blocks":    op.Blocks,
+			"inodes":    op.Inodes,
+		}
+	case *fuseops.LookUpInodeOp:
+		return map[string]interface{}{
+			"parent":    op.Parent,
+			"name":      op.Name,
+			"entry":     op.Entry,
+			"OpContext": op.OpContext,
+		}
+	case *fuseops.GetInodeAttributesOp:
+		return map[string]interface{}{
+			"inode":                op.Inode,
+			"attributes":           op.Attributes,
+			"attributesExpiration": op.AttributesExpiration,
+			"opContext":            op.OpContext,
+		}
+	case *fuseops.SetInodeAttributesOp:
+		return map[string]interface{}{
+			"inode":                op.Inode,
+			"handle":               op.Handle,
+			"size":                 op.Size,
+			"mode":                 op.Mode,
+			"aTime":                op.Atime,
+			"mTime":                op.Mtime,
+			"attributes":           op.Attributes,
+			"attributesExpiration": op.AttributesExpiration,
+			"opContext":            op.OpContext,
+		}
+	case *fuseops.MkDirOp:
+		return map[string]interface{}{
+			"parent":    op.Parent,
+			"name":      op.Name,
+			"mode":      op.Mode,
+			"entry":     op.Entry,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.MkNodeOp:
+		return map[string]interface{}{
+			"parent":    op.Parent,
+			"name":      op.Name,
+			"mode":      op.Mode,
+			"entry":     op.Entry,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.CreateFileOp:
+		return map[string]interface{}{
+			"parent":    op.Parent,
+			"name":      op.Name,
+			"mode":      op.Mode,
+			"entry":     op.Entry,
+			"handle":    op.Handle,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.RenameOp:
+		return map[string]interface{}{
+			"oldParent": op.OldParent,
+			"oldName":   op.OldName,
+			"newParent": op.NewParent,
+			"newName":   op.NewName,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.RmDirOp:
+		return map[string]interface{}{
+			"parent":    op.Parent,
+			"name":      op.Name,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.OpenDirOp:
+		return map[string]interface{}{
+			"inode":     op.Inode,
+			"handle":    op.Handle,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.ReadDirOp:
+		return map[string]interface{}{
+			"inode":     op.Inode,
+			"handle":    op.Handle,
+			"offset":    op.Offset,
+			"bytesRead": op.BytesRead,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.OpenFileOp:
+		return map[string]interface{}{
+			"inode":         op.Inode,
+			"handle":        op.Handle,
+			"keepPageCache": op.KeepPageCache,
+			"useDirectID":   op.UseDirectIO,
+			"opContext":     op.OpContext,
+		}
+	case *fuseops.ReadFileOp:
+		return map[string]interface{}{
+			"inode":     op.Inode,
+			"handle":    op.Handle,
+			"offset":    op.Offset,
+			"bytesRead": op.BytesRead,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.WriteFileOp:
+		return map[string]interface{}{
+			"inode":     op.Inode,
+			"handle":    op.Handle,
+			"offset":    op.Offset,
+			"opContext": op.OpContext,
+			"data":      len(op.Data),
+		}
+	case *fuseops.CreateLinkOp:
+		return map[string]interface{}{
+			"parent":    op.Parent,
+			"name":      op.Name,
+			"target":    op.Target,
+			"entry":     op.Entry,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.FlushFileOp:
+		return map[string]interface{}{
+			"inode":     op.Inode,
+			"handle":    op.Handle,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.CreateSymlinkOp:
+		return map[string]interface{}{
+			"parent":    op.Parent,
+			"name":      op.Name,
+			"target":    op.Target,
+			"entry":     op.Entry,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.UnlinkOp:
+		return map[string]interface{}{
+			"parent":    op.Parent,
+			"name":      op.Name,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.ReadSymlinkOp:
+		return map[string]interface{}{
+			"inode":     op.Inode,
+			"target":    op.Target,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.GetXattrOp:
+		return map[string]interface{}{
+			"inode":     op.Inode,
+			"name":      op.Name,
+			"bytesRead": op.BytesRead,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.ListXattrOp:
+		return map[string]interface{}{
+			"inode":     op.Inode,
+			"bytesRead": op.BytesRead,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.RemoveXattrOp:
+		return map[string]interface{}{
+			"inode":     op.Inode,
+			"name":      op.Name,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.SetXattrOp:
+		return map[string]interface{}{
+			"inode":     op.Inode,
+			"name":      op.Name,
+			"value":     op.Value,
+			"flags":     op.Flags,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.FallocateOp:
+		return map[string]interface{}{
+			"inode":     op.Inode,
+			"handle":    op.Handle,
+			"offset":    op.Offset,
+			"length":    op.Length,
+			"mode":      op.Mode,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.ReleaseFileHandleOp:
+		return map[string]interface{}{
+			"handle":    op.Handle,
+			"opContext": op.OpContext,
+		}
+	case *fuseops.ReleaseDirHandleOp:
+		return map[string]interface{}{
+			"handle":    op.Handle,
+			"opContext": op.OpContext,
+		}
+	default:
+		return map[string]interface{}{}
+	}
+}
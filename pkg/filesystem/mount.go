@@ -0,0 +1,181 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/spf13/afero"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// mountAttempts is how often mounting and unmounting are tried before giving up.
+	mountAttempts = 5
+
+	// mountRetryDelay is the delay before the first retry, which doubles with every further one.
+	mountRetryDelay = 100 * time.Millisecond
+)
+
+// MountedFileSystem is a filesystem mounted by Mount. It embeds the Server,
+// so that the filesystem can be managed while it is mounted.
+type MountedFileSystem struct {
+	*Server
+
+	mountpoint string
+	mfs        *fuse.MountedFileSystem
+
+	done chan struct{}
+	err  error
+}
+
+// Mount creates a filesystem serving backend and mounts it at mountpoint. A
+// stale mount left behind by a crashed process is cleaned up first. The
+// filesystem is unmounted once ctx is cancelled.
+func Mount(ctx context.Context, mountpoint string, backend afero.Fs, options ...Option) (*MountedFileSystem, error) {
+	return New(mountpoint, backend, options...).Mount(ctx)
+}
+
+// Mount mounts the filesystem at the mountpoint it was created for. Features
+// which have to be enabled before mounting, like the journal, can be enabled
+// between New and Mount.
+func (s *Server) Mount(ctx context.Context) (*MountedFileSystem, error) {
+	mountpoint := s.fs.getInodeOrDie(fuseops.RootInodeID).name
+
+	cfg := &fuse.MountConfig{
+		OpContext:               ctx,
+		ReadOnly:                s.fs.readOnly,
+		DisableWritebackCaching: s.fs.disableWriteback,
+	}
+
+	var mfs *fuse.MountedFileSystem
+	err := retry(ctx, func() error {
+		// A filesystem which wasn't unmounted before its process exited leaves
+		// the mountpoint inaccessible until it is unmounted.
+		if _, err := os.Stat(mountpoint); errors.Is(err, syscall.ENOTCONN) {
+			unmount(mountpoint, unix.MNT_DETACH)
+		}
+
+		if err := os.MkdirAll(mountpoint, os.ModePerm); err != nil {
+			return err
+		}
+
+		var err error
+		mfs, err = fuse.Mount(mountpoint, s, cfg)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MountedFileSystem{
+		Server:     s,
+		mountpoint: mountpoint,
+		mfs:        mfs,
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		m.err = mfs.Join(context.Background())
+		close(m.done)
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := m.Unmount(); err != nil {
+				s.fs.log.Error("FUSE.Unmount", map[string]interface{}{
+					"mountpoint": mountpoint,
+					"err":        err,
+				})
+			}
+		case <-m.done:
+		}
+	}()
+
+	return m, nil
+}
+
+// Mountpoint returns the directory the filesystem is mounted at.
+func (m *MountedFileSystem) Mountpoint() string {
+	return m.mountpoint
+}
+
+// Unmount unmounts the filesystem, retrying while it is busy.
+func (m *MountedFileSystem) Unmount() error {
+	return retry(context.Background(), func() error {
+		select {
+		case <-m.done:
+			return nil
+		default:
+		}
+
+		return unmount(m.mountpoint, 0)
+	})
+}
+
+// Wait blocks until the filesystem is unmounted.
+func (m *MountedFileSystem) Wait() error {
+	<-m.done
+
+	return m.err
+}
+
+// Flush writes the changes cached by the kernel and by the filesystem to the backend.
+func (m *MountedFileSystem) Flush() error {
+	dir, err := os.Open(m.mountpoint)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if err := unix.Syncfs(int(dir.Fd())); err != nil {
+		return err
+	}
+
+	return m.fs.flush()
+}
+
+// unmount unmounts dir through fusermount, or directly if fusermount isn't
+// available, e.g. in containers running as root.
+func unmount(dir string, flags int) error {
+	err := fuse.Unmount(dir)
+	if err == nil {
+		return nil
+	}
+
+	if unix.Unmount(dir, flags) == nil {
+		return nil
+	}
+
+	return err
+}
+
+// retry calls fn until it succeeds, it failed mountAttempts times or ctx is cancelled.
+func retry(ctx context.Context, fn func() error) error {
+	delay := mountRetryDelay
+
+	var err error
+	for attempt := 0; attempt < mountAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+
+			delay *= 2
+		}
+
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,305 @@
+package filesystem
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/spf13/afero"
+)
+
+// invalidation is a kernel cache entry to drop, either the attributes and
+// content of an inode or the entry name of a directory.
+type invalidation struct {
+	inode fuseops.InodeID
+	name  string
+}
+
+// Invalidate updates the filesystem after the file or directory at a path
+// of the mount was changed on the backend without going through the mount,
+// and drops what the kernel cached about it. For directories, their entries
+// are updated as well.
+func (s *Server) Invalidate(p string) error {
+	return s.fs.invalidate(p)
+}
+
+func (fs *fileSystem) invalidate(p string) error {
+	root := fs.getInodeOrDie(fuseops.RootInodeID).path
+
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return fs.reconcile(root)
+	}
+
+	return fs.reconcile(concatPath(root, p))
+}
+
+// reconcile updates the index for a path of the backend and notifies the kernel about the changes.
+func (fs *fileSystem) reconcile(p string) error {
+	invalidations := []invalidation{}
+
+	err := fs.reconcilePath(p, &invalidations)
+
+	// The kernel may wait for operations holding the locks of inodes while it processes notifications.
+	for _, i := range invalidations {
+		if i.name == "" {
+			fs.invalidateInode(i.inode)
+		} else {
+			fs.invalidateEntry(i.inode, i.name)
+		}
+	}
+
+	return err
+}
+
+func (fs *fileSystem) reconcilePath(p string, invalidations *[]invalidation) error {
+	info, err := fs.lstat(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+
+	id, indexed := fs.inodeByPath(p)
+	if id == fuseops.RootInodeID {
+		*invalidations = append(*invalidations, invalidation{inode: id})
+
+		return fs.reconcileDir(fs.getInodeOrDie(id), invalidations)
+	}
+
+	parentID, ok := fs.inodeByPath(path.Dir(p))
+	if !ok {
+		// The kernel can't have cached anything below an unknown directory.
+		return nil
+	}
+
+	parent := fs.getInodeOrDie(parentID)
+	name := path.Base(p)
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	_, typ, listed := parent.lookUpChild(name)
+	if listed && (!exists || typ != direntType(info)) {
+		// The kernel may still reference the inode until it learns about the
+		// removal, so it stays in the inode table and fails on the backend.
+		parent.removeChild(name)
+		listed = false
+
+		*invalidations = append(*invalidations, invalidation{inode: parentID, name: name}, invalidation{inode: parentID})
+	}
+
+	if !exists {
+		return nil
+	}
+
+	if !listed {
+		fs.addToIndex(parent, p, info)
+
+		// The kernel may have cached that the file doesn't exist.
+		*invalidations = append(*invalidations, invalidation{inode: parentID, name: name}, invalidation{inode: parentID})
+
+		return nil
+	}
+
+	if !indexed {
+		return nil
+	}
+
+	in := fs.getInodeOrDie(id)
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	fs.cache.invalidate(id)
+
+	in.attrs.Size = uint64(info.Size())
+	in.attrs.Mode = info.Mode()
+	in.attrs.Mtime = info.ModTime()
+	in.attrs.Ctime = info.ModTime()
+
+	*invalidations = append(*invalidations, invalidation{inode: id})
+
+	if info.IsDir() {
+		return fs.reconcileEntries(in, invalidations)
+	}
+
+	return nil
+}
+
+// reconcileDir updates the entries of a directory from the backend.
+func (fs *fileSystem) reconcileDir(dir *inode, invalidations *[]invalidation) error {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	return fs.reconcileEntries(dir, invalidations)
+}
+
+// reconcileEntries is reconcileDir for a directory which is locked already.
+func (fs *fileSystem) reconcileEntries(dir *inode, invalidations *[]invalidation) error {
+	file, err := fs.backend.Open(dir.path)
+	if err != nil {
+		return err
+	}
+
+	infos, err := file.Readdir(-1)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	present := map[string]os.FileInfo{}
+	for _, info := range infos {
+		if p := concatPath(dir.path, info.Name()); !fs.isReserved(p) {
+			present[info.Name()] = info
+		}
+	}
+
+	for _, entry := range append([]fuseutil.Dirent{}, dir.entries...) {
+		if info, ok := present[entry.Name]; ok && entry.Type == direntType(info) {
+			delete(present, entry.Name)
+
+			continue
+		}
+
+		dir.removeChild(entry.Name)
+
+		*invalidations = append(*invalidations, invalidation{inode: dir.id, name: entry.Name})
+	}
+
+	for name, info := range present {
+		fs.addToIndex(dir, concatPath(dir.path, name), info)
+
+		*invalidations = append(*invalidations, invalidation{inode: dir.id, name: name})
+	}
+
+	return nil
+}
+
+// addToIndex indexes a file which was added to the backend without going through the mount.
+func (fs *fileSystem) addToIndex(parent *inode, p string, info os.FileInfo) {
+	name := path.Base(p)
+
+	if info.IsDir() {
+		fs.buildIndex(p)
+	} else {
+		fs.putInode(newInode(hash(p), name, p, fuseops.InodeAttributes{
+			Nlink:  1,
+			Size:   uint64(info.Size()),
+			Mode:   info.Mode(),
+			Atime:  info.ModTime(),
+			Mtime:  info.ModTime(),
+			Ctime:  info.ModTime(),
+			Crtime: info.ModTime(),
+			Uid:    fs.uid,
+			Gid:    fs.gid,
+		}))
+	}
+
+	parent.addChild(hash(p), name, direntType(info))
+}
+
+// inodeByPath returns the ID of the inode at a path of the backend.
+func (fs *fileSystem) inodeByPath(p string) (fuseops.InodeID, bool) {
+	root := fs.getInodeOrDie(fuseops.RootInodeID).path
+	if p == root || (root == "" && p == "/") {
+		return fuseops.RootInodeID, true
+	}
+
+	_, ok := fs.lookUpInode(hash(p))
+
+	return hash(p), ok
+}
+
+// lstat returns the backend's file info for a path without following symlinks.
+func (fs *fileSystem) lstat(p string) (os.FileInfo, error) {
+	if lstater, ok := fs.backend.(afero.Lstater); ok {
+		info, _, err := lstater.LstatIfPossible(p)
+
+		return info, err
+	}
+
+	return fs.backend.Stat(p)
+}
+
+// serving marks the filesystem as mounted while it serves the operations of
+// the kernel. The notifier only delivers notifications in the meantime, so
+// they are skipped before the filesystem is mounted and after it was unmounted.
+// Expired entries are removed from the trash in the meantime as well.
+type serving struct {
+	fuse.Server
+
+	fs *fileSystem
+}
+
+func (s *serving) ServeOps(c *fuse.Connection) {
+	s.fs.setMounted(true)
+	defer s.fs.setMounted(false)
+
+	if s.fs.trash != nil && s.fs.trashMaxAge > 0 {
+		done := make(chan struct{})
+		defer close(done)
+
+		go s.fs.expireTrashPeriodically(done)
+	}
+
+	s.Server.ServeOps(c)
+}
+
+func (fs *fileSystem) setMounted(mounted bool) {
+	// Waits for the notifications in progress, which the notifier still delivers.
+	fs.mountedMu.Lock()
+	defer fs.mountedMu.Unlock()
+
+	fs.mounted = mounted
+}
+
+// invalidateInode drops the attributes and content of an inode cached by the
+// kernel. It must not be called while holding a lock an operation may wait for.
+func (fs *fileSystem) invalidateInode(id fuseops.InodeID) {
+	fs.mountedMu.RLock()
+	defer fs.mountedMu.RUnlock()
+
+	if !fs.mounted {
+		return
+	}
+
+	if err := fs.notifier.InvalidateInode(id, 0, 0); err != nil {
+		fs.log.Debug("FUSE.invalidateInode", map[string]interface{}{
+			"inode": id,
+			"err":   err,
+		})
+	}
+}
+
+// invalidateEntry drops the entry of a directory cached by the kernel. It
+// must not be called while holding a lock an operation may wait for.
+func (fs *fileSystem) invalidateEntry(parent fuseops.InodeID, name string) {
+	fs.mountedMu.RLock()
+	defer fs.mountedMu.RUnlock()
+
+	if !fs.mounted {
+		return
+	}
+
+	if err := fs.notifier.InvalidateEntry(parent, name); err != nil {
+		fs.log.Debug("FUSE.invalidateEntry", map[string]interface{}{
+			"parent": parent,
+			"name":   name,
+			"err":    err,
+		})
+	}
+}
+
+func direntType(info os.FileInfo) fuseutil.DirentType {
+	switch {
+	case info.IsDir():
+		return fuseutil.DT_Directory
+	case info.Mode()&os.ModeSymlink != 0:
+		return fuseutil.DT_Link
+	default:
+		return fuseutil.DT_File
+	}
+}
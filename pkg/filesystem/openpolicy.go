@@ -0,0 +1,92 @@
+package filesystem
+
+import (
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/rules"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// OpenPolicy selects how the kernel caches the content of the files opened
+// through the mount.
+type OpenPolicy struct {
+	// DirectIO lists patterns of paths in the mount whose content bypasses
+	// the page cache, in the syntax of the patterns of rules.
+	DirectIO []string
+	// KeepPageCache keeps what the kernel cached of a file across opens for
+	// as long as its modification time and size in the backend don't change.
+	KeepPageCache bool
+}
+
+// WithOpenPolicy selects how the kernel caches the content of opened files.
+// Files of backends implementing Streamer bypass the page cache regardless.
+func WithOpenPolicy(policy OpenPolicy) Option {
+	return func(fs *fileSystem) {
+		fs.openPolicy = policy
+	}
+}
+
+// openedVersion is the version of a file in the backend when it was last opened.
+type openedVersion struct {
+	mtime time.Time
+	size  int64
+}
+
+// applyOpenPolicy decides whether a file being opened bypasses the page
+// cache, or keeps what the kernel cached of it since it was last opened.
+func (fs *fileSystem) applyOpenPolicy(op *fuseops.OpenFileOp, in *inode, stream bool) {
+	p := fs.backendPath(in)
+
+	if stream {
+		op.UseDirectIO = true
+
+		return
+	}
+
+	if len(fs.openPolicy.DirectIO) > 0 {
+		mountPath := fs.mountPath(in.path)
+
+		for _, pattern := range fs.openPolicy.DirectIO {
+			if ok, _ := rules.Match(pattern, mountPath); ok {
+				op.UseDirectIO = true
+
+				return
+			}
+		}
+	}
+
+	if !fs.openPolicy.KeepPageCache {
+		return
+	}
+
+	info, err := fs.backend.Stat(p)
+	if err != nil {
+		return
+	}
+
+	version := openedVersion{mtime: info.ModTime(), size: info.Size()}
+
+	fs.openedMu.Lock()
+	defer fs.openedMu.Unlock()
+
+	last, ok := fs.openedVersions[in.id]
+	op.KeepPageCache = ok && last.mtime.Equal(version.mtime) && last.size == version.size
+
+	fs.openedVersions[in.id] = version
+}
+
+// forgetOpened forgets the version of a removed file, so that a file
+// created at its path doesn't keep what was cached of it.
+func (fs *fileSystem) forgetOpened(id fuseops.InodeID) {
+	fs.openedMu.Lock()
+	defer fs.openedMu.Unlock()
+
+	delete(fs.openedVersions, id)
+}
+
+// isStream reports whether the backend serves the content of an inode as a stream.
+func (fs *fileSystem) isStream(in *inode) bool {
+	streamer, ok := fs.backend.(Streamer)
+
+	return ok && streamer.IsStream(fs.backendPath(in))
+}
@@ -0,0 +1,70 @@
+package filesystem
+
+import (
+	"github.com/JakWai01/sile-fystem/pkg/logging"
+	"github.com/JakWai01/sile-fystem/pkg/posix"
+)
+
+// Option configures a filesystem created by New.
+type Option func(*fileSystem)
+
+// WithLogger logs the operations of the filesystem. By default, nothing is logged.
+func WithLogger(logger logging.StructuredLogger) Option {
+	return func(fs *fileSystem) {
+		fs.log = logger
+	}
+}
+
+// WithOwner sets the owner of all files. By default, the files belong to the current user.
+func WithOwner(uid uint32, gid uint32) Option {
+	return func(fs *fileSystem) {
+		fs.uid = uid
+		fs.gid = gid
+	}
+}
+
+// WithRoot serves the directory at root of the backend instead of its root.
+func WithRoot(root string) Option {
+	return func(fs *fileSystem) {
+		fs.root = root
+	}
+}
+
+// WithCacheTTL changes how long the kernel caches attributes and names.
+func WithCacheTTL(ttl CacheTTL) Option {
+	return func(fs *fileSystem) {
+		fs.ttl = ttl
+	}
+}
+
+// WithReadOnly rejects all changes with EROFS, and mounts the filesystem read-only when mounted with Mount.
+func WithReadOnly() Option {
+	return func(fs *fileSystem) {
+		fs.readOnly = true
+	}
+}
+
+// WithoutWritebackCaching makes the kernel send writes to the filesystem
+// immediately instead of caching them, when mounted with Mount.
+func WithoutWritebackCaching() Option {
+	return func(fs *fileSystem) {
+		fs.disableWriteback = true
+	}
+}
+
+// WithSync keeps a file opened by the kernel open on the backend for each
+// handle until it is released and serves attributes from the index.
+func WithSync() Option {
+	return func(fs *fileSystem) {
+		fs.sync = true
+	}
+}
+
+// defaultOptions are applied before the options passed to New.
+func defaultOptions() []Option {
+	return []Option{
+		WithLogger(logging.NoopLogger{}),
+		WithOwner(posix.CurrentUid(), posix.CurrentGid()),
+		WithCacheTTL(DefaultCacheTTL),
+	}
+}
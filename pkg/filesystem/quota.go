@@ -0,0 +1,224 @@
+package filesystem
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/JakWai01/sile-fystem/pkg/quota"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/spf13/afero"
+)
+
+// WithQuotas limits the bytes and inodes per user and directory. New files
+// are owned by the user creating them; changes exceeding a quota fail with EDQUOT.
+func WithQuotas(q *quota.Quotas) Option {
+	return func(fs *fileSystem) {
+		fs.quotas = q
+	}
+}
+
+// RebuildQuotas replaces the usage of the quotas with the content of the
+// backend below root, which must not be mounted. Files keep their known
+// owners; others are owned by the owner in the backend if it keeps track of
+// owners, and by uid otherwise.
+func RebuildQuotas(q *quota.Quotas, backend afero.Fs, root string, uid uint32) error {
+	var files []quota.File
+	if err := afero.Walk(backend, root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if isReserved(root, p) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		file := quota.File{Path: "/" + filepath.ToSlash(rel), Uid: uid}
+		if info.Mode().IsRegular() {
+			file.Size = info.Size()
+		}
+
+		if owner, ok := q.Owner(file.Path); ok {
+			file.Uid = owner
+		} else if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			file.Uid = stat.Uid
+		}
+
+		files = append(files, file)
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return q.Rebuild(files)
+}
+
+// chargeInode accounts for an inode created by the caller.
+func (fs *fileSystem) chargeInode(p string, caller fuseops.OpContext) error {
+	if fs.quotas == nil {
+		return nil
+	}
+
+	return quotaErr(fs.quotas.Create(fs.mountPath(p), caller.Uid))
+}
+
+// chargeSize accounts for the new size of a file. The returned function
+// refunds the charge if resizing the file fails; the caller must hold the
+// inode lock until then.
+func (fs *fileSystem) chargeSize(p string, size uint64) (func(), error) {
+	if fs.quotas == nil {
+		return func() {}, nil
+	}
+
+	p = fs.mountPath(p)
+
+	previous, ok := fs.quotas.Size(p)
+
+	if err := fs.quotas.Resize(p, int64(size)); err != nil {
+		return nil, quotaErr(err)
+	}
+
+	if !ok {
+		return func() {}, nil
+	}
+
+	return func() {
+		fs.refund("FUSE.chargeSize", p, previous)
+	}, nil
+}
+
+// chargeWrite accounts for a write ending at end. The returned function
+// refunds the charge if the write fails; the caller must hold the inode lock
+// until then.
+func (fs *fileSystem) chargeWrite(p string, end int64) (func(), error) {
+	if fs.quotas == nil {
+		return func() {}, nil
+	}
+
+	p = fs.mountPath(p)
+
+	size, ok := fs.quotas.Size(p)
+	if !ok || end <= size {
+		return func() {}, nil
+	}
+
+	if err := fs.quotas.Extend(p, end); err != nil {
+		return nil, quotaErr(err)
+	}
+
+	return func() {
+		fs.refund("FUSE.chargeWrite", p, size)
+	}, nil
+}
+
+// refund restores the size accounted for a file of the mount after the change charged for it failed.
+func (fs *fileSystem) refund(op string, p string, size int64) {
+	if err := fs.quotas.Resize(p, size); err != nil {
+		fs.log.Error(op, map[string]interface{}{
+			"path": p,
+			"err":  err,
+		})
+	}
+}
+
+// releaseInode releases an inode which was removed.
+func (fs *fileSystem) releaseInode(p string) {
+	if fs.quotas == nil {
+		return
+	}
+
+	if err := fs.quotas.Remove(fs.mountPath(p)); err != nil {
+		fs.log.Error("FUSE.releaseInode", map[string]interface{}{
+			"path": p,
+			"err":  err,
+		})
+	}
+}
+
+// moveQuota moves the accounting of an inode which was renamed.
+func (fs *fileSystem) moveQuota(oldPath string, newPath string) {
+	if fs.quotas == nil {
+		return
+	}
+
+	if err := fs.quotas.Rename(fs.mountPath(oldPath), fs.mountPath(newPath)); err != nil {
+		fs.log.Error("FUSE.moveQuota", map[string]interface{}{
+			"oldPath": oldPath,
+			"newPath": newPath,
+			"err":     err,
+		})
+	}
+}
+
+// statQuota limits the capacity reported by StatFS to the quota of the caller.
+// The caller of statfs(2) isn't passed to the filesystem, so this is the quota of the
+// owner, which is the only user able to access the mount without allow_other.
+func (fs *fileSystem) statQuota(op *fuseops.StatFSOp) {
+	if fs.quotas == nil {
+		return
+	}
+
+	q, ok := fs.quotas.User(fs.uid)
+	if !ok {
+		return
+	}
+
+	op.BlockSize = blockSize
+	op.IoSize = blockSize
+
+	if q.Limit.Bytes > 0 {
+		reported := op.Blocks != 0
+
+		op.Blocks = capTo(op.Blocks, uint64(q.Limit.Bytes)/blockSize, reported)
+		op.BlocksFree = capTo(op.BlocksFree, remaining(q.Limit.Bytes, q.Usage.Bytes)/blockSize, reported)
+		op.BlocksAvailable = op.BlocksFree
+	}
+
+	if q.Limit.Inodes > 0 {
+		reported := op.Inodes != 0
+
+		op.Inodes = capTo(op.Inodes, uint64(q.Limit.Inodes), reported)
+		op.InodesFree = capTo(op.InodesFree, remaining(q.Limit.Inodes, q.Usage.Inodes), reported)
+	}
+}
+
+// capTo returns the smaller of a value reported by the backend and max, or max if the backend reported nothing.
+func capTo(value uint64, max uint64, reported bool) uint64 {
+	if !reported || max < value {
+		return max
+	}
+
+	return value
+}
+
+func remaining(limit int64, used int64) uint64 {
+	if used >= limit {
+		return 0
+	}
+
+	return uint64(limit - used)
+}
+
+// quotaErr maps exceeded quotas to the error the kernel expects.
+func quotaErr(err error) error {
+	if errors.Is(err, quota.ErrExceeded) {
+		return syscall.EDQUOT
+	}
+
+	return err
+}
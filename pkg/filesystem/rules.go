@@ -0,0 +1,168 @@
+package filesystem
+
+import (
+	"context"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/rules"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// WithRules restricts the paths callers may access. Denied paths are hidden
+// from directory listings and reject operations with EACCES, read-only paths
+// reject changes with EROFS.
+func WithRules(r *rules.Rules) Option {
+	return func(fs *fileSystem) {
+		fs.rules = r
+	}
+}
+
+// ruleEnforcer is the interceptor rejecting the operations the rules don't permit.
+type ruleEnforcer struct {
+	fs *fileSystem
+}
+
+func (e *ruleEnforcer) Intercept(ctx context.Context, op interface{}, next Handler) error {
+	var err error
+
+	switch op := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		err = e.check(ctx, op.OpContext, false, e.childPath(op.Parent, op.Name))
+	case *fuseops.GetInodeAttributesOp:
+		err = e.check(ctx, op.OpContext, false, e.inodePath(op.Inode))
+	case *fuseops.ReadSymlinkOp:
+		err = e.check(ctx, op.OpContext, false, e.inodePath(op.Inode))
+	case *fuseops.GetXattrOp:
+		err = e.check(ctx, op.OpContext, false, e.inodePath(op.Inode))
+	case *fuseops.ListXattrOp:
+		err = e.check(ctx, op.OpContext, false, e.inodePath(op.Inode))
+	case *fuseops.OpenDirOp:
+		err = e.check(ctx, op.OpContext, false, e.inodePath(op.Inode))
+	case *fuseops.OpenFileOp:
+		write := !op.OpenFlags.IsReadOnly() || op.OpenFlags&syscall.O_TRUNC != 0
+
+		err = e.check(ctx, op.OpContext, write, e.inodePath(op.Inode))
+	case *fuseops.MkDirOp:
+		err = e.check(ctx, op.OpContext, true, e.childPath(op.Parent, op.Name))
+	case *fuseops.MkNodeOp:
+		err = e.check(ctx, op.OpContext, true, e.childPath(op.Parent, op.Name))
+	case *fuseops.CreateFileOp:
+		err = e.check(ctx, op.OpContext, true, e.childPath(op.Parent, op.Name))
+	case *fuseops.CreateSymlinkOp:
+		err = e.check(ctx, op.OpContext, true, e.childPath(op.Parent, op.Name))
+	case *fuseops.CreateLinkOp:
+		err = e.check(ctx, op.OpContext, true, e.inodePath(op.Target), e.childPath(op.Parent, op.Name))
+	case *fuseops.RenameOp:
+		err = e.check(ctx, op.OpContext, true, e.childPath(op.OldParent, op.OldName), e.childPath(op.NewParent, op.NewName))
+	case *fuseops.UnlinkOp:
+		err = e.check(ctx, op.OpContext, true, e.childPath(op.Parent, op.Name))
+	case *fuseops.RmDirOp:
+		err = e.check(ctx, op.OpContext, true, e.childPath(op.Parent, op.Name))
+	case *fuseops.SetInodeAttributesOp:
+		err = e.check(ctx, op.OpContext, true, e.inodePath(op.Inode))
+	case *fuseops.SetXattrOp:
+		err = e.check(ctx, op.OpContext, true, e.inodePath(op.Inode))
+	case *fuseops.RemoveXattrOp:
+		err = e.check(ctx, op.OpContext, true, e.inodePath(op.Inode))
+	case *fuseops.FallocateOp:
+		err = e.check(ctx, op.OpContext, true, e.inodePath(op.Inode))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return next(ctx)
+}
+
+// inodePath returns the path the rules of an inode are evaluated against.
+func (e *ruleEnforcer) inodePath(id fuseops.InodeID) string {
+	return e.fs.liveMountPath(e.fs.inodePath(id))
+}
+
+// childPath returns the path the rules of a child of an inode are evaluated against.
+func (e *ruleEnforcer) childPath(parent fuseops.InodeID, name string) string {
+	return e.fs.liveMountPath(e.fs.childPath(parent, name))
+}
+
+// liveMountPath maps a path in the mount to the live path it holds the content of.
+// Snapshots and versions are copies of live files, so the rules of the live
+// path apply to them, e.g. /.snapshots/<name>/secret and
+// /.versions/secret/<version> to /secret.
+func (fs *fileSystem) liveMountPath(p string) string {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 3)
+
+	switch {
+	case parts[0] == snapshotsDir:
+		if len(parts) < 3 {
+			return "/"
+		}
+
+		return "/" + parts[2]
+	case parts[0] == versionsDir && fs.retention != nil:
+		live := path.Join("/", strings.TrimPrefix(p, "/"+versionsDir))
+
+		if _, err := time.Parse(versionLayout, path.Base(live)); err == nil {
+			return path.Dir(live)
+		}
+
+		return live
+	}
+
+	return p
+}
+
+// check returns the error an operation of the caller on the paths is rejected with, if any.
+func (e *ruleEnforcer) check(ctx context.Context, caller fuseops.OpContext, write bool, paths ...string) error {
+	// The kernel sends operations on its own behalf, e.g. to write back its cache, without a pid.
+	if caller.Pid == 0 {
+		return nil
+	}
+
+	process, err := lookUpCaller(ctx, caller.Pid)
+	if err != nil {
+		return syscall.EACCES
+	}
+
+	gids := process.Gids()
+
+	for _, p := range paths {
+		switch e.fs.rules.Evaluate(p, caller.Uid, gids) {
+		case rules.Deny:
+			return syscall.EACCES
+		case rules.Traverse:
+			if write {
+				return syscall.EACCES
+			}
+		case rules.ReadOnly:
+			if write {
+				return syscall.EROFS
+			}
+		}
+	}
+
+	return nil
+}
+
+// visibleTo returns whether a caller may see a path of the backend in directory listings.
+func (fs *fileSystem) visibleTo(ctx context.Context, caller fuseops.OpContext) func(p string) bool {
+	if fs.rules == nil {
+		return func(p string) bool { return true }
+	}
+
+	process, err := lookUpCaller(ctx, caller.Pid)
+	if err != nil {
+		return func(p string) bool { return false }
+	}
+
+	gids := process.Gids()
+
+	root := fs.getInodeOrDie(fuseops.RootInodeID).path
+
+	return func(p string) bool {
+		return fs.rules.Evaluate(fs.liveMountPath(path.Join("/", strings.TrimPrefix(p, root))), caller.Uid, gids) != rules.Deny
+	}
+}
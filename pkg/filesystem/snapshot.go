@@ -0,0 +1,398 @@
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/spf13/afero"
+)
+
+const (
+	// snapshotsDir is the hidden directory in the root of the mount exposing the snapshots.
+	snapshotsDir = ".snapshots"
+
+	// snapshotStore is the directory in the root of the backend holding the
+	// content of files which changed after a snapshot was taken. Snapshots
+	// only last as long as the mount, so it is cleared on startup.
+	snapshotStore = ".sile-fystem-snapshots"
+)
+
+var errInvalidSnapshotName = errors.New("invalid snapshot name")
+
+// SnapshotInfo describes a snapshot of a mounted filesystem.
+type SnapshotInfo struct {
+	Name    string
+	Created time.Time
+}
+
+type snapshot struct {
+	SnapshotInfo
+
+	root fuseops.InodeID
+}
+
+// CreateSnapshot freezes the current state of the filesystem and exposes it
+// read-only under .snapshots/<name>. Taking a snapshot only copies the index;
+// the content of files is copied once they are about to change. Snapshots
+// don't outlive the mount; New deletes the content kept by a previous one.
+func (s *Server) CreateSnapshot(name string) error {
+	return s.fs.createSnapshot(name)
+}
+
+// ListSnapshots returns the snapshots of the filesystem ordered by name.
+func (s *Server) ListSnapshots() []SnapshotInfo {
+	return s.fs.listSnapshots()
+}
+
+// DeleteSnapshot removes a snapshot and the content kept for it.
+func (s *Server) DeleteSnapshot(name string) error {
+	return s.fs.deleteSnapshot(name)
+}
+
+func (fs *fileSystem) createSnapshot(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return errInvalidSnapshotName
+	}
+
+	dir := fs.getInodeOrDie(fs.snapshotsInode)
+
+	// Snapshots are taken and deleted one at a time.
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	fs.snapMu.Lock()
+	_, exists := fs.snapshots[name]
+	fs.snapMu.Unlock()
+
+	if exists {
+		return os.ErrExist
+	}
+
+	root := fs.getInodeOrDie(fuseops.RootInodeID)
+
+	snapshotPath := concatPath(dir.path, name)
+	if err := fs.freeze(root, snapshotPath); err != nil {
+		return err
+	}
+
+	dir.addChild(hash(snapshotPath), name, fuseutil.DT_Directory)
+
+	fs.snapMu.Lock()
+	defer fs.snapMu.Unlock()
+
+	fs.snapshots[name] = &snapshot{
+		SnapshotInfo: SnapshotInfo{
+			Name:    name,
+			Created: time.Now(),
+		},
+		root: hash(snapshotPath),
+	}
+
+	return nil
+}
+
+func (fs *fileSystem) listSnapshots() []SnapshotInfo {
+	fs.snapMu.Lock()
+	defer fs.snapMu.Unlock()
+
+	infos := []SnapshotInfo{}
+	for _, s := range fs.snapshots {
+		infos = append(infos, s.SnapshotInfo)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+func (fs *fileSystem) deleteSnapshot(name string) error {
+	if err := fs.deleteSnapshotLocked(name); err != nil {
+		return err
+	}
+
+	fs.invalidateEntry(fs.snapshotsInode, name)
+	fs.invalidateInode(fs.snapshotsInode)
+
+	return nil
+}
+
+func (fs *fileSystem) deleteSnapshotLocked(name string) error {
+	dir := fs.getInodeOrDie(fs.snapshotsInode)
+
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	fs.snapMu.Lock()
+	s, ok := fs.snapshots[name]
+	delete(fs.snapshots, name)
+	fs.snapMu.Unlock()
+
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	// The kernel may still reference the inodes of the snapshot, so they are
+	// detached instead of being dropped from the inode table.
+	fs.detach(fs.getInodeOrDie(s.root))
+
+	dir.removeChild(name)
+
+	return fs.backend.RemoveAll(fs.storePath(concatPath(dir.path, name)))
+}
+
+// freeze copies the index below live into a read-only tree at p. Each
+// directory is locked while it is copied, so that the tree is consistent
+// with the operations changing it.
+func (fs *fileSystem) freeze(live *inode, p string) error {
+	live.mu.RLock()
+	defer live.mu.RUnlock()
+
+	info, err := fs.stat(live)
+	if err != nil {
+		return err
+	}
+
+	attrs := live.attrs
+	attrs.Size = uint64(info.Size())
+	attrs.Mode = info.Mode() &^ 0222
+	attrs.Mtime = info.ModTime()
+
+	frozen := newInode(hash(p), path.Base(p), p, attrs)
+	frozen.frozen = true
+
+	switch {
+	case live.isDir():
+		for _, entry := range live.entries {
+			child, ok := fs.lookUpInode(entry.Inode)
+			if entry.Type == fuseutil.DT_Unknown || !ok {
+				continue
+			}
+
+			childPath := concatPath(p, entry.Name)
+			if err := fs.freeze(child, childPath); err != nil {
+				return err
+			}
+
+			frozen.addChild(hash(childPath), entry.Name, entry.Type)
+		}
+	case attrs.Mode&os.ModeSymlink != 0:
+		if reader, ok := fs.backend.(afero.LinkReader); ok {
+			if frozen.target, err = reader.ReadlinkIfPossible(live.path); err != nil {
+				return err
+			}
+		}
+	default:
+		// The snapshot shares the content of the backend, which has to include the cached writes.
+		if err := fs.cache.flush(live.id); err != nil {
+			return err
+		}
+
+		fs.snapMu.Lock()
+		frozen.origin = live.path
+		frozen.live = live.id
+		fs.cow[live.path] = append(fs.cow[live.path], frozen.id)
+		fs.snapMu.Unlock()
+	}
+
+	// Adding children touches the modification time.
+	frozen.attrs = attrs
+	fs.putInode(frozen)
+
+	return nil
+}
+
+// detach unlinks a frozen tree from the content it references.
+func (fs *fileSystem) detach(in *inode) {
+	in.mu.Lock()
+	entries := in.entries
+	in.entries = nil
+	in.mu.Unlock()
+
+	for _, entry := range entries {
+		if child, ok := fs.lookUpInode(entry.Inode); ok && child.frozen {
+			fs.detach(child)
+		}
+	}
+
+	fs.snapMu.Lock()
+	defer fs.snapMu.Unlock()
+
+	fs.unshare(in)
+}
+
+// unshare drops the content a frozen file shares with a live path. The caller must hold snapMu.
+func (fs *fileSystem) unshare(in *inode) {
+	if in.origin == "" {
+		return
+	}
+
+	ids := fs.cow[in.origin][:0]
+	for _, id := range fs.cow[in.origin] {
+		if id != in.id {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		delete(fs.cow, in.origin)
+	} else {
+		fs.cow[in.origin] = ids
+	}
+
+	in.origin = ""
+	in.live = 0
+}
+
+// preserve copies the content at a live path into the snapshots still
+// referencing it. It has to be called before the content is changed or
+// removed, with the live inode locked so that the content doesn't change
+// while it is copied. The content cached for the live inode is written back
+// before it is copied.
+func (fs *fileSystem) preserve(livePath string, live fuseops.InodeID) error {
+	fs.snapMu.Lock()
+	ids := append([]fuseops.InodeID{}, fs.cow[livePath]...)
+	fs.snapMu.Unlock()
+
+	// snapMu isn't held while copying, so that the snapshots stay readable meanwhile.
+	for _, id := range ids {
+		in, ok := fs.lookUpInode(id)
+		if !ok {
+			continue
+		}
+
+		fs.snapMu.Lock()
+		shared := in.origin == livePath
+		fs.snapMu.Unlock()
+
+		if !shared {
+			continue
+		}
+
+		if err := fs.cache.flush(live); err != nil {
+			return err
+		}
+
+		if err := fs.copyToStore(livePath, fs.storePath(in.path)); err != nil {
+			return err
+		}
+
+		// The snapshot may have been deleted or moved on during the copy.
+		fs.snapMu.Lock()
+		if in.origin == livePath {
+			fs.unshare(in)
+		}
+		fs.snapMu.Unlock()
+	}
+
+	return nil
+}
+
+// moveOrigins follows a rename of live content, which doesn't change it.
+func (fs *fileSystem) moveOrigins(oldPath string, newPath string) {
+	fs.snapMu.Lock()
+	defer fs.snapMu.Unlock()
+
+	for livePath, ids := range fs.cow {
+		if livePath != oldPath && !strings.HasPrefix(livePath, oldPath+"/") {
+			continue
+		}
+
+		moved := newPath + strings.TrimPrefix(livePath, oldPath)
+		for _, id := range ids {
+			if in, ok := fs.lookUpInode(id); ok {
+				in.origin = moved
+			}
+		}
+
+		delete(fs.cow, livePath)
+		fs.cow[moved] = append(fs.cow[moved], ids...)
+	}
+}
+
+// backendPath returns the path to access the content of an inode at.
+func (fs *fileSystem) backendPath(in *inode) string {
+	if !in.frozen {
+		return in.path
+	}
+
+	fs.snapMu.Lock()
+	defer fs.snapMu.Unlock()
+
+	if in.origin != "" {
+		return in.origin
+	}
+
+	return fs.storePath(in.path)
+}
+
+// lockContent returns the path to read the content of an inode at. Content a
+// frozen file shares with a live file is kept from changing until unlock is
+// called, by holding the read lock of the live inode, which writers hold
+// while preserving the content before they change it. The caller must hold
+// the lock of the inode.
+func (fs *fileSystem) lockContent(in *inode) (p string, unlock func()) {
+	if !in.frozen {
+		return in.path, func() {}
+	}
+
+	fs.snapMu.Lock()
+	id := in.live
+	fs.snapMu.Unlock()
+
+	live, ok := fs.lookUpInode(id)
+	if !ok {
+		return fs.backendPath(in), func() {}
+	}
+
+	live.mu.RLock()
+
+	// The content may have been preserved while waiting for the lock.
+	return fs.backendPath(in), live.mu.RUnlock
+}
+
+// storePath maps a path below .snapshots to the path its content is kept at.
+func (fs *fileSystem) storePath(p string) string {
+	root := fs.getInodeOrDie(fuseops.RootInodeID).path
+
+	return concatPath(root, snapshotStore) + strings.TrimPrefix(p, fs.getInodeOrDie(fs.snapshotsInode).path)
+}
+
+func (fs *fileSystem) copyToStore(src string, dst string) error {
+	if err := fs.backend.MkdirAll(path.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	in, err := fs.backend.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fs.backend.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+
+		return err
+	}
+
+	return out.Close()
+}
+
+// isFrozen reports whether an inode, or the child name of it, is part of the
+// read-only snapshots, or whether the whole filesystem is read-only.
+func (fs *fileSystem) isFrozen(parent *inode, name string) bool {
+	return fs.readOnly || parent.frozen || (parent.id == fuseops.RootInodeID && (name == snapshotsDir || name == versionsDir))
+}
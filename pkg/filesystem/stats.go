@@ -0,0 +1,66 @@
+package filesystem
+
+import (
+	"sync/atomic"
+)
+
+// Stats describes the activity of a filesystem.
+type Stats struct {
+	// Inodes is the number of inodes known to the filesystem.
+	Inodes int
+	// OpenFiles is the number of files opened by the kernel.
+	OpenFiles int
+	// Reads and Writes count the read and write requests served.
+	Reads  uint64
+	Writes uint64
+	// BytesRead and BytesWritten count the content read and written.
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// Stats returns the activity of the filesystem since it was created.
+func (s *Server) Stats() Stats {
+	return s.fs.stats()
+}
+
+func (fs *fileSystem) stats() Stats {
+	stats := Stats{
+		Reads:        atomic.LoadUint64(&fs.counters.Reads),
+		Writes:       atomic.LoadUint64(&fs.counters.Writes),
+		BytesRead:    atomic.LoadUint64(&fs.counters.BytesRead),
+		BytesWritten: atomic.LoadUint64(&fs.counters.BytesWritten),
+	}
+
+	fs.inodesMu.RLock()
+	stats.Inodes = len(fs.inodes)
+	fs.inodesMu.RUnlock()
+
+	fs.handlesMu.Lock()
+	stats.OpenFiles = len(fs.handles)
+	fs.handlesMu.Unlock()
+
+	return stats
+}
+
+// flush writes the block cache back, and the content of the files kept open in sync mode to stable storage.
+func (fs *fileSystem) flush() error {
+	if err := fs.cache.flushAll(); err != nil {
+		return err
+	}
+
+	// The handles stay registered while their files are synced, so that they aren't closed meanwhile.
+	fs.handlesMu.Lock()
+	defer fs.handlesMu.Unlock()
+
+	for _, h := range fs.handles {
+		if h.file == nil {
+			continue
+		}
+
+		if err := h.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package filesystem
+
+import (
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/trash"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// trashExpiryInterval is how often expired entries are removed from the trash.
+const trashExpiryInterval = time.Minute
+
+// EnableTrash moves deleted files and directories into the trash of the
+// backend instead of removing them. Entries older than maxAge are removed
+// from the trash (0 keeps them forever). It has to be called before the
+// filesystem is mounted.
+func (s *Server) EnableTrash(maxAge time.Duration) error {
+	return s.fs.enableTrash(maxAge)
+}
+
+func (fs *fileSystem) enableTrash(maxAge time.Duration) error {
+	fs.trashMu.Lock()
+	defer fs.trashMu.Unlock()
+
+	fs.trash = trash.New(fs.backend, fs.getInodeOrDie(fuseops.RootInodeID).path)
+	fs.trashMaxAge = maxAge
+
+	return fs.expireTrash()
+}
+
+// remove deletes a file or directory of the backend, moving it into the trash if enabled.
+func (fs *fileSystem) remove(p string) error {
+	if fs.trash == nil {
+		return fs.backend.Remove(p)
+	}
+
+	fs.trashMu.Lock()
+	defer fs.trashMu.Unlock()
+
+	return fs.trash.Move(p)
+}
+
+// expireTrashPeriodically removes the expired entries from the trash until
+// done is closed. It runs while the filesystem is mounted, so that removing
+// files doesn't wait for it.
+func (fs *fileSystem) expireTrashPeriodically(done <-chan struct{}) {
+	ticker := time.NewTicker(trashExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			fs.trashMu.Lock()
+			err := fs.expireTrash()
+			fs.trashMu.Unlock()
+
+			if err != nil {
+				fs.log.Error("FUSE.expireTrash", map[string]interface{}{
+					"err": err,
+				})
+			}
+		}
+	}
+}
+
+// expireTrash removes the entries older than the maximum age from the trash. The caller must hold trashMu.
+func (fs *fileSystem) expireTrash() error {
+	if fs.trashMaxAge <= 0 {
+		return nil
+	}
+
+	_, err := fs.trash.Empty(time.Now().Add(-fs.trashMaxAge))
+
+	return err
+}
@@ -0,0 +1,49 @@
+package filesystem
+
+import (
+	"math"
+	"time"
+)
+
+// Forever caches until the kernel evicts the entry or the filesystem invalidates it.
+const Forever = time.Duration(math.MaxInt64)
+
+// CacheTTL controls how long the kernel caches what it learns from the filesystem.
+type CacheTTL struct {
+	// Attributes is how long the attributes of inodes are cached.
+	Attributes time.Duration
+	// Entries is how long the names of directories are cached.
+	Entries time.Duration
+	// Negative is how long names which don't exist are cached (0 doesn't cache them).
+	Negative time.Duration
+}
+
+// DefaultCacheTTL caches attributes and names for a year and doesn't cache missing names.
+var DefaultCacheTTL = CacheTTL{
+	Attributes: 365 * 24 * time.Hour,
+	Entries:    365 * 24 * time.Hour,
+}
+
+// SetCacheTTL changes how long the kernel caches attributes and names. Short
+// TTLs suit backends changed by others, e.g. network backends, and Forever
+// suits backends which never change. It has to be called before the
+// filesystem is mounted.
+func (s *Server) SetCacheTTL(ttl CacheTTL) {
+	s.fs.ttl = ttl
+}
+
+func (fs *fileSystem) attributesExpiration() time.Time {
+	return expiration(fs.ttl.Attributes)
+}
+
+func (fs *fileSystem) entryExpiration() time.Time {
+	return expiration(fs.ttl.Entries)
+}
+
+func expiration(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(ttl)
+}
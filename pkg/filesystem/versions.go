@@ -0,0 +1,365 @@
+package filesystem
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/spf13/afero"
+)
+
+const (
+	// versionsDir is the hidden directory in the root of the mount exposing the previous versions of files.
+	versionsDir = ".versions"
+
+	// versionStore is the directory in the root of the backend holding the previous versions of files.
+	versionStore = ".sile-fystem-versions"
+
+	// versionLayout names versions by the time they were replaced, so that they sort chronologically.
+	versionLayout = "2006-01-02T15:04:05.000000000Z"
+)
+
+// Retention limits the versions kept per file.
+type Retention struct {
+	// Count is the maximum number of versions kept (0 is unlimited).
+	Count int
+	// MaxAge is the maximum age of versions kept (0 is unlimited).
+	MaxAge time.Duration
+}
+
+// handle is an open file of the kernel.
+type handle struct {
+	inode     fuseops.InodeID
+	versioned bool
+
+	// opener is the process which opened the file.
+	opener  fuseops.OpContext
+	written bool
+
+	// file is the file of the backend kept open for the handle in sync mode.
+	file afero.File
+}
+
+// EnableVersioning keeps the previous content of files opened for writing as
+// versions, which are exposed read-only under .versions/<path>/. It has to be
+// called before the filesystem is mounted.
+func (s *Server) EnableVersioning(retention Retention) {
+	s.fs.enableVersioning(retention)
+}
+
+func (fs *fileSystem) enableVersioning(retention Retention) {
+	fs.versionMu.Lock()
+	defer fs.versionMu.Unlock()
+
+	root := fs.getInodeOrDie(fuseops.RootInodeID).path
+
+	versionsPath := concatPath(root, versionsDir)
+	fs.versionsInode = hash(versionsPath)
+
+	in := newInode(fs.versionsInode, versionsDir, versionsPath, fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0555 | os.ModeDir,
+		Uid:   fs.uid,
+		Gid:   fs.gid,
+	})
+	in.frozen = true
+	in.versions = true
+	in.origin = concatPath(root, versionStore)
+
+	fs.putInode(in)
+	fs.retention = &retention
+}
+
+// openHandle registers a file opened by the kernel and returns its handle.
+// The file of the backend, if any, is closed once the handle is released.
+func (fs *fileSystem) openHandle(id fuseops.InodeID, opener fuseops.OpContext, file afero.File) fuseops.HandleID {
+	fs.handlesMu.Lock()
+	defer fs.handlesMu.Unlock()
+
+	fs.nextHandle++
+	fs.handles[fs.nextHandle] = &handle{inode: id, opener: opener, file: file}
+
+	return fs.nextHandle
+}
+
+// handleFile returns the file of the backend kept open for a handle.
+func (fs *fileSystem) handleFile(id fuseops.HandleID) (afero.File, bool) {
+	fs.handlesMu.Lock()
+	defer fs.handlesMu.Unlock()
+
+	h, ok := fs.handles[id]
+	if !ok || h.file == nil {
+		return nil, false
+	}
+
+	return h.file, true
+}
+
+// handleInode returns the inode a handle was opened for.
+func (fs *fileSystem) handleInode(id fuseops.HandleID) (fuseops.InodeID, bool) {
+	fs.handlesMu.Lock()
+	defer fs.handlesMu.Unlock()
+
+	h, ok := fs.handles[id]
+	if !ok {
+		return 0, false
+	}
+
+	return h.inode, true
+}
+
+// handleWritten reports whether a file was written to through a handle.
+func (fs *fileSystem) handleWritten(id fuseops.HandleID) bool {
+	fs.handlesMu.Lock()
+	defer fs.handlesMu.Unlock()
+
+	h, ok := fs.handles[id]
+
+	return ok && h.written
+}
+
+// markWritten remembers that a file was written to through a handle.
+func (fs *fileSystem) markWritten(id fuseops.HandleID) {
+	fs.handlesMu.Lock()
+	defer fs.handlesMu.Unlock()
+
+	if h, ok := fs.handles[id]; ok {
+		h.written = true
+	}
+}
+
+// releaseHandle closes the file kept open for the handle, reports a file
+// written to through it and applies the retention to the versions of the
+// file if they changed.
+func (fs *fileSystem) releaseHandle(id fuseops.HandleID) error {
+	fs.handlesMu.Lock()
+	h, ok := fs.handles[id]
+	delete(fs.handles, id)
+	fs.handlesMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	var err error
+	if h.file != nil {
+		err = h.file.Close()
+	}
+
+	in, ok := fs.lookUpInode(h.inode)
+	if !ok {
+		return err
+	}
+
+	in.mu.RLock()
+	p := in.path
+	in.mu.RUnlock()
+
+	if h.written {
+		fs.emit(EventWrite, p, "", in.id, h.opener)
+	}
+
+	if !h.versioned {
+		return err
+	}
+
+	fs.versionMu.Lock()
+	defer fs.versionMu.Unlock()
+
+	if pruneErr := fs.prune(fs.versionPath(p)); err == nil {
+		err = pruneErr
+	}
+
+	return err
+}
+
+// keepVersion copies the content of a file into a new version before it is
+// changed through a handle for the first time. Without a handle, e.g. for
+// truncate(2), a version is kept for every change. Versions belong to the
+// path of a file, so they don't follow renames. The content cached for the
+// inode is written back first, so that the version holds it.
+func (fs *fileSystem) keepVersion(p string, inode fuseops.InodeID, id *fuseops.HandleID) error {
+	if fs.retention == nil {
+		return nil
+	}
+
+	var h *handle
+	if id != nil {
+		fs.handlesMu.Lock()
+		h = fs.handles[*id]
+		versioned := h != nil && h.versioned
+		fs.handlesMu.Unlock()
+
+		if versioned {
+			return nil
+		}
+	}
+
+	if err := fs.cache.flush(inode); err != nil {
+		return err
+	}
+
+	info, err := fs.backend.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	// The caller holds the lock of the inode, so the content doesn't change
+	// while it is copied without holding versionMu.
+	if info.Mode().IsRegular() && info.Size() > 0 {
+		dir := fs.versionPath(p)
+		if err := fs.copyToStore(p, concatPath(dir, time.Now().UTC().Format(versionLayout))); err != nil {
+			return err
+		}
+
+		if h == nil {
+			fs.versionMu.Lock()
+			defer fs.versionMu.Unlock()
+
+			if err := fs.prune(dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	if h != nil {
+		fs.handlesMu.Lock()
+		h.versioned = true
+		fs.handlesMu.Unlock()
+	}
+
+	return nil
+}
+
+// prune removes the versions in a directory of the store exceeding the retention.
+func (fs *fileSystem) prune(dir string) error {
+	file, err := fs.backend.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	infos, err := file.Readdir(-1)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	versions := []string{}
+	for _, info := range infos {
+		if _, err := time.Parse(versionLayout, info.Name()); err == nil && info.Mode().IsRegular() {
+			versions = append(versions, info.Name())
+		}
+	}
+
+	// Newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+
+	for i, name := range versions {
+		created, _ := time.Parse(versionLayout, name)
+
+		if (fs.retention.Count > 0 && i >= fs.retention.Count) || (fs.retention.MaxAge > 0 && time.Since(created) > fs.retention.MaxAge) {
+			if err := fs.backend.Remove(concatPath(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// versionPath maps a live path to the directory its versions are kept in.
+func (fs *fileSystem) versionPath(p string) string {
+	root := fs.getInodeOrDie(fuseops.RootInodeID).path
+
+	return concatPath(concatPath(root, versionStore), strings.TrimPrefix(strings.TrimPrefix(p, root), "/"))
+}
+
+// lookUpVersion resolves a child of a directory below .versions from the store.
+func (fs *fileSystem) lookUpVersion(parent *inode, name string) (*inode, error) {
+	info, err := fs.backend.Stat(concatPath(parent.origin, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fuse.ENOENT
+		}
+
+		return nil, errno(err)
+	}
+
+	return fs.versionInode(parent, info), nil
+}
+
+// listVersions refreshes the entries of a directory below .versions from the store.
+func (fs *fileSystem) listVersions(dir *inode) error {
+	file, err := fs.backend.Open(dir.origin)
+	if err != nil {
+		if os.IsNotExist(err) {
+			dir.entries = nil
+
+			return nil
+		}
+
+		return errno(err)
+	}
+	defer file.Close()
+
+	infos, err := file.Readdir(-1)
+	if err != nil {
+		return errno(err)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+
+	entries := []fuseutil.Dirent{}
+	for _, info := range infos {
+		child := fs.versionInode(dir, info)
+
+		typ := fuseutil.DT_File
+		if info.IsDir() {
+			typ = fuseutil.DT_Directory
+		}
+
+		entries = append(entries, fuseutil.Dirent{
+			Offset: fuseops.DirOffset(len(entries) + 1),
+			Inode:  child.id,
+			Name:   info.Name(),
+			Type:   typ,
+		})
+	}
+
+	dir.entries = entries
+
+	return nil
+}
+
+func (fs *fileSystem) versionInode(parent *inode, info os.FileInfo) *inode {
+	p := concatPath(parent.path, info.Name())
+
+	in := newInode(hash(p), info.Name(), p, fuseops.InodeAttributes{
+		Nlink:  1,
+		Size:   uint64(info.Size()),
+		Mode:   info.Mode() &^ 0222,
+		Atime:  info.ModTime(),
+		Ctime:  info.ModTime(),
+		Crtime: info.ModTime(),
+		Uid:    fs.uid,
+		Gid:    fs.gid,
+	})
+	in.attrs.Mtime = info.ModTime()
+	in.frozen = true
+	in.versions = true
+	in.origin = concatPath(parent.origin, info.Name())
+
+	fs.putInode(in)
+
+	return in
+}
@@ -0,0 +1,206 @@
+package filesystem
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// WatchDir keeps the filesystem in sync with changes made by other processes
+// to dir, the directory of the host holding the files of the backend. The
+// backend must not change the names of files. Closing the returned watcher
+// stops watching.
+func (s *Server) WatchDir(dir string) (io.Closer, error) {
+	return s.fs.watchDir(dir)
+}
+
+// selfChangeTTL is how long the state the mount left a path in is remembered
+// to recognize the events caused by the mount itself.
+const selfChangeTTL = 10 * time.Second
+
+// maxChanges is the number of remembered changes above which expired ones are dropped.
+const maxChanges = 1024
+
+// changeLog remembers the state the mount left the paths of the backend in
+// while the storage folder is watched, so that the events caused by the
+// changes of the mount itself aren't reconciled.
+type changeLog struct {
+	mu       sync.Mutex
+	watching bool
+	changes  map[string]change
+}
+
+// change is the state of a path of the backend after the mount changed it.
+type change struct {
+	exists bool
+	size   int64
+	mode   os.FileMode
+	mtime  time.Time
+
+	at time.Time
+}
+
+func (fs *fileSystem) watchDir(dir string) (io.Closer, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	fs.changes.mu.Lock()
+	fs.changes.watching = true
+	if fs.changes.changes == nil {
+		fs.changes.changes = map[string]change{}
+	}
+	fs.changes.mu.Unlock()
+
+	if err := fs.addWatches(watcher, dir, dir); err != nil {
+		watcher.Close()
+
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				fs.handleEvent(watcher, dir, event)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				fs.log.Error("FUSE.watchDir", map[string]interface{}{
+					"err": err,
+				})
+			}
+		}
+	}()
+
+	return watcher, nil
+}
+
+// addWatches watches a directory of the host and the directories below it.
+func (fs *fileSystem) addWatches(watcher *fsnotify.Watcher, dir string, p string) error {
+	return filepath.Walk(p, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The directory may have been removed in the meantime.
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if fs.isReserved(fs.livePath(dir, p)) {
+			return filepath.SkipDir
+		}
+
+		return watcher.Add(p)
+	})
+}
+
+// livePath maps a path of the host to the path of the backend.
+func (fs *fileSystem) livePath(dir string, p string) string {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == "." {
+		return fs.getInodeOrDie(fuseops.RootInodeID).path
+	}
+
+	return concatPath(fs.getInodeOrDie(fuseops.RootInodeID).path, filepath.ToSlash(rel))
+}
+
+func (fs *fileSystem) handleEvent(watcher *fsnotify.Watcher, dir string, event fsnotify.Event) {
+	fs.log.Trace("FUSE.handleEvent", map[string]interface{}{
+		"name": event.Name,
+		"op":   event.Op,
+	})
+
+	p := fs.livePath(dir, event.Name)
+	if fs.isReserved(p) {
+		return
+	}
+
+	var err error
+	if !fs.changedByMount(p) {
+		err = fs.reconcile(p)
+	}
+
+	if err == nil && event.Op&fsnotify.Create != 0 {
+		if info, statErr := os.Lstat(event.Name); statErr == nil && info.IsDir() {
+			err = fs.addWatches(watcher, dir, event.Name)
+		}
+	}
+
+	if err != nil {
+		fs.log.Error("FUSE.handleEvent", map[string]interface{}{
+			"name": event.Name,
+			"err":  err,
+		})
+	}
+}
+
+// noteChange remembers the state the mount left a path of the backend in, if
+// the storage folder is watched.
+func (fs *fileSystem) noteChange(p string) {
+	fs.changes.mu.Lock()
+	watching := fs.changes.watching
+	fs.changes.mu.Unlock()
+
+	if !watching {
+		return
+	}
+
+	c := change{at: time.Now()}
+	if info, err := fs.lstat(p); err == nil {
+		c.exists = true
+		c.size = info.Size()
+		c.mode = info.Mode()
+		c.mtime = info.ModTime()
+	}
+
+	fs.changes.mu.Lock()
+	defer fs.changes.mu.Unlock()
+
+	if len(fs.changes.changes) >= maxChanges {
+		for p, c := range fs.changes.changes {
+			if time.Since(c.at) > selfChangeTTL {
+				delete(fs.changes.changes, p)
+			}
+		}
+	}
+
+	fs.changes.changes[p] = c
+}
+
+// changedByMount reports whether a path of the backend is still in the state
+// the mount recently left it in, i.e. whether an event for it was caused by
+// the mount itself.
+func (fs *fileSystem) changedByMount(p string) bool {
+	fs.changes.mu.Lock()
+	c, ok := fs.changes.changes[p]
+	fs.changes.mu.Unlock()
+
+	if !ok || time.Since(c.at) > selfChangeTTL {
+		return false
+	}
+
+	info, err := fs.lstat(p)
+	if err != nil {
+		return os.IsNotExist(err) && !c.exists
+	}
+
+	return c.exists && info.Size() == c.size && info.Mode() == c.mode && info.ModTime().Equal(c.mtime)
+}
@@ -0,0 +1,18 @@
+package logging
+
+import (
+	golog "github.com/fclairamb/go-log"
+)
+
+// NoopLogger discards everything logged to it.
+type NoopLogger struct{}
+
+func (l NoopLogger) Trace(event string, keyvals ...interface{}) {}
+func (l NoopLogger) Debug(event string, keyvals ...interface{}) {}
+func (l NoopLogger) Info(event string, keyvals ...interface{})  {}
+func (l NoopLogger) Warn(event string, keyvals ...interface{})  {}
+func (l NoopLogger) Error(event string, keyvals ...interface{}) {}
+
+func (l NoopLogger) With(keyvals ...interface{}) golog.Logger {
+	return l
+}
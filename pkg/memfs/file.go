@@ -0,0 +1,182 @@
+package memfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// File wraps a MemMapFs file to account for the memory its content uses.
+type File struct {
+	afero.File
+
+	fs    *Fs
+	key   string
+	flag  int
+	state *fileState
+}
+
+func (f *File) Close() error {
+	if f.state != nil {
+		f.fs.mu.Lock()
+		f.state.open--
+		f.fs.mu.Unlock()
+	}
+
+	return f.File.Close()
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	f.touch()
+
+	return f.File.Read(p)
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.touch()
+
+	return f.File.ReadAt(p, off)
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	if f.state == nil {
+		return f.File.Write(p)
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	off := f.state.size
+	if f.flag&os.O_APPEND == 0 {
+		var err error
+		if off, err = f.File.Seek(0, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := f.grow(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	n, err := f.File.Write(p)
+	f.settle()
+
+	return n, err
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if f.state == nil {
+		return f.File.WriteAt(p, off)
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.grow(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	n, err := f.File.WriteAt(p, off)
+	f.settle()
+
+	return n, err
+}
+
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *File) Truncate(size int64) error {
+	if f.state == nil {
+		return f.File.Truncate(size)
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.grow(size); err != nil {
+		return err
+	}
+
+	err := f.File.Truncate(size)
+	f.settle()
+
+	return err
+}
+
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	for i, info := range infos {
+		infos[i] = f.fs.withSize(path.Join(f.key, info.Name()), info)
+	}
+
+	return infos, err
+}
+
+// grow reserves the memory needed to extend the file to end bytes. The caller must hold fs.mu.
+func (f *File) grow(end int64) error {
+	if end <= f.state.size {
+		return nil
+	}
+
+	if err := f.fs.reserveBytes(f.key, end-f.state.size); err != nil {
+		return &os.PathError{Op: "write", Path: f.Name(), Err: err}
+	}
+
+	f.state.size = end
+
+	return nil
+}
+
+// settle corrects the accounting to the actual size of the file after a write. The caller must hold fs.mu.
+func (f *File) settle() {
+	if info, err := f.File.Stat(); err == nil {
+		f.fs.bytes += info.Size() - f.state.size
+		f.state.size = info.Size()
+	}
+
+	f.state.atime = time.Now()
+}
+
+func (f *File) touch() {
+	if f.state == nil {
+		return
+	}
+
+	f.fs.mu.Lock()
+	f.state.atime = time.Now()
+	f.fs.mu.Unlock()
+}
+
+// spilledFile is a read-only handle to file content that was spilled to disk.
+type spilledFile struct {
+	*os.File
+
+	name string
+	info os.FileInfo
+}
+
+func (f *spilledFile) Name() string {
+	return f.name
+}
+
+func (f *spilledFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+type sizedInfo struct {
+	os.FileInfo
+
+	size int64
+}
+
+func (fi *sizedInfo) Size() int64 {
+	return fi.size
+}
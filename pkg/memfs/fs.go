@@ -0,0 +1,468 @@
+package memfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/afero/mem"
+)
+
+const (
+	xattrCreate  = 1
+	xattrReplace = 2
+)
+
+// Fs is an afero.MemMapFs extended with symlinks, extended attributes and
+// optional limits on the memory and inodes it may use.
+// Symlinks are stored as files with os.ModeSymlink set, holding the link target as content.
+type Fs struct {
+	afero.Fs
+
+	limits Limits
+
+	mu     sync.Mutex
+	xattrs map[string]map[string][]byte
+	files  map[string]*fileState
+	dirs   map[string]bool
+	bytes  int64
+	spills int
+}
+
+type fileState struct {
+	size  int64
+	atime time.Time
+	open  int
+	spill string
+	link  bool
+}
+
+func NewFs() *Fs {
+	fs, _ := NewLimitedFs(Limits{})
+
+	return fs
+}
+
+// NewLimitedFs creates an Fs enforcing limits. If limits.SpillDir is set,
+// a private directory for spilled content is created below it.
+func NewLimitedFs(limits Limits) (*Fs, error) {
+	if limits.SpillDir != "" {
+		if err := os.MkdirAll(limits.SpillDir, os.ModePerm); err != nil {
+			return nil, err
+		}
+
+		dir, err := ioutil.TempDir(limits.SpillDir, "memfs")
+		if err != nil {
+			return nil, err
+		}
+
+		limits.SpillDir = dir
+	}
+
+	return &Fs{
+		Fs:     afero.NewMemMapFs(),
+		limits: limits,
+		xattrs: make(map[string]map[string][]byte),
+		files:  make(map[string]*fileState),
+		dirs:   make(map[string]bool),
+	}, nil
+}
+
+func (fs *Fs) Name() string {
+	return "memfs"
+}
+
+// Close removes the content spilled to disk. The Fs must not be used afterwards.
+func (fs *Fs) Close() error {
+	if fs.limits.SpillDir == "" {
+		return nil
+	}
+
+	return os.RemoveAll(fs.limits.SpillDir)
+}
+
+func (fs *Fs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *Fs) Mkdir(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	key := normalize(name)
+
+	if !fs.dirs[key] {
+		if err := fs.reserveInodes(1); err != nil {
+			return &os.PathError{Op: "mkdir", Path: name, Err: err}
+		}
+	}
+
+	if err := fs.Fs.Mkdir(name, perm); err != nil {
+		return err
+	}
+
+	fs.dirs[key] = true
+
+	return nil
+}
+
+func (fs *Fs) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	missing := []string{}
+	for dir := normalize(path); dir != "/" && !fs.dirs[dir]; dir = filepath.Dir(dir) {
+		missing = append(missing, dir)
+	}
+
+	if err := fs.reserveInodes(len(missing)); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+
+	if err := fs.Fs.MkdirAll(path, perm); err != nil {
+		return err
+	}
+
+	for _, dir := range missing {
+		fs.dirs[dir] = true
+	}
+
+	return nil
+}
+
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	key := normalize(name)
+
+	state, exists := fs.files[key]
+	if !exists && !fs.dirs[key] && key != "/" && flag&os.O_CREATE != 0 {
+		if err := fs.reserveInodes(1); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+
+	if exists && state.spill != "" {
+		switch {
+		case flag&(os.O_WRONLY|os.O_RDWR) == 0:
+			return fs.openSpilled(name, state)
+		case flag&os.O_TRUNC != 0:
+			os.Remove(state.spill)
+			state.spill = ""
+			state.size = 0
+		default:
+			if err := fs.unspill(key, state); err != nil {
+				return nil, &os.PathError{Op: "open", Path: name, Err: err}
+			}
+		}
+	}
+
+	file, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return &File{File: file, fs: fs, key: key, flag: flag}, nil
+	}
+
+	if !exists {
+		state = &fileState{}
+		fs.files[key] = state
+	}
+
+	// Truncation through O_TRUNC happens within MemMapFs, so the accounting is corrected afterwards.
+	fs.bytes += info.Size() - state.size
+	state.size = info.Size()
+	state.atime = time.Now()
+	state.open++
+
+	return &File{File: file, fs: fs, key: key, flag: flag, state: state}, nil
+}
+
+func (fs *Fs) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.Fs.Remove(name); err != nil {
+		return err
+	}
+
+	fs.forget(normalize(name), false)
+
+	return nil
+}
+
+func (fs *Fs) RemoveAll(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.Fs.RemoveAll(path); err != nil {
+		return err
+	}
+
+	fs.forget(normalize(path), true)
+
+	return nil
+}
+
+func (fs *Fs) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.Fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+
+	oldPrefix := normalize(oldname)
+	newPrefix := normalize(newname)
+
+	if oldPrefix == newPrefix {
+		return nil
+	}
+
+	fs.forget(newPrefix, false)
+
+	for name, attrs := range fs.xattrs {
+		if isBelow(name, oldPrefix) {
+			delete(fs.xattrs, name)
+			fs.xattrs[newPrefix+strings.TrimPrefix(name, oldPrefix)] = attrs
+		}
+	}
+
+	for name, state := range fs.files {
+		if isBelow(name, oldPrefix) {
+			delete(fs.files, name)
+			fs.files[newPrefix+strings.TrimPrefix(name, oldPrefix)] = state
+		}
+	}
+
+	for name := range fs.dirs {
+		if isBelow(name, oldPrefix) {
+			delete(fs.dirs, name)
+			fs.dirs[newPrefix+strings.TrimPrefix(name, oldPrefix)] = true
+		}
+	}
+
+	return nil
+}
+
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.withSize(normalize(name), info), nil
+}
+
+func (fs *Fs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	// MemMapFs never follows symlinks, so Stat already behaves like Lstat.
+	info, err := fs.Stat(name)
+
+	return info, true, err
+}
+
+func (fs *Fs) SymlinkIfPossible(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.reserveInodes(1); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+
+	if err := fs.reserveBytes("", int64(len(oldname))); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+
+	file, err := fs.Fs.OpenFile(newname, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0777)
+	if err != nil {
+		fs.bytes -= int64(len(oldname))
+
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	defer file.Close()
+
+	fs.files[normalize(newname)] = &fileState{
+		size:  int64(len(oldname)),
+		atime: time.Now(),
+		link:  true,
+	}
+
+	if _, err := file.WriteString(oldname); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+
+	memFile, ok := file.(*mem.File)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+	}
+
+	mem.SetMode(memFile.Data(), os.ModeSymlink|0777)
+
+	return nil
+}
+
+func (fs *Fs) ReadlinkIfPossible(name string) (string, error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil {
+		return "", err
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+
+	target, err := afero.ReadFile(fs.Fs, name)
+	if err != nil {
+		return "", err
+	}
+
+	return string(target), nil
+}
+
+func (fs *Fs) GetXattr(name string, attr string) ([]byte, error) {
+	if _, err := fs.Fs.Stat(name); err != nil {
+		return nil, syscall.ENOENT
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	value, ok := fs.xattrs[normalize(name)][attr]
+	if !ok {
+		return nil, syscall.ENODATA
+	}
+
+	return append([]byte{}, value...), nil
+}
+
+func (fs *Fs) ListXattr(name string) ([]string, error) {
+	if _, err := fs.Fs.Stat(name); err != nil {
+		return nil, syscall.ENOENT
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	names := []string{}
+	for attr := range fs.xattrs[normalize(name)] {
+		names = append(names, attr)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (fs *Fs) SetXattr(name string, attr string, value []byte, flags int) error {
+	if _, err := fs.Fs.Stat(name); err != nil {
+		return syscall.ENOENT
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	key := normalize(name)
+
+	attrs, ok := fs.xattrs[key]
+	if !ok {
+		attrs = make(map[string][]byte)
+		fs.xattrs[key] = attrs
+	}
+
+	_, exists := attrs[attr]
+	if exists && flags&xattrCreate != 0 {
+		return syscall.EEXIST
+	}
+
+	if !exists && flags&xattrReplace != 0 {
+		return syscall.ENODATA
+	}
+
+	attrs[attr] = append([]byte{}, value...)
+
+	return nil
+}
+
+func (fs *Fs) RemoveXattr(name string, attr string) error {
+	if _, err := fs.Fs.Stat(name); err != nil {
+		return syscall.ENOENT
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	key := normalize(name)
+
+	if _, ok := fs.xattrs[key][attr]; !ok {
+		return syscall.ENODATA
+	}
+
+	delete(fs.xattrs[key], attr)
+
+	return nil
+}
+
+// forget drops the bookkeeping of a removed entry, and of everything below it if recursive is set.
+func (fs *Fs) forget(prefix string, recursive bool) {
+	matches := func(name string) bool {
+		if recursive {
+			return isBelow(name, prefix)
+		}
+
+		return name == prefix
+	}
+
+	for name := range fs.xattrs {
+		if matches(name) {
+			delete(fs.xattrs, name)
+		}
+	}
+
+	for name, state := range fs.files {
+		if matches(name) {
+			if state.spill != "" {
+				os.Remove(state.spill)
+			} else {
+				fs.bytes -= state.size
+			}
+
+			delete(fs.files, name)
+		}
+	}
+
+	for name := range fs.dirs {
+		if matches(name) {
+			delete(fs.dirs, name)
+		}
+	}
+}
+
+func normalize(name string) string {
+	return filepath.Clean("/" + name)
+}
+
+func isBelow(name string, prefix string) bool {
+	return name == prefix || prefix == "/" || strings.HasPrefix(name, prefix+"/")
+}
@@ -0,0 +1,245 @@
+package memfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+)
+
+// unlimited is reported as capacity by StatFS for limits that are not set.
+const unlimited = 1 << 50
+
+// Limits restricts the resources an Fs may use. Zero values disable a limit.
+type Limits struct {
+	// MaxBytes is the amount of file content kept in memory.
+	MaxBytes int64
+
+	// MaxInodes is the number of files, directories and symlinks.
+	MaxInodes int64
+
+	// SpillDir enables moving the content of the least recently used files
+	// to disk instead of failing with ENOSPC once MaxBytes is reached.
+	SpillDir string
+}
+
+// StatFS reports the memory and inode usage against the configured limits.
+func (fs *Fs) StatFS() (filesystem.Usage, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	usage := filesystem.Usage{
+		TotalBytes:  unlimited,
+		TotalInodes: unlimited,
+	}
+
+	if fs.limits.MaxBytes > 0 {
+		usage.TotalBytes = uint64(fs.limits.MaxBytes)
+	}
+
+	if fs.limits.MaxInodes > 0 {
+		usage.TotalInodes = uint64(fs.limits.MaxInodes)
+	}
+
+	if used := uint64(fs.bytes); used < usage.TotalBytes {
+		usage.FreeBytes = usage.TotalBytes - used
+	}
+
+	if used := uint64(len(fs.files) + len(fs.dirs)); used < usage.TotalInodes {
+		usage.FreeInodes = usage.TotalInodes - used
+	}
+
+	return usage, nil
+}
+
+func (fs *Fs) reserveInodes(n int) error {
+	if fs.limits.MaxInodes > 0 && int64(len(fs.files)+len(fs.dirs)+n) > fs.limits.MaxInodes {
+		return syscall.ENOSPC
+	}
+
+	return nil
+}
+
+// reserveBytes accounts for delta additional bytes of content, spilling other
+// files than key to disk if needed. The caller must hold fs.mu.
+func (fs *Fs) reserveBytes(key string, delta int64) error {
+	if fs.limits.MaxBytes <= 0 || delta <= 0 || fs.bytes+delta <= fs.limits.MaxBytes {
+		fs.bytes += delta
+
+		return nil
+	}
+
+	if fs.limits.SpillDir == "" {
+		return syscall.ENOSPC
+	}
+
+	candidates := []string{}
+	for name, state := range fs.files {
+		if name != key && state.open == 0 && state.spill == "" && !state.link && state.size > 0 {
+			candidates = append(candidates, name)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return fs.files[candidates[i]].atime.Before(fs.files[candidates[j]].atime)
+	})
+
+	for _, name := range candidates {
+		if fs.bytes+delta <= fs.limits.MaxBytes {
+			break
+		}
+
+		if err := fs.spill(name, fs.files[name]); err != nil {
+			return err
+		}
+	}
+
+	if fs.bytes+delta > fs.limits.MaxBytes {
+		return syscall.ENOSPC
+	}
+
+	fs.bytes += delta
+
+	return nil
+}
+
+// spill moves the content of a file to disk and truncates it in memory,
+// keeping its modification time.
+func (fs *Fs) spill(key string, state *fileState) error {
+	info, err := fs.Fs.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	fs.spills++
+	spillPath := filepath.Join(fs.limits.SpillDir, strconv.Itoa(fs.spills))
+
+	out, err := os.OpenFile(spillPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	in, err := fs.Fs.Open(key)
+	if err != nil {
+		out.Close()
+		os.Remove(spillPath)
+
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	in.Close()
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+
+	if err != nil {
+		os.Remove(spillPath)
+
+		return err
+	}
+
+	file, err := fs.Fs.OpenFile(key, os.O_WRONLY, 0)
+	if err != nil {
+		os.Remove(spillPath)
+
+		return err
+	}
+
+	err = file.Truncate(0)
+	file.Close()
+	if err != nil {
+		os.Remove(spillPath)
+
+		return err
+	}
+
+	if err := fs.Fs.Chtimes(key, state.atime, info.ModTime()); err != nil {
+		return err
+	}
+
+	state.spill = spillPath
+	fs.bytes -= state.size
+
+	return nil
+}
+
+// unspill loads the content of a spilled file back into memory.
+func (fs *Fs) unspill(key string, state *fileState) error {
+	if err := fs.reserveBytes(key, state.size); err != nil {
+		return err
+	}
+
+	info, err := fs.Fs.Stat(key)
+	if err != nil {
+		fs.bytes -= state.size
+
+		return err
+	}
+
+	in, err := os.Open(state.spill)
+	if err != nil {
+		fs.bytes -= state.size
+
+		return err
+	}
+	defer in.Close()
+
+	out, err := fs.Fs.OpenFile(key, os.O_WRONLY, 0)
+	if err != nil {
+		fs.bytes -= state.size
+
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	out.Close()
+	if err != nil {
+		fs.bytes -= state.size
+
+		return err
+	}
+
+	if err := fs.Fs.Chtimes(key, state.atime, info.ModTime()); err != nil {
+		return err
+	}
+
+	os.Remove(state.spill)
+	state.spill = ""
+
+	return nil
+}
+
+// openSpilled serves a read-only handle of a spilled file directly from disk.
+func (fs *Fs) openSpilled(name string, state *fileState) (*spilledFile, error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(state.spill)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &spilledFile{
+		File: file,
+		name: name,
+		info: &sizedInfo{FileInfo: info, size: state.size},
+	}, nil
+}
+
+// withSize reports the logical size of spilled files. The caller must hold fs.mu.
+func (fs *Fs) withSize(key string, info os.FileInfo) os.FileInfo {
+	if state, ok := fs.files[key]; ok && state.spill != "" {
+		return &sizedInfo{FileInfo: info, size: state.size}
+	}
+
+	return info
+}
@@ -0,0 +1,239 @@
+package memfs
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/afero"
+)
+
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// Save serializes the tree of fs into a tar archive at path.
+// The archive is written to a temporary file first and renamed into place,
+// so an existing snapshot is never left half-written.
+func Save(fs afero.Fs, path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	tw := tar.NewWriter(tmp)
+
+	err = afero.Walk(fs, "/", func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if normalize(p) == "/" {
+			return nil
+		}
+
+		return writeEntry(tw, fs, normalize(p), info)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load restores a tree previously written by Save into fs.
+// A missing snapshot file is not an error, as there is nothing to restore on the first run.
+func Load(fs afero.Fs, path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dirTimes := map[string]time.Time{}
+
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		name := normalize(hdr.Name)
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := fs.MkdirAll(name, mode); err != nil {
+				return err
+			}
+
+			if err := fs.Chmod(name, mode); err != nil {
+				return err
+			}
+
+			dirTimes[name] = hdr.ModTime
+		case tar.TypeSymlink:
+			linker, ok := fs.(afero.Linker)
+			if !ok {
+				return &os.LinkError{Op: "symlink", Old: hdr.Linkname, New: name, Err: afero.ErrNoSymlink}
+			}
+
+			if err := linker.SymlinkIfPossible(hdr.Linkname, name); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			out, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+
+				return err
+			}
+
+			if err := out.Close(); err != nil {
+				return err
+			}
+
+			if err := fs.Chmod(name, mode); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+
+		if err := restoreXattrs(fs, name, hdr.PAXRecords); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeDir {
+			if err := fs.Chtimes(name, hdr.AccessTime, hdr.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Directory times are restored last, as adding children updates them.
+	for name, mtime := range dirTimes {
+		if err := fs.Chtimes(name, mtime, mtime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeEntry(tw *tar.Writer, fs afero.Fs, name string, info os.FileInfo) error {
+	hdr := &tar.Header{
+		Name:       strings.TrimPrefix(name, "/"),
+		Mode:       int64(info.Mode().Perm()),
+		ModTime:    info.ModTime(),
+		AccessTime: info.ModTime(),
+		Format:     tar.FormatPAX,
+	}
+
+	switch {
+	case info.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case info.Mode()&os.ModeSymlink != 0:
+		reader, ok := fs.(afero.LinkReader)
+		if !ok {
+			return &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+		}
+
+		target, err := reader.ReadlinkIfPossible(name)
+		if err != nil {
+			return err
+		}
+
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = target
+	case info.Mode().IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+	default:
+		return nil
+	}
+
+	if xattrer, ok := fs.(filesystem.Xattrer); ok {
+		names, err := xattrer.ListXattr(name)
+		if err != nil {
+			return err
+		}
+
+		for _, attr := range names {
+			value, err := xattrer.GetXattr(name, attr)
+			if err != nil {
+				return err
+			}
+
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[xattrPAXPrefix+attr] = string(value)
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	file, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.CopyN(tw, file, hdr.Size)
+
+	return err
+}
+
+func restoreXattrs(fs afero.Fs, name string, records map[string]string) error {
+	xattrer, ok := fs.(filesystem.Xattrer)
+	if !ok {
+		return nil
+	}
+
+	for key, value := range records {
+		if !strings.HasPrefix(key, xattrPAXPrefix) {
+			continue
+		}
+
+		if err := xattrer.SetXattr(name, strings.TrimPrefix(key, xattrPAXPrefix), []byte(value), 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
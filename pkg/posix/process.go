@@ -0,0 +1,70 @@
+package posix
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Process describes a running process.
+type Process struct {
+	Name string
+	// Gid is the group the process accesses files as.
+	Gid uint32
+	// Groups are the supplementary groups of the process.
+	Groups []uint32
+}
+
+// Gids returns the filesystem group followed by the supplementary groups of the process.
+func (p Process) Gids() []uint32 {
+	return append([]uint32{p.Gid}, p.Groups...)
+}
+
+// LookUpProcess returns the name and groups of a process from /proc.
+func LookUpProcess(pid uint32) (Process, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return Process{}, err
+	}
+	defer file.Close()
+
+	process := Process{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		fields := strings.Fields(value)
+
+		switch key {
+		case "Name":
+			process.Name = strings.TrimSpace(value)
+		case "Gid":
+			// Real, effective, saved and filesystem group
+			if len(fields) == 4 {
+				gid, err := strconv.ParseUint(fields[3], 10, 32)
+				if err != nil {
+					return Process{}, err
+				}
+
+				process.Gid = uint32(gid)
+			}
+		case "Groups":
+			for _, field := range fields {
+				gid, err := strconv.ParseUint(field, 10, 32)
+				if err != nil {
+					return Process{}, err
+				}
+
+				process.Groups = append(process.Groups, uint32(gid))
+			}
+		}
+	}
+
+	return process, scanner.Err()
+}
@@ -0,0 +1,539 @@
+// Package quota limits the bytes and inodes used per user and per directory
+// of a filesystem.
+//
+// The owner and size of every file are kept in a SQLite database next to the
+// storage, so that the usage survives remounts. The usage of a directory
+// includes everything below it, but not the directory itself.
+package quota
+
+import (
+	"database/sql"
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	kindUser = "uid"
+	kindDir  = "dir"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS limits (
+	kind TEXT NOT NULL,
+	id TEXT NOT NULL,
+	bytes INTEGER NOT NULL,
+	inodes INTEGER NOT NULL,
+	PRIMARY KEY (kind, id)
+);
+
+CREATE TABLE IF NOT EXISTS files (
+	path TEXT PRIMARY KEY,
+	uid INTEGER NOT NULL,
+	size INTEGER NOT NULL
+);
+`
+
+// ErrExceeded is returned if a change would exceed a quota.
+var ErrExceeded = errors.New("quota exceeded")
+
+// Limit is the maximum of bytes and inodes. Zero is unlimited.
+type Limit struct {
+	Bytes  int64
+	Inodes int64
+}
+
+// Usage is the amount of bytes and inodes in use.
+type Usage struct {
+	Bytes  int64
+	Inodes int64
+}
+
+// Quota is the limit of a user or a directory and its usage.
+type Quota struct {
+	// Dir is the directory the quota applies to, or empty for the quota of Uid.
+	Dir   string
+	Uid   uint32
+	Limit Limit
+	Usage Usage
+}
+
+// File is the owner and size of a file, directory or other inode.
+type File struct {
+	Path string
+	Uid  uint32
+	Size int64
+}
+
+// Quotas tracks the usage of a filesystem against its quotas. Paths are
+// absolute paths in the filesystem.
+type Quotas struct {
+	mu    sync.Mutex
+	db    *sql.DB
+	files map[string]File
+	users map[uint32]*Quota
+	dirs  map[string]*Quota
+}
+
+// Open opens the quota database at name, creating it if it doesn't exist yet.
+func Open(name string) (*Quotas, error) {
+	db, err := sql.Open("sqlite", name+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite serializes writers anyway; a single connection avoids busy errors
+	// between the connections of the pool.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	q := &Quotas{
+		db:    db,
+		files: map[string]File{},
+		users: map[uint32]*Quota{},
+		dirs:  map[string]*Quota{},
+	}
+
+	if err := q.load(); err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Close closes the quota database.
+func (q *Quotas) Close() error {
+	return q.db.Close()
+}
+
+// SetUserLimit sets the limit of the files owned by uid. A zero limit removes the quota.
+func (q *Quotas) SetUserLimit(uid uint32, limit Limit) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.storeLimit(kindUser, strconv.FormatUint(uint64(uid), 10), limit); err != nil {
+		return err
+	}
+
+	delete(q.users, uid)
+	if limit != (Limit{}) {
+		q.users[uid] = q.compute(&Quota{Uid: uid, Limit: limit})
+	}
+
+	return nil
+}
+
+// SetDirLimit sets the limit of everything below dir. A zero limit removes the quota.
+func (q *Quotas) SetDirLimit(dir string, limit Limit) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dir = clean(dir)
+
+	if err := q.storeLimit(kindDir, dir, limit); err != nil {
+		return err
+	}
+
+	delete(q.dirs, dir)
+	if limit != (Limit{}) {
+		q.dirs[dir] = q.compute(&Quota{Dir: dir, Limit: limit})
+	}
+
+	return nil
+}
+
+// User returns the quota of uid, if there is one.
+func (q *Quotas) User(uid uint32) (Quota, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	quota, ok := q.users[uid]
+	if !ok {
+		return Quota{}, false
+	}
+
+	return *quota, true
+}
+
+// List returns all quotas, the ones of users first.
+func (q *Quotas) List() []Quota {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var quotas []Quota
+	for _, quota := range q.users {
+		quotas = append(quotas, *quota)
+	}
+	for _, quota := range q.dirs {
+		quotas = append(quotas, *quota)
+	}
+
+	sort.Slice(quotas, func(i, j int) bool {
+		if quotas[i].Dir != quotas[j].Dir {
+			return quotas[i].Dir < quotas[j].Dir
+		}
+
+		return quotas[i].Uid < quotas[j].Uid
+	})
+
+	return quotas
+}
+
+// Owner returns the owner of a file, if it is known.
+func (q *Quotas) Owner(p string) (uint32, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	file, ok := q.files[clean(p)]
+
+	return file.Uid, ok
+}
+
+// Size returns the size a file is accounted with, if it is known.
+func (q *Quotas) Size(p string) (int64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	file, ok := q.files[clean(p)]
+
+	return file.Size, ok
+}
+
+// Create accounts for a new, empty inode owned by uid. It returns ErrExceeded
+// if the inode would exceed a quota.
+func (q *Quotas) Create(p string, uid uint32) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	file := File{Path: clean(p), Uid: uid}
+	if _, ok := q.files[file.Path]; ok {
+		return nil
+	}
+
+	if err := q.check(file, Usage{Inodes: 1}); err != nil {
+		return err
+	}
+
+	if _, err := q.db.Exec(`INSERT OR REPLACE INTO files (path, uid, size) VALUES (?, ?, ?)`, file.Path, file.Uid, 0); err != nil {
+		return err
+	}
+
+	q.files[file.Path] = file
+	q.charge(file, Usage{Inodes: 1})
+
+	return nil
+}
+
+// Resize accounts for the new size of a file. It returns ErrExceeded if the
+// file grows beyond a quota; shrinking always succeeds.
+func (q *Quotas) Resize(p string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	file, ok := q.files[clean(p)]
+	if !ok {
+		return nil
+	}
+
+	return q.resize(file, size)
+}
+
+// Extend accounts for a write ending at size, which grows a file if it ends
+// beyond its size. It returns ErrExceeded if the file grows beyond a quota.
+func (q *Quotas) Extend(p string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	file, ok := q.files[clean(p)]
+	if !ok || size <= file.Size {
+		return nil
+	}
+
+	return q.resize(file, size)
+}
+
+// Fits reports whether a file may grow to size without exceeding a quota.
+func (q *Quotas) Fits(p string, size int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	file, ok := q.files[clean(p)]
+	if !ok || size <= file.Size {
+		return true
+	}
+
+	return q.check(file, Usage{Bytes: size - file.Size}) == nil
+}
+
+// Remove releases an inode and everything below it.
+func (q *Quotas) Remove(p string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p = clean(p)
+
+	if _, err := q.db.Exec(`DELETE FROM files WHERE path = ? OR substr(path, 1, ?) = ?`, p, len(p)+1, p+"/"); err != nil {
+		return err
+	}
+
+	for _, file := range q.below(p) {
+		delete(q.files, file.Path)
+		q.charge(file, Usage{Bytes: -file.Size, Inodes: -1})
+	}
+
+	return nil
+}
+
+// Rename moves the accounting of an inode and everything below it to a new
+// path, replacing the accounting of what was at the new path. Quotas aren't
+// enforced, so a directory may exceed its quota by moving files into it.
+func (q *Quotas) Rename(oldPath string, newPath string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	oldPath, newPath = clean(oldPath), clean(newPath)
+	if oldPath == newPath {
+		return nil
+	}
+
+	tx, err := q.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM files WHERE path = ? OR substr(path, 1, ?) = ?`, newPath, len(newPath)+1, newPath+"/"); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE files SET path = ? || substr(path, ?) WHERE path = ? OR substr(path, 1, ?) = ?`,
+		newPath, len(oldPath)+1, oldPath, len(oldPath)+1, oldPath+"/",
+	); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, file := range q.below(newPath) {
+		delete(q.files, file.Path)
+		q.charge(file, Usage{Bytes: -file.Size, Inodes: -1})
+	}
+
+	for _, file := range q.below(oldPath) {
+		delete(q.files, file.Path)
+		q.charge(file, Usage{Bytes: -file.Size, Inodes: -1})
+
+		file.Path = newPath + strings.TrimPrefix(file.Path, oldPath)
+		q.files[file.Path] = file
+		q.charge(file, Usage{Bytes: file.Size, Inodes: 1})
+	}
+
+	return nil
+}
+
+// Rebuild replaces the accounting with the given files, e.g. after the
+// storage was changed while it wasn't mounted.
+func (q *Quotas) Rebuild(files []File) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tx, err := q.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM files`); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO files (path, uid, size) VALUES (?, ?, ?)`, clean(file.Path), file.Uid, file.Size); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return q.load()
+}
+
+func (q *Quotas) load() error {
+	q.files = map[string]File{}
+	q.users = map[uint32]*Quota{}
+	q.dirs = map[string]*Quota{}
+
+	rows, err := q.db.Query(`SELECT path, uid, size FROM files`)
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var file File
+		if err := rows.Scan(&file.Path, &file.Uid, &file.Size); err != nil {
+			rows.Close()
+
+			return err
+		}
+
+		q.files[file.Path] = file
+	}
+
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	rows, err = q.db.Query(`SELECT kind, id, bytes, inodes FROM limits`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, id string
+		var limit Limit
+		if err := rows.Scan(&kind, &id, &limit.Bytes, &limit.Inodes); err != nil {
+			return err
+		}
+
+		switch kind {
+		case kindUser:
+			uid, err := strconv.ParseUint(id, 10, 32)
+			if err != nil {
+				return err
+			}
+
+			q.users[uint32(uid)] = q.compute(&Quota{Uid: uint32(uid), Limit: limit})
+		case kindDir:
+			q.dirs[id] = q.compute(&Quota{Dir: id, Limit: limit})
+		}
+	}
+
+	return rows.Err()
+}
+
+func (q *Quotas) storeLimit(kind string, id string, limit Limit) error {
+	if limit == (Limit{}) {
+		_, err := q.db.Exec(`DELETE FROM limits WHERE kind = ? AND id = ?`, kind, id)
+
+		return err
+	}
+
+	_, err := q.db.Exec(`INSERT OR REPLACE INTO limits (kind, id, bytes, inodes) VALUES (?, ?, ?, ?)`, kind, id, limit.Bytes, limit.Inodes)
+
+	return err
+}
+
+func (q *Quotas) resize(file File, size int64) error {
+	if file.Size == size {
+		return nil
+	}
+
+	delta := Usage{Bytes: size - file.Size}
+	if delta.Bytes > 0 {
+		if err := q.check(file, delta); err != nil {
+			return err
+		}
+	}
+
+	if _, err := q.db.Exec(`UPDATE files SET size = ? WHERE path = ?`, size, file.Path); err != nil {
+		return err
+	}
+
+	file.Size = size
+	q.files[file.Path] = file
+	q.charge(file, delta)
+
+	return nil
+}
+
+// compute sets the usage of a quota from the files.
+func (q *Quotas) compute(quota *Quota) *Quota {
+	quota.Usage = Usage{}
+	for _, file := range q.files {
+		if quota.applies(file) {
+			quota.Usage.Bytes += file.Size
+			quota.Usage.Inodes++
+		}
+	}
+
+	return quota
+}
+
+// check returns ErrExceeded if adding delta to the quotas of file exceeds one of them.
+func (q *Quotas) check(file File, delta Usage) error {
+	for _, quota := range q.applicable(file) {
+		if exceeds(quota.Usage.Bytes+delta.Bytes, quota.Limit.Bytes) || exceeds(quota.Usage.Inodes+delta.Inodes, quota.Limit.Inodes) {
+			return ErrExceeded
+		}
+	}
+
+	return nil
+}
+
+func (q *Quotas) charge(file File, delta Usage) {
+	for _, quota := range q.applicable(file) {
+		quota.Usage.Bytes += delta.Bytes
+		quota.Usage.Inodes += delta.Inodes
+	}
+}
+
+func (q *Quotas) applicable(file File) []*Quota {
+	var quotas []*Quota
+	if quota, ok := q.users[file.Uid]; ok {
+		quotas = append(quotas, quota)
+	}
+
+	for _, quota := range q.dirs {
+		if quota.applies(file) {
+			quotas = append(quotas, quota)
+		}
+	}
+
+	return quotas
+}
+
+// below returns the file at p and everything below it.
+func (q *Quotas) below(p string) []File {
+	var files []File
+	for _, file := range q.files {
+		if file.Path == p || strings.HasPrefix(file.Path, p+"/") {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+func (quota *Quota) applies(file File) bool {
+	if quota.Dir == "" {
+		return file.Uid == quota.Uid
+	}
+
+	return strings.HasPrefix(file.Path, strings.TrimSuffix(quota.Dir, "/")+"/")
+}
+
+func exceeds(value int64, limit int64) bool {
+	return limit > 0 && value > limit
+}
+
+func clean(p string) string {
+	return path.Clean("/" + p)
+}
@@ -0,0 +1,296 @@
+// Package rules decides which paths of a filesystem a user may access.
+//
+// Rules are read from a file with one rule per line:
+//
+//	# <action> <pattern> [uid=<uid>] [gid=<gid>]
+//	allow    /home/alice/**  uid=1000
+//	deny     /home/**
+//	readonly /docs/**        gid=100
+//
+// The action is one of allow, deny or readonly. Patterns are matched against
+// absolute paths in the filesystem; * matches within a path component as in
+// path.Match, and ** matches any number of components, including none. A rule
+// scoped by uid or gid only applies to callers with that uid or in that group,
+// either as their filesystem group or as a supplementary group. The first
+// rule matching a path decides; paths matching no rule are allowed.
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Action is what a rule lets callers do with the paths it matches.
+type Action int
+
+const (
+	// Allow permits every operation.
+	Allow Action = iota
+	// ReadOnly permits lookups and reads, but no changes.
+	ReadOnly
+	// Traverse permits looking up and listing a denied directory, as an
+	// earlier rule allows some path beneath it.
+	Traverse
+	// Deny hides the path and rejects every operation on it.
+	Deny
+)
+
+func (a Action) String() string {
+	switch a {
+	case Allow:
+		return "allow"
+	case ReadOnly:
+		return "readonly"
+	case Traverse:
+		return "traverse"
+	case Deny:
+		return "deny"
+	default:
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+}
+
+// Rule maps the paths matching a pattern to an action.
+type Rule struct {
+	Action  Action
+	Pattern string
+	// Uid and Gid scope the rule to callers with that uid or in that group if set.
+	Uid *uint32
+	Gid *uint32
+}
+
+// Rules is an ordered list of rules.
+type Rules struct {
+	rules []Rule
+}
+
+// New returns rules evaluated in the given order.
+func New(rules ...Rule) (*Rules, error) {
+	for _, rule := range rules {
+		if err := validate(rule.Pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Rules{rules}, nil
+}
+
+// Load reads the rules from a file.
+func Load(name string) (*Rules, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Parse(file)
+}
+
+// Parse reads rules from r, skipping empty lines and comments starting with #.
+func Parse(r io.Reader) (*Rules, error) {
+	var rules []Rule
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		rule, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return New(rules...)
+}
+
+// Evaluate returns the action of the first rule matching p for a caller with
+// uid in the groups gids. Directories which are denied, but contain paths
+// allowed by an earlier rule, evaluate to Traverse.
+func (r *Rules) Evaluate(p string, uid uint32, gids []uint32) Action {
+	components := split(p)
+
+	traverse := false
+	for _, rule := range r.rules {
+		if !rule.appliesTo(uid, gids) {
+			continue
+		}
+
+		pattern := split(rule.Pattern)
+		if match(pattern, components) {
+			if rule.Action == Deny && traverse {
+				return Traverse
+			}
+
+			return rule.Action
+		}
+
+		if rule.Action != Deny && matchBelow(pattern, components) {
+			traverse = true
+		}
+	}
+
+	return Allow
+}
+
+// Match reports whether pattern matches the absolute path p, with the syntax
+// of the patterns of rules.
+func Match(pattern string, p string) (bool, error) {
+	if err := validate(pattern); err != nil {
+		return false, err
+	}
+
+	return match(split(pattern), split(p)), nil
+}
+
+func (r Rule) appliesTo(uid uint32, gids []uint32) bool {
+	if r.Uid != nil && *r.Uid != uid {
+		return false
+	}
+
+	if r.Gid == nil {
+		return true
+	}
+
+	for _, gid := range gids {
+		if gid == *r.Gid {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseRule(fields []string) (Rule, error) {
+	if len(fields) < 2 {
+		return Rule{}, fmt.Errorf("expected action and pattern, got %q", strings.Join(fields, " "))
+	}
+
+	var rule Rule
+
+	switch fields[0] {
+	case "allow":
+		rule.Action = Allow
+	case "readonly":
+		rule.Action = ReadOnly
+	case "deny":
+		rule.Action = Deny
+	default:
+		return Rule{}, fmt.Errorf("unknown action %q", fields[0])
+	}
+
+	rule.Pattern = fields[1]
+
+	for _, field := range fields[2:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return Rule{}, fmt.Errorf("expected uid=<uid> or gid=<gid>, got %q", field)
+		}
+
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid %v: %w", key, err)
+		}
+		v := uint32(id)
+
+		switch key {
+		case "uid":
+			rule.Uid = &v
+		case "gid":
+			rule.Gid = &v
+		default:
+			return Rule{}, fmt.Errorf("unknown scope %q", key)
+		}
+	}
+
+	return rule, nil
+}
+
+func validate(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("pattern %q is not absolute", pattern)
+	}
+
+	for _, component := range split(pattern) {
+		if _, err := path.Match(component, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+func split(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+
+	return strings.Split(p, "/")
+}
+
+// match reports whether the pattern matches all of the components.
+func match(pattern []string, components []string) bool {
+	if len(pattern) == 0 {
+		return len(components) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(components); i++ {
+			if match(pattern[1:], components[i:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(components) == 0 {
+		return false
+	}
+
+	if ok, _ := path.Match(pattern[0], components[0]); !ok {
+		return false
+	}
+
+	return match(pattern[1:], components[1:])
+}
+
+// matchBelow reports whether the pattern may match some path beneath the components.
+func matchBelow(pattern []string, components []string) bool {
+	if len(pattern) == 0 {
+		return false
+	}
+
+	if pattern[0] == "**" {
+		return true
+	}
+
+	if len(components) == 0 {
+		return true
+	}
+
+	if ok, _ := path.Match(pattern[0], components[0]); !ok {
+		return false
+	}
+
+	return matchBelow(pattern[1:], components[1:])
+}
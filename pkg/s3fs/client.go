@@ -0,0 +1,496 @@
+package s3fs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	metaMode        = "X-Amz-Meta-Mode"
+	metaMtime       = "X-Amz-Meta-Mtime"
+)
+
+// Config describes how to reach a bucket on an S3-compatible object store.
+type Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+
+	// PartSize is the size of the parts used for multipart uploads. Objects
+	// smaller than PartSize are uploaded with a single PUT.
+	PartSize int64
+
+	Client *http.Client
+}
+
+type client struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+	access   string
+	secret   string
+	http     *http.Client
+}
+
+type objectInfo struct {
+	key   string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+	etag  string
+	// stream is set for objects served without a Content-Length, whose size isn't known.
+	stream bool
+}
+
+type listResult struct {
+	objects  []objectInfo
+	prefixes []string
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		Size         int64  `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type errorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func newClient(cfg Config) (*client, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", cfg.Endpoint)
+	}
+
+	if cfg.Bucket == "" {
+		return nil, errors.New("missing bucket")
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	httpClient := cfg.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &client{
+		endpoint: endpoint,
+		region:   region,
+		bucket:   cfg.Bucket,
+		access:   cfg.AccessKey,
+		secret:   cfg.SecretKey,
+		http:     httpClient,
+	}, nil
+}
+
+func (c *client) headObject(key string) (objectInfo, error) {
+	res, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	defer res.Body.Close()
+
+	return objectInfoFromHeader(key, res.Header, res.ContentLength), nil
+}
+
+func (c *client) getObject(key string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+
+	res, err := c.do(http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (c *client) putObject(key string, body io.Reader, size int64, mode os.FileMode, mtime time.Time) error {
+	header := metadataHeader(mode, mtime)
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+
+	res, err := c.do(http.MethodPut, key, nil, header, body)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (c *client) copyObject(src, dst string, mode os.FileMode, mtime time.Time) error {
+	header := metadataHeader(mode, mtime)
+	header.Set("X-Amz-Copy-Source", "/"+c.bucket+"/"+escapePath(src))
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+
+	res, err := c.do(http.MethodPut, dst, nil, header, nil)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (c *client) deleteObject(key string) error {
+	res, err := c.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (c *client) list(prefix string, delimiter string, max int) (listResult, error) {
+	var result listResult
+
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if max > 0 {
+			query.Set("max-keys", strconv.Itoa(max))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		res, err := c.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return result, err
+		}
+
+		var page listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return result, err
+		}
+
+		for _, content := range page.Contents {
+			mtime, _ := time.Parse(time.RFC3339, content.LastModified)
+
+			result.objects = append(result.objects, objectInfo{
+				key:   content.Key,
+				size:  content.Size,
+				mtime: mtime,
+				etag:  content.ETag,
+			})
+		}
+
+		for _, p := range page.CommonPrefixes {
+			result.prefixes = append(result.prefixes, p.Prefix)
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" || (max > 0 && len(result.objects)+len(result.prefixes) >= max) {
+			return result, nil
+		}
+
+		token = page.NextContinuationToken
+	}
+}
+
+func (c *client) createMultipartUpload(key string, mode os.FileMode, mtime time.Time) (string, error) {
+	res, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, metadataHeader(mode, mtime), nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var result initiateMultipartUploadResult
+	if err := xml.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", err
+	}
+
+	return result.UploadID, nil
+}
+
+func (c *client) uploadPart(key string, uploadID string, number int, body io.Reader, size int64) (string, error) {
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(number))
+	query.Set("uploadId", uploadID)
+
+	header := http.Header{}
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+
+	res, err := c.do(http.MethodPut, key, query, header, body)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	return res.Header.Get("ETag"), nil
+}
+
+func (c *client) completeMultipartUpload(key string, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	res, err := c.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, header, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// S3 may report a failed completion with a 200 status and an error document.
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var errRes errorResponse
+	if xml.Unmarshal(data, &errRes) == nil && errRes.Code != "" {
+		return fmt.Errorf("complete multipart upload: %v: %v", errRes.Code, errRes.Message)
+	}
+
+	return nil
+}
+
+func (c *client) abortMultipartUpload(key string, uploadID string) error {
+	res, err := c.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (c *client) do(method string, key string, query url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + "/" + escapePath(c.bucket)
+	if key != "" {
+		u.RawPath += "/" + escapePath(key)
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if l := header.Get("Content-Length"); l != "" {
+		req.ContentLength, _ = strconv.ParseInt(l, 10, 64)
+	}
+
+	c.sign(req, time.Now().UTC())
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+
+		if res.StatusCode == http.StatusNotFound {
+			return nil, os.ErrNotExist
+		}
+
+		// Ranges beyond the end of an object are only requested for streams, whose size isn't known.
+		if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return nil, io.EOF
+		}
+
+		var errRes errorResponse
+		_ = xml.NewDecoder(res.Body).Decode(&errRes)
+
+		return nil, fmt.Errorf("%v %v: %v %v: %v", method, key, res.Status, errRes.Code, errRes.Message)
+	}
+
+	return res, nil
+}
+
+// sign adds an AWS Signature Version 4 authorization header to req.
+func (c *client) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	req.Header.Set("Host", req.URL.Host)
+
+	if c.access == "" {
+		return
+	}
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "host" || lower == "content-type" || lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashedRequest[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secret), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.access+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func metadataHeader(mode os.FileMode, mtime time.Time) http.Header {
+	header := http.Header{}
+	header.Set(metaMode, strconv.FormatUint(uint64(mode), 8))
+	header.Set(metaMtime, strconv.FormatInt(mtime.UnixNano(), 10))
+	return header
+}
+
+func objectInfoFromHeader(key string, header http.Header, size int64) objectInfo {
+	info := objectInfo{
+		key:  key,
+		size: size,
+		mode: 0644,
+		etag: header.Get("ETag"),
+	}
+
+	// Gateways streaming objects from elsewhere don't know their length up front.
+	if size < 0 {
+		info.size = 0
+		info.stream = true
+	}
+
+	if mode, err := strconv.ParseUint(header.Get(metaMode), 8, 32); err == nil {
+		info.mode = os.FileMode(mode)
+	}
+
+	if mtime, err := strconv.ParseInt(header.Get(metaMtime), 10, 64); err == nil {
+		info.mtime = time.Unix(0, mtime)
+	} else if mtime, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		info.mtime = mtime
+	}
+
+	return info
+}
+
+// escapePath URI-encodes every segment of an object key as required by SigV4.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = escape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, escape(k)+"="+escape(v))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
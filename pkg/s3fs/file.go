@@ -0,0 +1,432 @@
+package s3fs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// File is a handle to an object or a directory in the bucket.
+// Reads are served by ranged GET requests. The first write spools the
+// object into a local temporary file, which is uploaded on Sync and Close.
+type File struct {
+	fs   *Fs
+	name string
+	key  string
+	flag int
+	info *fileInfo
+
+	mu     sync.Mutex
+	offset int64
+	spool  *os.File
+	dirty  bool
+	closed bool
+
+	entries []os.FileInfo
+	listed  bool
+}
+
+func newFile(fs *Fs, name string, key string, flag int, info *fileInfo) *File {
+	return &File{
+		fs:   fs,
+		name: name,
+		key:  key,
+		flag: flag,
+		info: info,
+	}
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+
+	err := f.flush()
+
+	if f.spool != nil {
+		f.spool.Close()
+		os.Remove(f.spool.Name())
+		f.spool = nil
+	}
+
+	return err
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+
+	return n, err
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.readAt(p, off)
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return 0, syscall.EINVAL
+	}
+
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = f.info.size
+	}
+
+	n, err := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+
+	return n, err
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.writeAt(p, off)
+}
+
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+
+	if !f.info.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+
+	if !f.listed {
+		entries, err := f.fs.readDir(f.key)
+		if err != nil {
+			return nil, &os.PathError{Op: "readdir", Path: f.name, Err: err}
+		}
+
+		f.entries = entries
+		f.listed = true
+	}
+
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+
+		return entries, nil
+	}
+
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+
+	return entries, nil
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	infos, err := f.Readdir(n)
+
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+
+	return names, err
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info := *f.info
+
+	return &info, nil
+}
+
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	return f.flush()
+}
+
+func (f *File) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := f.loadSpool(); err != nil {
+		return err
+	}
+
+	if err := f.spool.Truncate(size); err != nil {
+		return err
+	}
+
+	f.info.size = size
+	f.info.mtime = time.Now()
+	f.dirty = true
+
+	return nil
+}
+
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	if f.info.IsDir() {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+	}
+
+	if f.info.stream && f.spool == nil {
+		return f.readStream(p, off)
+	}
+
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+
+	if f.spool != nil {
+		return f.spool.ReadAt(p, off)
+	}
+
+	length := int64(len(p))
+	if off+length > f.info.size {
+		length = f.info.size - off
+	}
+
+	if length == 0 {
+		return 0, nil
+	}
+
+	body, err := f.fs.client.getObject(f.key, off, length)
+	if err != nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p[:length])
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// readStream reads from an object of unknown size, which ends where the store runs out of content.
+func (f *File) readStream(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	body, err := f.fs.client.getObject(f.key, off, int64(len(p)))
+	if err == io.EOF {
+		return 0, io.EOF
+	} else if err != nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (f *File) writeAt(p []byte, off int64) (int, error) {
+	if err := f.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	if err := f.loadSpool(); err != nil {
+		return 0, err
+	}
+
+	n, err := f.spool.WriteAt(p, off)
+	if end := off + int64(n); end > f.info.size {
+		f.info.size = end
+	}
+
+	f.info.mtime = time.Now()
+	f.dirty = true
+
+	return n, err
+}
+
+func (f *File) checkWritable() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	if f.info.IsDir() {
+		return &os.PathError{Op: "write", Path: f.name, Err: syscall.EISDIR}
+	}
+
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+
+	return nil
+}
+
+// loadSpool downloads the current content of the object into a temporary file.
+func (f *File) loadSpool() error {
+	if f.spool != nil {
+		return nil
+	}
+
+	spool, err := ioutil.TempFile("", "s3fs")
+	if err != nil {
+		return err
+	}
+
+	if f.info.size > 0 || f.info.stream {
+		body, err := f.fs.client.getObject(f.key, 0, 0)
+		if err != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+
+			return &os.PathError{Op: "open", Path: f.name, Err: err}
+		}
+		defer body.Close()
+
+		n, err := io.Copy(spool, body)
+		if err != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+
+			return &os.PathError{Op: "open", Path: f.name, Err: err}
+		}
+
+		// The size of a stream is known once it was read.
+		f.info.size = n
+	}
+
+	f.spool = spool
+
+	return nil
+}
+
+func (f *File) flush() error {
+	if !f.dirty {
+		return nil
+	}
+
+	if err := f.upload(); err != nil {
+		return &os.PathError{Op: "sync", Path: f.name, Err: err}
+	}
+	f.dirty = false
+
+	return nil
+}
+
+func (f *File) upload() error {
+	size := f.info.size
+	client := f.fs.client
+
+	if size < f.fs.partSize {
+		return client.putObject(f.key, io.NewSectionReader(f.spool, 0, size), size, f.info.mode, f.info.mtime)
+	}
+
+	uploadID, err := client.createMultipartUpload(f.key, f.info.mode, f.info.mtime)
+	if err != nil {
+		return err
+	}
+
+	parts := []completedPart{}
+	for offset := int64(0); offset < size; offset += f.fs.partSize {
+		length := f.fs.partSize
+		if offset+length > size {
+			length = size - offset
+		}
+
+		etag, err := client.uploadPart(f.key, uploadID, len(parts)+1, io.NewSectionReader(f.spool, offset, length), length)
+		if err != nil {
+			_ = client.abortMultipartUpload(f.key, uploadID)
+
+			return err
+		}
+
+		parts = append(parts, completedPart{
+			PartNumber: len(parts) + 1,
+			ETag:       etag,
+		})
+	}
+
+	if err := client.completeMultipartUpload(f.key, uploadID, parts); err != nil {
+		_ = client.abortMultipartUpload(f.key, uploadID)
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package s3fs
+
+import (
+	"os"
+	"time"
+)
+
+type fileInfo struct {
+	name   string
+	size   int64
+	mode   os.FileMode
+	mtime  time.Time
+	etag   string
+	stream bool
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.mtime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// ETag identifies the content of the object, if the store reported it.
+func (fi *fileInfo) ETag() string {
+	return fi.etag
+}
@@ -0,0 +1,467 @@
+package s3fs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	defaultPartSize = 16 * 1024 * 1024
+)
+
+// Fs is an afero.Fs storing files as objects of an S3-compatible bucket.
+// Directories are key prefixes; empty directories are kept alive by a
+// zero-byte marker object whose key ends with a slash.
+type Fs struct {
+	client   *client
+	partSize int64
+}
+
+func NewFs(cfg Config) (*Fs, error) {
+	c, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	partSize := cfg.PartSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+
+	return &Fs{
+		client:   c,
+		partSize: partSize,
+	}, nil
+}
+
+func (fs *Fs) Name() string {
+	return "s3fs"
+}
+
+func (fs *Fs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *Fs) Mkdir(name string, perm os.FileMode) error {
+	key := toKey(name)
+	if key == "" {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+
+	if _, err := fs.stat(key); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	parent, err := fs.stat(parentKey(key))
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	if !parent.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	if err := fs.client.putObject(key+"/", strings.NewReader(""), 0, perm.Perm()|os.ModeDir, time.Now()); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (fs *Fs) MkdirAll(p string, perm os.FileMode) error {
+	key := toKey(p)
+	if key == "" {
+		return nil
+	}
+
+	info, err := fs.stat(key)
+	if err == nil {
+		if info.IsDir() {
+			return nil
+		}
+
+		return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+	}
+
+	if err := fs.MkdirAll(parentKey(key), perm); err != nil {
+		return err
+	}
+
+	return fs.Mkdir(key, perm)
+}
+
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	key := toKey(name)
+
+	info, err := fs.stat(key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if err == nil {
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+
+		if info.IsDir() {
+			if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+				return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+			}
+
+			return newFile(fs, name, key, flag, info), nil
+		}
+
+		if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			info.size = 0
+			info.stream = false
+			info.mtime = time.Now()
+
+			if err := fs.client.putObject(key, strings.NewReader(""), 0, info.mode, info.mtime); err != nil {
+				return nil, &os.PathError{Op: "open", Path: name, Err: err}
+			}
+		}
+
+		return newFile(fs, name, key, flag, info), nil
+	}
+
+	if flag&os.O_CREATE == 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	parent, err := fs.stat(parentKey(key))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if !parent.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	info = &fileInfo{
+		name:  path.Base(key),
+		mode:  perm.Perm(),
+		mtime: time.Now(),
+	}
+
+	// The object is created right away so that it is visible to a
+	// subsequent Stat even if the handle is never closed.
+	if err := fs.client.putObject(key, strings.NewReader(""), 0, info.mode, info.mtime); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return newFile(fs, name, key, flag, info), nil
+}
+
+func (fs *Fs) Remove(name string) error {
+	key := toKey(name)
+
+	info, err := fs.stat(key)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	if !info.IsDir() {
+		if err := fs.client.deleteObject(key); err != nil {
+			return &os.PathError{Op: "remove", Path: name, Err: err}
+		}
+
+		return nil
+	}
+
+	if key == "" {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+
+	children, err := fs.client.list(key+"/", "", 2)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	for _, child := range children.objects {
+		if child.key != key+"/" {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	if err := fs.client.deleteObject(key + "/"); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (fs *Fs) RemoveAll(p string) error {
+	key := toKey(p)
+
+	info, err := fs.stat(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return &os.PathError{Op: "removeall", Path: p, Err: err}
+	}
+
+	if !info.IsDir() {
+		return fs.Remove(p)
+	}
+
+	prefix := key + "/"
+	if key == "" {
+		prefix = ""
+	}
+
+	children, err := fs.client.list(prefix, "", 0)
+	if err != nil {
+		return &os.PathError{Op: "removeall", Path: p, Err: err}
+	}
+
+	for _, child := range children.objects {
+		if err := fs.client.deleteObject(child.key); err != nil {
+			return &os.PathError{Op: "removeall", Path: p, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Rename emulates a rename by copying every affected object to its new key
+// and deleting the original afterwards. It is therefore not atomic.
+func (fs *Fs) Rename(oldname, newname string) error {
+	oldKey := toKey(oldname)
+	newKey := toKey(newname)
+
+	if oldKey == newKey {
+		return nil
+	}
+
+	info, err := fs.stat(oldKey)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	if !info.IsDir() {
+		if err := fs.client.copyObject(oldKey, newKey, info.mode, info.mtime); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+
+		if err := fs.client.deleteObject(oldKey); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+
+		return nil
+	}
+
+	if oldKey == "" || strings.HasPrefix(newKey+"/", oldKey+"/") {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+	}
+
+	children, err := fs.client.list(oldKey+"/", "", 0)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	if err := fs.client.putObject(newKey+"/", strings.NewReader(""), 0, info.mode, info.mtime); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	for _, child := range children.objects {
+		if child.key == oldKey+"/" {
+			continue
+		}
+
+		childInfo, err := fs.client.headObject(child.key)
+		if err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+
+		target := newKey + "/" + strings.TrimPrefix(child.key, oldKey+"/")
+		if err := fs.client.copyObject(child.key, target, childInfo.mode, childInfo.mtime); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+	}
+
+	for _, child := range children.objects {
+		if err := fs.client.deleteObject(child.key); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+	}
+
+	return nil
+}
+
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.stat(toKey(name))
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return info, nil
+}
+
+// IsStream reports whether name is an object served without a length. Its
+// size is reported as zero, and it is read until the store runs out of content.
+func (fs *Fs) IsStream(name string) bool {
+	info, err := fs.stat(toKey(name))
+
+	return err == nil && info.stream
+}
+
+func (fs *Fs) Chmod(name string, mode os.FileMode) error {
+	key := toKey(name)
+
+	info, err := fs.stat(key)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+
+	if err := fs.replaceMetadata(key, info, mode.Perm()|(info.mode&os.ModeType), info.mtime); err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// Chown is a no-op, as objects in a bucket have no owner.
+func (fs *Fs) Chown(name string, uid, gid int) error {
+	if _, err := fs.stat(toKey(name)); err != nil {
+		return &os.PathError{Op: "chown", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (fs *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	key := toKey(name)
+
+	info, err := fs.stat(key)
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+
+	if err := fs.replaceMetadata(key, info, info.mode, mtime); err != nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (fs *Fs) replaceMetadata(key string, info *fileInfo, mode os.FileMode, mtime time.Time) error {
+	if key == "" {
+		return nil
+	}
+
+	if info.IsDir() {
+		return fs.client.putObject(key+"/", strings.NewReader(""), 0, mode, mtime)
+	}
+
+	return fs.client.copyObject(key, key, mode, mtime)
+}
+
+func (fs *Fs) stat(key string) (*fileInfo, error) {
+	if key == "" {
+		return &fileInfo{
+			name: "/",
+			mode: 0755 | os.ModeDir,
+		}, nil
+	}
+
+	object, err := fs.client.headObject(key)
+	if err == nil {
+		return &fileInfo{
+			name:   path.Base(key),
+			size:   object.size,
+			mode:   object.mode.Perm(),
+			mtime:  object.mtime,
+			etag:   object.etag,
+			stream: object.stream,
+		}, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	marker, err := fs.client.headObject(key + "/")
+	if err == nil {
+		return &fileInfo{
+			name:  path.Base(key),
+			mode:  marker.mode.Perm() | os.ModeDir,
+			mtime: marker.mtime,
+		}, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// Directories created by other tools often have no marker object.
+	children, err := fs.client.list(key+"/", "/", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(children.objects)+len(children.prefixes) > 0 {
+		return &fileInfo{
+			name: path.Base(key),
+			mode: 0755 | os.ModeDir,
+		}, nil
+	}
+
+	return nil, os.ErrNotExist
+}
+
+func (fs *Fs) readDir(key string) ([]os.FileInfo, error) {
+	prefix := key + "/"
+	if key == "" {
+		prefix = ""
+	}
+
+	children, err := fs.client.list(prefix, "/", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []os.FileInfo{}
+	for _, p := range children.prefixes {
+		infos = append(infos, &fileInfo{
+			name: path.Base(strings.TrimSuffix(p, "/")),
+			mode: 0755 | os.ModeDir,
+		})
+	}
+
+	for _, object := range children.objects {
+		if object.key == prefix {
+			continue
+		}
+
+		infos = append(infos, &fileInfo{
+			name:  path.Base(object.key),
+			size:  object.size,
+			mode:  0644,
+			mtime: object.mtime,
+			etag:  object.etag,
+		})
+	}
+
+	return infos, nil
+}
+
+func toKey(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func parentKey(key string) string {
+	dir := path.Dir(key)
+	if dir == "." {
+		return ""
+	}
+
+	return dir
+}
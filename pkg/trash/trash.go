@@ -0,0 +1,175 @@
+// Package trash keeps deleted files and directories of a backend in a
+// reserved directory, from which they can be restored until they expire.
+package trash
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// Dir is the directory in the root of the backend holding the trash.
+	Dir = ".sile-fystem-trash"
+
+	infoFile = "info.json"
+	dataFile = "data"
+)
+
+// Entry is a deleted file or directory.
+type Entry struct {
+	ID      string    `json:"-"`
+	Path    string    `json:"path"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// Trash is the trash of a backend.
+type Trash struct {
+	backend afero.Fs
+	root    string
+}
+
+// New returns the trash of the backend below root.
+func New(backend afero.Fs, root string) *Trash {
+	return &Trash{
+		backend: backend,
+		root:    root,
+	}
+}
+
+// Move moves a file or directory of the backend into the trash.
+func (t *Trash) Move(p string) error {
+	entry := Entry{
+		Path:    "/" + strings.TrimPrefix(strings.TrimPrefix(p, t.root), "/"),
+		Deleted: time.Now(),
+	}
+
+	dir := path.Join(t.root, Dir, fmt.Sprintf("%d-%08x", entry.Deleted.UnixNano(), rand.Uint32()))
+	if err := t.backend.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := afero.WriteFile(t.backend, path.Join(dir, infoFile), data, 0600); err != nil {
+		return err
+	}
+
+	if err := t.backend.Rename(p, path.Join(dir, dataFile)); err != nil {
+		t.backend.RemoveAll(dir)
+
+		return err
+	}
+
+	return nil
+}
+
+// List returns the entries of the trash, most recently deleted first.
+func (t *Trash) List() ([]Entry, error) {
+	ids, err := afero.ReadDir(t.backend, path.Join(t.root, Dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Entry{}, nil
+		}
+
+		return nil, err
+	}
+
+	entries := []Entry{}
+	for _, id := range ids {
+		data, err := afero.ReadFile(t.backend, path.Join(t.root, Dir, id.Name(), infoFile))
+		if err != nil {
+			// Deleting the entry was interrupted.
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		entry := Entry{ID: id.Name()}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.After(entries[j].Deleted)
+	})
+
+	return entries, nil
+}
+
+// Restore moves an entry back to its original path, which must not exist.
+func (t *Trash) Restore(id string) error {
+	entries, err := t.List()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.ID != id {
+			continue
+		}
+
+		target := path.Join(t.root, entry.Path)
+		if _, err := t.backend.Stat(target); err == nil {
+			return &os.PathError{Op: "restore", Path: entry.Path, Err: os.ErrExist}
+		}
+
+		if err := t.backend.MkdirAll(path.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		dir := path.Join(t.root, Dir, id)
+		if err := t.backend.Rename(path.Join(dir, dataFile), target); err != nil {
+			return err
+		}
+
+		return t.backend.RemoveAll(dir)
+	}
+
+	return &os.PathError{Op: "restore", Path: id, Err: os.ErrNotExist}
+}
+
+// Empty removes the entries deleted before the given time and returns how many were removed.
+func (t *Trash) Empty(before time.Time) (int, error) {
+	entries, err := t.List()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if !entry.Deleted.Before(before) {
+			continue
+		}
+
+		dir := path.Join(t.root, Dir, entry.ID)
+
+		// Drop the info first, so that an interrupted removal doesn't leave a listed entry behind.
+		if err := t.backend.Remove(path.Join(dir, infoFile)); err != nil {
+			return removed, err
+		}
+
+		if err := t.backend.RemoveAll(dir); err != nil {
+			return removed, err
+		}
+
+		removed++
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,122 @@
+package filesystem
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/audit"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/afero"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logDir, err := ioutil.TempDir("", "audit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+
+	name := path.Join(logDir, "audit.log")
+
+	log, err := audit.Open(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	mfs, err := filesystem.Mount(context.Background(), dir, afero.NewMemMapFs(),
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithoutWritebackCaching(),
+		filesystem.WithAuditLog(log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(path.Join(dir, "foo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "foo", "bar"), []byte("taco"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(path.Join(dir, "foo", "bar"), path.Join(dir, "foo", "baz")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(path.Join(dir, "foo")); err == nil {
+		t.Fatal("removed non-empty directory")
+	}
+
+	if err := os.Remove(path.Join(dir, "foo", "baz")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mfs.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := map[string][]audit.Record{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		var r audit.Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+
+		records[r.Op] = append(records[r.Op], r)
+	}
+
+	if r := records["mkdir"]; len(r) != 1 || r[0].Path != "/foo" || r[0].Result != "ok" || r[0].Pid == 0 || r[0].Uid != uint32(os.Getuid()) {
+		t.Fatalf("unexpected mkdir records %+v", r)
+	}
+
+	if r := records["create"]; len(r) != 1 || r[0].Path != "/foo/bar" {
+		t.Fatalf("unexpected create records %+v", r)
+	}
+
+	if r := records["write"]; len(r) != 1 || r[0].Path != "/foo/bar" || r[0].Bytes != 4 || r[0].Process == "" {
+		t.Fatalf("unexpected write records %+v", r)
+	}
+
+	if r := records["rename"]; len(r) != 1 || r[0].Path != "/foo/bar" || r[0].NewPath != "/foo/baz" {
+		t.Fatalf("unexpected rename records %+v", r)
+	}
+
+	if r := records["rmdir"]; len(r) != 1 || r[0].Result == "ok" {
+		t.Fatalf("unexpected rmdir records %+v", r)
+	}
+
+	if r := records["unlink"]; len(r) != 1 || r[0].Path != "/foo/baz" || r[0].Result != "ok" {
+		t.Fatalf("unexpected unlink records %+v", r)
+	}
+
+	if n, err := audit.Verify(bytes.NewReader(content)); err != nil || n < 6 {
+		t.Fatal(n, err)
+	}
+
+	tampered := bytes.Replace(content, []byte(`"/foo/baz"`), []byte(`"/foo/qux"`), 1)
+	if _, err := audit.Verify(bytes.NewReader(tampered)); !errors.Is(err, audit.ErrTampered) {
+		t.Fatal(err)
+	}
+}
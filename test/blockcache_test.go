@@ -0,0 +1,162 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/afero"
+)
+
+// countingFs counts the reads and writes of the files opened from it, and
+// the files opened for writing.
+type countingFs struct {
+	afero.Fs
+
+	reads  int64
+	writes int64
+	opens  int64
+}
+
+func (fs *countingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		atomic.AddInt64(&fs.opens, 1)
+	}
+
+	file, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &countingFile{file, fs}, nil
+}
+
+func (fs *countingFs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+type countingFile struct {
+	afero.File
+
+	fs *countingFs
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt64(&f.fs.reads, 1)
+
+	return f.File.ReadAt(p, off)
+}
+
+func (f *countingFile) WriteAt(p []byte, off int64) (int, error) {
+	atomic.AddInt64(&f.fs.writes, 1)
+
+	return f.File.WriteAt(p, off)
+}
+
+func TestBlockCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &countingFs{Fs: afero.NewMemMapFs()}
+
+	mfs, err := filesystem.Mount(context.Background(), dir, backend,
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithoutWritebackCaching(),
+		filesystem.WithBlockCache(filesystem.BlockCache{
+			BlockSize: 4096,
+			Memory:    1024 * 1024,
+			ReadAhead: 4,
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+	file, err := os.Create(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(content); i += 1000 {
+		end := i + 1000
+		if end > len(content) {
+			end = len(content)
+		}
+
+		if _, err := file.Write(content[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The writes are coalesced until the file is flushed.
+	if writes := atomic.LoadInt64(&backend.writes); writes != 0 {
+		t.Fatal(writes)
+	}
+
+	if info, err := file.Stat(); err != nil || info.Size() != int64(len(content)) {
+		t.Fatal(info, err)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if writes := atomic.LoadInt64(&backend.writes); writes != 1 {
+		t.Fatal(writes)
+	}
+
+	stored, err := afero.ReadFile(backend.Fs, "/foo")
+	if err != nil || !bytes.Equal(stored, content) {
+		t.Fatal(err)
+	}
+
+	// A write in the middle of a block reads the rest of it.
+	file, err = os.OpenFile(path.Join(dir, "foo"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := file.WriteAt([]byte("taco"), 5000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	copy(content[5000:], "taco")
+
+	atomic.StoreInt64(&backend.reads, 0)
+	atomic.StoreInt64(&backend.opens, 0)
+
+	data, err := ioutil.ReadFile(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, content) {
+		t.Fatal("content differs")
+	}
+
+	// Files are only opened for writing to write back blocks.
+	if opens := atomic.LoadInt64(&backend.opens); opens != 0 {
+		t.Fatal(opens)
+	}
+
+	// Sequential reads are served by reads of several blocks.
+	if reads := atomic.LoadInt64(&backend.reads); reads == 0 || reads > int64(len(content)/4096/5+1) {
+		t.Fatal(reads)
+	}
+}
@@ -0,0 +1,145 @@
+package filesystem
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	internal "github.com/JakWai01/sile-fystem/internal/test"
+	"github.com/JakWai01/sile-fystem/pkg/cachefs"
+	"github.com/JakWai01/sile-fystem/pkg/s3fs"
+	"github.com/spf13/afero"
+)
+
+func TestCacheFs(t *testing.T) {
+	var gets int64
+
+	fake := internal.NewFakeS3("bucket")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "" {
+			atomic.AddInt64(&gets, 1)
+		}
+
+		fake.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	backend, err := s3fs.NewFs(s3fs.Config{
+		Endpoint:  server.URL,
+		Bucket:    "bucket",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "cachefs_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func() *cachefs.Fs {
+		fs, err := cachefs.NewFs(backend, cachefs.Config{Dir: dir, Size: 14})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return fs
+	}
+
+	read := func(fs afero.Fs, name string, want string) {
+		t.Helper()
+
+		data, err := afero.ReadFile(fs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != want {
+			t.Fatalf("%v: got %q, want %q", name, data, want)
+		}
+	}
+
+	fs := open()
+
+	if err := fs.Mkdir("/docs", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range map[string]string{"/docs/a": "aaaaaa", "/b": "bbbbbb", "/c": "cccccc"} {
+		if err := afero.WriteFile(fs, name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reads are served from the cache after the first one.
+	read(fs, "/docs/a", "aaaaaa")
+	fetched := atomic.LoadInt64(&gets)
+
+	read(fs, "/docs/a", "aaaaaa")
+	if atomic.LoadInt64(&gets) != fetched {
+		t.Fatal("cached file was fetched again")
+	}
+
+	// Content changed in the backend is detected by its ETag, even if the size stays the same.
+	if err := afero.WriteFile(backend, "/docs/a", []byte("AAAAAA"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	read(fs, "/docs/a", "AAAAAA")
+
+	// Pinned files are kept when the cache exceeds its size.
+	if err := fs.Pin("/docs"); err != nil {
+		t.Fatal(err)
+	}
+
+	read(fs, "/b", "bbbbbb")
+	read(fs, "/c", "cccccc")
+
+	fetched = atomic.LoadInt64(&gets)
+
+	read(fs, "/docs/a", "AAAAAA")
+	if atomic.LoadInt64(&gets) != fetched {
+		t.Fatal("pinned file was evicted")
+	}
+
+	read(fs, "/c", "cccccc")
+	if atomic.LoadInt64(&gets) != fetched {
+		t.Fatal("recently used file was evicted")
+	}
+
+	read(fs, "/b", "bbbbbb")
+	if atomic.LoadInt64(&gets) != fetched+1 {
+		t.Fatal("least recently used file wasn't evicted")
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pinned files survive remounts and are available while the backend can't be reached.
+	server.Close()
+
+	fs = open()
+	defer fs.Close()
+
+	read(fs, "/docs/a", "AAAAAA")
+
+	infos, err := afero.ReadDir(fs, "/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 1 || infos[0].Name() != "a" || infos[0].Size() != 6 {
+		t.Fatal("pinned directory isn't listed offline")
+	}
+
+	if _, err := afero.ReadFile(fs, "/c"); err == nil {
+		t.Fatal("evicted file was read offline")
+	}
+}
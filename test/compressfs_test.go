@@ -0,0 +1,211 @@
+package filesystem
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/JakWai01/sile-fystem/pkg/compressfs"
+	"github.com/spf13/afero"
+)
+
+func setupCompressFs(t *testing.T, backend afero.Fs, algorithm compressfs.Algorithm) *compressfs.Fs {
+	fs, err := compressfs.NewFs(backend, compressfs.Config{
+		Algorithm:      algorithm,
+		FrameSize:      1024,
+		SkipExtensions: compressfs.DefaultSkipExtensions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fs
+}
+
+func TestCompressFsRoundTrip(t *testing.T) {
+	content := bytes.Repeat([]byte("2022-01-24T12:00:00Z INFO request handled\n"), 1000)
+
+	for _, algorithm := range []compressfs.Algorithm{compressfs.Zstd, compressfs.LZ4, compressfs.Gzip} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			backend := afero.NewMemMapFs()
+			fs := setupCompressFs(t, backend, algorithm)
+
+			if err := afero.WriteFile(fs, "/app.log", content, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := afero.ReadFile(fs, "/app.log")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(data, content) {
+				t.Fail()
+			}
+
+			fi, err := fs.Stat("/app.log")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fi.Size() != int64(len(content)) {
+				t.Fail()
+			}
+
+			raw, err := backend.Stat("/app.log")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if raw.Size() >= int64(len(content)) {
+				t.Fail()
+			}
+
+			infos, err := afero.ReadDir(fs, "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(infos) != 1 || infos[0].Size() != int64(len(content)) {
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestCompressFsRandomAccess(t *testing.T) {
+	fs := setupCompressFs(t, afero.NewMemMapFs(), compressfs.Zstd)
+
+	content := bytes.Repeat([]byte("0123456789"), 500)
+
+	if err := afero.WriteFile(fs, "/foo", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile("/foo", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt([]byte("abcd"), 1022); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = fs.OpenFile("/foo", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	copy(content[1022:], "abcd")
+	content = append(content, "tail"...)
+
+	f, err = fs.Open("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 8)
+	if _, err := f.ReadAt(buf, 1020); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf, content[1020:1028]) {
+		t.Fail()
+	}
+
+	if n, err := f.ReadAt(buf, int64(len(content))-4); n != 4 || err != io.EOF || string(buf[:4]) != "tail" {
+		t.Fail()
+	}
+
+	data, err := afero.ReadFile(fs, "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, content) {
+		t.Fail()
+	}
+}
+
+func TestCompressFsTruncate(t *testing.T) {
+	fs := setupCompressFs(t, afero.NewMemMapFs(), compressfs.LZ4)
+
+	if err := afero.WriteFile(fs, "/foo", bytes.Repeat([]byte("a"), 3000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile("/foo", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Truncate(1500); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Truncate(2100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(fs, "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(bytes.Repeat([]byte("a"), 1500), make([]byte, 600)...)
+	if !bytes.Equal(data, expected) {
+		t.Fail()
+	}
+}
+
+func TestCompressFsSkipExtensions(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	fs := setupCompressFs(t, backend, compressfs.Gzip)
+
+	content := bytes.Repeat([]byte("already compressed"), 100)
+
+	if err := afero.WriteFile(fs, "/archive.GZ", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := afero.ReadFile(backend, "/archive.GZ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(raw, content) {
+		t.Fail()
+	}
+
+	// Files stored as they are stay readable through the layer.
+	if err := afero.WriteFile(backend, "/plain", []byte("plain"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(fs, "/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "plain" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,169 @@
+package filesystem
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/JakWai01/sile-fystem/pkg/cryptfs"
+	"github.com/spf13/afero"
+)
+
+func setupCryptFs(t *testing.T, backend afero.Fs, encryptNames bool) *cryptfs.Fs {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := cryptfs.NewFs(backend, cryptfs.Config{
+		Identities:   []age.Identity{identity},
+		Recipients:   []age.Recipient{identity.Recipient()},
+		EncryptNames: encryptNames,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fs
+}
+
+func TestCryptFsRoundTrip(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	fs := setupCryptFs(t, backend, false)
+
+	content := bytes.Repeat([]byte("Hello, world!"), 12345)
+
+	if err := afero.WriteFile(fs, "/foo", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(fs, "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, content) {
+		t.Fail()
+	}
+
+	fi, err := fs.Stat("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != int64(len(content)) {
+		t.Fail()
+	}
+
+	raw, err := afero.ReadFile(backend, "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(raw, []byte("Hello, world!")) {
+		t.Fail()
+	}
+
+	names, err := afero.ReadDir(fs, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 1 || names[0].Name() != "foo" || names[0].Size() != int64(len(content)) {
+		t.Fail()
+	}
+}
+
+func TestCryptFsRandomAccess(t *testing.T) {
+	fs := setupCryptFs(t, afero.NewMemMapFs(), false)
+
+	f, err := fs.Create("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Write across a chunk boundary past the end of the file.
+	if _, err := f.WriteAt([]byte("abcdef"), 64*1024-3); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt([]byte("XY"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 8)
+	if _, err := f.ReadAt(buf, 64*1024-4); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf[:7], []byte("\x00abcdef")) {
+		t.Fail()
+	}
+
+	if _, err := f.ReadAt(buf[:4], 9); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf[:4], []byte("\x00XY\x00")) {
+		t.Fail()
+	}
+
+	if err := f.Truncate(64*1024 - 1); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != 64*1024-1 {
+		t.Fail()
+	}
+
+	if n, _ := f.ReadAt(buf, 64*1024-4); n != 3 || !bytes.Equal(buf[:3], []byte("\x00ab")) {
+		t.Fail()
+	}
+}
+
+func TestCryptFsEncryptNames(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	fs := setupCryptFs(t, backend, true)
+
+	if err := fs.MkdirAll("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := afero.WriteFile(fs, "/dir/sub/foo", []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Stat("/dir"); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	if err := fs.Rename("/dir/sub/foo", "/dir/baz"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(fs, "/dir/baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "bar" {
+		t.Fail()
+	}
+
+	names, err := afero.ReadDir(fs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 2 || names[0].Name() != "baz" || names[1].Name() != "sub" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,237 @@
+package filesystem
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/dedupfs"
+	"github.com/spf13/afero"
+)
+
+func setupDedupFs(t *testing.T) (*dedupfs.Fs, string) {
+	store := t.TempDir()
+
+	fs, err := dedupfs.NewFs(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fs.Close()
+	})
+
+	return fs, store
+}
+
+func countChunks(t *testing.T, store string) int {
+	chunks := 0
+	if err := filepath.Walk(filepath.Join(store, "chunks"), func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			chunks++
+		}
+
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return chunks
+}
+
+func randomContent(seed int64, size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(content)
+
+	return content
+}
+
+func TestDedupFsDeduplicates(t *testing.T) {
+	fs, store := setupDedupFs(t)
+
+	content := randomContent(1, 1024*1024)
+
+	if err := fs.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := afero.WriteFile(fs, "/a/b/foo", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := countChunks(t, store)
+	if chunks < 2 {
+		t.Fail()
+	}
+
+	// The same content with a small prefix only adds the chunks around the edit.
+	if err := afero.WriteFile(fs, "/a/bar", append([]byte("prefix"), content...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if added := countChunks(t, store) - chunks; added < 1 || added > 2 {
+		t.Fail()
+	}
+
+	data, err := afero.ReadFile(fs, "/a/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, append([]byte("prefix"), content...)) {
+		t.Fail()
+	}
+
+	fi, err := fs.Stat("/a/b/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != int64(len(content)) || fi.Mode() != 0644 {
+		t.Fail()
+	}
+}
+
+func TestDedupFsAppendAndWriteAt(t *testing.T) {
+	fs, store := setupDedupFs(t)
+
+	content := randomContent(2, 512*1024)
+
+	if err := afero.WriteFile(fs, "/foo", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := countChunks(t, store)
+
+	f, err := fs.OpenFile("/foo", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the last chunk is stored anew.
+	if countChunks(t, store) != chunks+1 {
+		t.Fail()
+	}
+
+	f, err = fs.OpenFile("/foo", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt([]byte("head"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(append([]byte{}, content...), "tail"...)
+	copy(expected[10:], "head")
+
+	data, err := afero.ReadFile(fs, "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, expected) {
+		t.Fail()
+	}
+}
+
+func TestDedupFsDirectories(t *testing.T) {
+	fs, _ := setupDedupFs(t)
+
+	if err := fs.MkdirAll("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := afero.WriteFile(fs, "/dir/sub/foo", []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Remove("/dir/sub"); err == nil {
+		t.Fail()
+	}
+
+	if err := fs.Rename("/dir/sub", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(fs, "/moved/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "foo" {
+		t.Fail()
+	}
+
+	infos, err := afero.ReadDir(fs, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 2 || infos[0].Name() != "dir" || infos[1].Name() != "moved" || !infos[1].IsDir() {
+		t.Fail()
+	}
+
+	if err := fs.RemoveAll("/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat("/moved/foo"); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
+
+func TestDedupFsGC(t *testing.T) {
+	fs, store := setupDedupFs(t)
+
+	if err := afero.WriteFile(fs, "/foo", randomContent(3, 256*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := afero.WriteFile(fs, "/bar", []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := countChunks(t, store)
+
+	if err := fs.Remove("/foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recently written chunks are kept within the grace period.
+	if removed, _, err := fs.GC(time.Hour); err != nil || removed != 0 {
+		t.Fail()
+	}
+
+	removed, freed, err := fs.GC(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != chunks-1 || freed != 256*1024 || countChunks(t, store) != 1 {
+		t.Fail()
+	}
+
+	data, err := afero.ReadFile(fs, "/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "bar" {
+		t.Fail()
+	}
+}
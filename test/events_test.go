@@ -0,0 +1,92 @@
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	internal "github.com/JakWai01/sile-fystem/internal/test"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+)
+
+func testEvents(test *internal.TestSetup, t *testing.T) {
+	all := test.Server.Subscribe(64)
+	defer all.Close()
+
+	dir := test.Server.Subscribe(64, "/dir")
+	defer dir.Close()
+
+	small := test.Server.Subscribe(1)
+	defer small.Close()
+
+	if err := os.Mkdir(path.Join(test.Dir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(test.Dir, "dir", "foo"), []byte("taco"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(path.Join(test.Dir, "dir", "foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(path.Join(test.Dir, "dir", "foo"), path.Join(test.Dir, "bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(path.Join(test.Dir, "bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(path.Join(test.Dir, "dir")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []filesystem.Event{
+		{Type: filesystem.EventMkdir, Path: "/dir"},
+		{Type: filesystem.EventCreate, Path: "/dir/foo"},
+		{Type: filesystem.EventWrite, Path: "/dir/foo"},
+		{Type: filesystem.EventChmod, Path: "/dir/foo"},
+		{Type: filesystem.EventRename, Path: "/dir/foo", NewPath: "/bar"},
+		{Type: filesystem.EventUnlink, Path: "/bar"},
+		{Type: filesystem.EventRmdir, Path: "/dir"},
+	}
+
+	// The kernel releases files asynchronously, so the write may be reported late.
+	received := []filesystem.Event{}
+	for range expected {
+		received = append(received, <-all.Events)
+	}
+
+	for _, want := range expected {
+		found := false
+		for _, got := range received {
+			if got.Type == want.Type && got.Path == want.Path && got.NewPath == want.NewPath && got.Pid != 0 {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("missing %v", want)
+		}
+	}
+
+	// The unlink of /bar is the only event outside of /dir.
+	if len(dir.Events) != len(expected)-1 {
+		t.Fail()
+	}
+
+	if len(small.Events) != 1 || small.Dropped() != uint64(len(expected)-1) {
+		t.Fail()
+	}
+}
+
+func TestEvents(t *testing.T) {
+	testOsFs := setupTestingEnvironment(true)
+	testEvents(testOsFs, t)
+
+	testMemMapFs := setupTestingEnvironment(false)
+	testEvents(testMemMapFs, t)
+}
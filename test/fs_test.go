@@ -2,6 +2,7 @@ package filesystem
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"io"
 	"io/ioutil"
@@ -10,10 +11,14 @@ import (
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/JakWai01/sile-fystem/internal/logging"
 	internal "github.com/JakWai01/sile-fystem/internal/test"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/JakWai01/sile-fystem/pkg/memfs"
 	"github.com/JakWai01/sile-fystem/pkg/posix"
+	"github.com/spf13/afero"
 )
 
 var (
@@ -723,20 +728,109 @@ func TestRenameWithinDirFile(t *testing.T) {
 	testRenameWithinDirFile(testMemMapFs, t)
 }
 
+func testRenameDir(test *internal.TestSetup, t *testing.T) {
+	parentPath := path.Join(test.Dir, "parent3")
+
+	if err := os.MkdirAll(path.Join(parentPath, "dir", "sub", "leaf"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(path.Join(parentPath, "full", "x"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	movedPath := path.Join(parentPath, "moved")
+
+	if err := os.Rename(path.Join(parentPath, "dir"), movedPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The directories below the renamed one are created at their new path.
+	if err := os.Mkdir(path.Join(movedPath, "sub", "leaf", "new"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(movedPath, "sub", "leaf", "new")); err != nil {
+		t.Fail()
+	}
+
+	// os.Rename refuses to replace directories on its own.
+	if err := syscall.Rename(movedPath, path.Join(parentPath, "full")); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(movedPath, "sub", "leaf")); err != nil {
+		t.Fail()
+	}
+}
+
+func TestRenameDir(t *testing.T) {
+	// afero.MemMapFs doesn't move the content of renamed directories.
+	testOsFs := setupTestingEnvironment(true)
+	testRenameDir(testOsFs, t)
+}
+
 func getFileOffset(f *os.File) (offset int64, err error) {
 	const relativeToCurrent = 1
 	return f.Seek(0, relativeToCurrent)
 }
 
-func setupTestingEnvironment(osfs bool) *internal.TestSetup {
+func setupTestingEnvironment(osfs bool, options ...filesystem.Option) *internal.TestSetup {
 	test := internal.TestSetup{}
 
 	l := logging.NewJSONLogger(*verbosity)
 
-	err := test.Setup(l, osfs)
+	err := test.Setup(l, osfs, options...)
 	if err != nil {
 		panic(err)
 	}
 
 	return &test
 }
+
+func TestChtimes(t *testing.T) {
+	backend := memfs.NewFs()
+
+	if err := afero.WriteFile(backend, "/foo", []byte("Hello, world!"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := mountMemFs(t, backend)
+
+	mtime := time.Unix(1640995200, 0)
+	if err := os.Chtimes(path.Join(dir, "foo"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := backend.Stat("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.ModTime().Equal(mtime) {
+		t.Fatal(info.ModTime())
+	}
+}
+
+func TestLinkBackend(t *testing.T) {
+	test := setupTestingEnvironment(true)
+
+	if err := syscall.Mknod(path.Join(test.Dir, "target"), syscall.S_IFREG|0600, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Link(path.Join(test.Dir, "target"), path.Join(test.Dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := os.Stat(path.Join(test.TestDir, "target"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The backend links the file, so it survives remounting.
+	link, err := os.Stat(path.Join(test.TestDir, "link"))
+	if err != nil || !os.SameFile(target, link) {
+		t.Fail()
+	}
+}
@@ -0,0 +1,227 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/afero"
+)
+
+// syncingFs records the files and directories synced through it.
+type syncingFs struct {
+	afero.Fs
+
+	syncs int64
+
+	mu   sync.Mutex
+	dirs []string
+}
+
+func (fs *syncingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syncingFile{file, fs}, nil
+}
+
+func (fs *syncingFs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *syncingFs) SyncDir(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.dirs = append(fs.dirs, name)
+
+	return nil
+}
+
+func (fs *syncingFs) synced(dir string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, d := range fs.dirs {
+		if d == dir {
+			return true
+		}
+	}
+
+	return false
+}
+
+type syncingFile struct {
+	afero.File
+
+	fs *syncingFs
+}
+
+func (f *syncingFile) Sync() error {
+	atomic.AddInt64(&f.fs.syncs, 1)
+
+	return f.File.Sync()
+}
+
+func TestFsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &syncingFs{Fs: afero.NewMemMapFs()}
+
+	mfs, err := filesystem.Mount(context.Background(), dir, backend,
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithoutWritebackCaching(),
+		filesystem.WithBlockCache(filesystem.BlockCache{BlockSize: 4096}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	if err := os.Mkdir(path.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Create(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !backend.synced("/") {
+		t.Fatal("directory of the created file wasn't synced")
+	}
+
+	content := bytes.Repeat([]byte("durable"), 1000)
+	if _, err := file.Write(content); err != nil {
+		t.Fatal(err)
+	}
+
+	// fsync drains the block cache into the backend and syncs the file there.
+	if err := file.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt64(&backend.syncs) == 0 {
+		t.Fatal("file wasn't synced in the backend")
+	}
+
+	stored, err := afero.ReadFile(backend.Fs, "/foo")
+	if err != nil || !bytes.Equal(stored, content) {
+		t.Fatal("content wasn't written back on fsync", err)
+	}
+
+	syncs := atomic.LoadInt64(&backend.syncs)
+
+	if _, err := file.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing a file written to flushes and syncs it as well.
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt64(&backend.syncs) == syncs {
+		t.Fatal("written file wasn't synced on close")
+	}
+
+	syncs = atomic.LoadInt64(&backend.syncs)
+
+	if _, err := ioutil.ReadFile(path.Join(dir, "foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt64(&backend.syncs) != syncs {
+		t.Fatal("file only read was synced on close")
+	}
+
+	if err := os.Rename(path.Join(dir, "foo"), path.Join(dir, "sub", "bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	if !backend.synced("/sub") {
+		t.Fatal("target directory of the rename wasn't synced")
+	}
+}
+
+// linkingFs is a syncingFs of the filesystem of the OS supporting links.
+type linkingFs struct {
+	*syncingFs
+}
+
+func (fs linkingFs) Link(oldname string, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (fs linkingFs) SymlinkIfPossible(oldname string, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func TestFsyncEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	backend := linkingFs{&syncingFs{Fs: afero.NewOsFs()}}
+
+	mfs, err := filesystem.Mount(context.Background(), dir, backend,
+		filesystem.WithRoot(root),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithoutWritebackCaching(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	// Each entry is created in a directory of its own, so that the sync of each parent is checked.
+	for _, name := range []string{"nodes", "symlinks", "links"} {
+		if err := os.Mkdir(path.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !backend.synced(root) {
+		t.Fatal("parent of the created directories wasn't synced")
+	}
+
+	if err := syscall.Mknod(path.Join(dir, "nodes", "node"), syscall.S_IFREG|0600, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !backend.synced(path.Join(root, "nodes")) {
+		t.Fatal("parent of the created node wasn't synced")
+	}
+
+	if err := os.Symlink("../nodes/node", path.Join(dir, "symlinks", "symlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	if !backend.synced(path.Join(root, "symlinks")) {
+		t.Fatal("parent of the created symlink wasn't synced")
+	}
+
+	if err := os.Link(path.Join(dir, "nodes", "node"), path.Join(dir, "links", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if !backend.synced(path.Join(root, "links")) {
+		t.Fatal("parent of the created link wasn't synced")
+	}
+}
@@ -0,0 +1,86 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/spf13/afero"
+)
+
+func TestInterceptors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := []string{}
+	record := func(name string) filesystem.Interceptor {
+		return filesystem.InterceptorFunc(func(ctx context.Context, op interface{}, next filesystem.Handler) error {
+			if _, ok := op.(*fuseops.UnlinkOp); !ok {
+				return next(ctx)
+			}
+
+			calls = append(calls, name+" before")
+			err := next(ctx)
+			calls = append(calls, name+" after")
+
+			return err
+		})
+	}
+
+	// Files named "keep" can't be removed.
+	protect := filesystem.InterceptorFunc(func(ctx context.Context, op interface{}, next filesystem.Handler) error {
+		if op, ok := op.(*fuseops.UnlinkOp); ok && op.Name == "keep" {
+			return syscall.EACCES
+		}
+
+		return next(ctx)
+	})
+
+	mfs, err := filesystem.Mount(context.Background(), dir, afero.NewMemMapFs(),
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithInterceptors(record("outer"), record("inner"), protect),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	for _, name := range []string{"keep", "drop"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Remove(path.Join(dir, "keep")); !errors.Is(err, syscall.EACCES) {
+		t.Fail()
+	}
+
+	if err := os.Remove(path.Join(dir, "drop")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "keep")); err != nil {
+		t.Fail()
+	}
+
+	expected := []string{"outer before", "inner before", "inner after", "outer after"}
+	if len(calls) != 2*len(expected) {
+		t.FailNow()
+	}
+
+	for i, call := range expected {
+		if calls[i] != call || calls[len(expected)+i] != call {
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package filesystem
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/JakWai01/sile-fystem/pkg/posix"
+	"github.com/spf13/afero"
+)
+
+func TestJournalRecovery(t *testing.T) {
+	backend := afero.NewMemMapFs()
+
+	for _, name := range []string{"/renamed", "/created", "/unlinked"} {
+		if err := afero.WriteFile(backend, name, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The rename and the create were interrupted, the mkdir completed.
+	journal := `{"seq":1,"op":"rename","path":"/renamed","newPath":"/target"}
+{"seq":2,"op":"create","path":"/created","mode":420}
+{"seq":3,"op":"unlink","path":"/unlinked"}
+{"seq":4,"op":"mkdir","path":"/dir","mode":2147484141}
+{"seq":4,"done":true}
+{"seq":5,"op":"ren`
+	if err := afero.WriteFile(backend, "/.sile-fystem-journal", []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := filesystem.NewFileSystem(posix.CurrentUid(), posix.CurrentGid(), t.TempDir(), "", logging.NewJSONLogger(*verbosity), backend, false).(*filesystem.Server)
+
+	if err := server.EnableJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Stat("/renamed"); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	data, err := afero.ReadFile(backend, "/target")
+	if err != nil || string(data) != "/renamed" {
+		t.Fail()
+	}
+
+	info, err := backend.Stat("/created")
+	if err != nil || info.Mode() != 0644 {
+		t.Fail()
+	}
+
+	// Removals are completed.
+	if _, err := backend.Stat("/unlinked"); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	data, err = afero.ReadFile(backend, "/.sile-fystem-journal")
+	if err != nil || len(data) != 0 {
+		t.Fail()
+	}
+}
+
+// crashingFs renames by copying before removing the source, and stops in between.
+type crashingFs struct {
+	afero.Fs
+
+	renaming chan struct{}
+	resume   chan struct{}
+}
+
+func (fs *crashingFs) Rename(oldname, newname string) error {
+	data, err := afero.ReadFile(fs.Fs, oldname)
+	if err != nil {
+		return err
+	}
+
+	if err := afero.WriteFile(fs.Fs, newname, data, 0644); err != nil {
+		return err
+	}
+
+	close(fs.renaming)
+	<-fs.resume
+
+	return fs.Fs.Remove(oldname)
+}
+
+func TestJournalInterruptedRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &crashingFs{
+		Fs:       afero.NewMemMapFs(),
+		renaming: make(chan struct{}),
+		resume:   make(chan struct{}),
+	}
+
+	if err := afero.WriteFile(backend.Fs, "/source", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := filesystem.New(dir, backend, filesystem.WithRoot("/"), filesystem.WithLogger(logging.NewJSONLogger(*verbosity)))
+	if err := server.EnableJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := server.Mount(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	renamed := make(chan error)
+	go func() {
+		renamed <- os.Rename(path.Join(dir, "source"), path.Join(dir, "target"))
+	}()
+
+	<-backend.renaming
+
+	// The state of the backend at the time of the crash.
+	crashed := afero.NewMemMapFs()
+	if err := afero.Walk(backend.Fs, "/", func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		data, err := afero.ReadFile(backend.Fs, p)
+		if err != nil {
+			return err
+		}
+
+		return afero.WriteFile(crashed, p, data, info.Mode())
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	close(backend.resume)
+
+	if err := <-renamed; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := filesystem.New(t.TempDir(), crashed, filesystem.WithRoot("/")).EnableJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := crashed.Stat("/source"); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	data, err := afero.ReadFile(crashed, "/target")
+	if err != nil || string(data) != "content" {
+		t.Fail()
+	}
+
+	data, err = afero.ReadFile(crashed, "/.sile-fystem-journal")
+	if err != nil || len(data) != 0 {
+		t.Fail()
+	}
+}
+
+func TestJournalLinkRecovery(t *testing.T) {
+	root := t.TempDir()
+	backend := afero.NewOsFs()
+
+	target := path.Join(root, "target")
+	if err := afero.WriteFile(backend, target, []byte("target"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The link was interrupted before the backend linked the file.
+	journal := `{"seq":1,"op":"link","path":"` + target + `","newPath":"` + path.Join(root, "link") + `"}`
+	if err := afero.WriteFile(backend, path.Join(root, ".sile-fystem-journal"), []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := filesystem.NewFileSystem(posix.CurrentUid(), posix.CurrentGid(), t.TempDir(), root, logging.NewJSONLogger(*verbosity), backend, false).(*filesystem.Server)
+
+	if err := server.EnableJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	linkInfo, err := os.Stat(path.Join(root, "link"))
+	if err != nil || !os.SameFile(targetInfo, linkInfo) {
+		t.Fail()
+	}
+}
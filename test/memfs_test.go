@@ -0,0 +1,220 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/memfs"
+	"github.com/spf13/afero"
+)
+
+func TestMemFsSnapshotRoundTrip(t *testing.T) {
+	snapshot := path.Join(t.TempDir(), "snapshot.tar")
+	mtime := time.Unix(1640995200, 0)
+
+	backend := memfs.NewFs()
+
+	if err := backend.MkdirAll("/dir/sub", 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := afero.WriteFile(backend, "/dir/foo", []byte("Hello, world!"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.Chtimes("/dir/foo", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.SymlinkIfPossible("foo", "/dir/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.SetXattr("/dir/foo", "user.tag", []byte("important"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := memfs.Save(backend, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := memfs.NewFs()
+
+	if err := memfs.Load(restored, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(restored, "/dir/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "Hello, world!" {
+		t.Fail()
+	}
+
+	fi, err := restored.Stat("/dir/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode() != 0640 || !fi.ModTime().Equal(mtime) {
+		t.Fail()
+	}
+
+	fi, err = restored.Stat("/dir/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode() != os.ModeDir|0750 {
+		t.Fail()
+	}
+
+	target, err := restored.ReadlinkIfPossible("/dir/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target != "foo" {
+		t.Fail()
+	}
+
+	value, err := restored.GetXattr("/dir/foo", "user.tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(value) != "important" {
+		t.Fail()
+	}
+}
+
+func TestMemFsLoadMissingSnapshot(t *testing.T) {
+	if err := memfs.Load(memfs.NewFs(), path.Join(t.TempDir(), "missing.tar")); err != nil {
+		t.Fail()
+	}
+}
+
+func TestMemFsLimits(t *testing.T) {
+	backend, err := memfs.NewLimitedFs(memfs.Limits{
+		MaxBytes:  10,
+		MaxInodes: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := afero.WriteFile(backend, "/foo", []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := backend.OpenFile("/foo", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte("a")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fail()
+	}
+	f.Close()
+
+	if err := backend.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.Mkdir("/dir2", 0755); !errors.Is(err, syscall.ENOSPC) {
+		t.Fail()
+	}
+
+	usage, err := backend.StatFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage.TotalBytes != 10 || usage.FreeBytes != 0 || usage.TotalInodes != 2 || usage.FreeInodes != 0 {
+		t.Fail()
+	}
+
+	if err := backend.Remove("/foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err = backend.StatFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage.FreeBytes != 10 || usage.FreeInodes != 1 {
+		t.Fail()
+	}
+}
+
+func TestMemFsSpill(t *testing.T) {
+	backend, err := memfs.NewLimitedFs(memfs.Limits{
+		MaxBytes: 16,
+		SpillDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	cold := bytes.Repeat([]byte("c"), 12)
+	hot := bytes.Repeat([]byte("h"), 12)
+
+	if err := afero.WriteFile(backend, "/cold", cold, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := afero.WriteFile(backend, "/hot", hot, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := backend.Stat("/cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != int64(len(cold)) {
+		t.Fail()
+	}
+
+	data, err := afero.ReadFile(backend, "/cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, cold) {
+		t.Fail()
+	}
+
+	f, err := backend.OpenFile("/cold", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	data, err = afero.ReadFile(backend, "/hot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, hot) {
+		t.Fail()
+	}
+
+	usage, err := backend.StatFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage.FreeBytes != 4 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,60 @@
+package filesystem
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/afero"
+)
+
+func TestMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := afero.NewMemMapFs()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mfs, err := filesystem.Mount(ctx, dir, backend,
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "foo"), []byte("taco"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mfs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(backend, "/foo")
+	if err != nil || string(data) != "taco" {
+		t.Fail()
+	}
+
+	if stats := mfs.Stats(); stats.Writes == 0 || stats.BytesWritten != 4 {
+		t.Fail()
+	}
+
+	// Cancelling the context unmounts the filesystem.
+	cancel()
+
+	if err := mfs.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ioutil.ReadFile(path.Join(dir, "foo")); err == nil {
+		t.Fail()
+	}
+}
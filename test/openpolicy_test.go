@@ -0,0 +1,96 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path"
+	"sync/atomic"
+	"testing"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/afero"
+)
+
+// streamingFs serves /stream as a stream.
+type streamingFs struct {
+	*countingFs
+}
+
+func (fs streamingFs) IsStream(name string) bool {
+	return name == "/stream"
+}
+
+func TestOpenPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := streamingFs{&countingFs{Fs: afero.NewMemMapFs()}}
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	for _, name := range []string{"/cached", "/direct.log", "/stream"} {
+		if err := afero.WriteFile(backend.Fs, name, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mfs, err := filesystem.Mount(context.Background(), dir, backend,
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithOpenPolicy(filesystem.OpenPolicy{
+			DirectIO:      []string{"/*.log"},
+			KeepPageCache: true,
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	// read reads a file through the mount and returns the reads it caused in the backend.
+	read := func(name string, want []byte) int64 {
+		t.Helper()
+
+		before := atomic.LoadInt64(&backend.reads)
+
+		data, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, want) {
+			t.Fatalf("%v: unexpected content", name)
+		}
+
+		return atomic.LoadInt64(&backend.reads) - before
+	}
+
+	if read("cached", content) == 0 {
+		t.Fatal("first read of a file wasn't served by the backend")
+	}
+
+	if reads := read("cached", content); reads != 0 {
+		t.Fatal("page cache of an unchanged file wasn't kept", reads)
+	}
+
+	// Changing the file in the backend drops what the kernel cached, even if its size stays the same.
+	changed := bytes.ToUpper(content)
+	if err := afero.WriteFile(backend.Fs, "/cached", changed, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if read("cached", changed) == 0 {
+		t.Fatal("page cache of a changed file was kept")
+	}
+
+	for _, name := range []string{"direct.log", "stream"} {
+		read(name, content)
+
+		if read(name, content) == 0 {
+			t.Fatalf("%v: read through the page cache", name)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/afero"
+)
+
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := filesystem.Mount(context.Background(), dir, afero.NewMemMapFs(),
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithReadOnly(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	if err := ioutil.WriteFile(path.Join(dir, "foo"), []byte("taco"), 0644); !errors.Is(err, syscall.EROFS) {
+		t.Fail()
+	}
+
+	if err := os.Mkdir(path.Join(dir, "bar"), 0755); !errors.Is(err, syscall.EROFS) {
+		t.Fail()
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,218 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/afero"
+)
+
+// blockingFs blocks reads of a file until it is released.
+type blockingFs struct {
+	afero.Fs
+
+	name    string
+	reading chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (fs *blockingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil || name != fs.name {
+		return file, err
+	}
+
+	return &blockingFile{file, fs}, nil
+}
+
+func (fs *blockingFs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+type blockingFile struct {
+	afero.File
+
+	fs *blockingFs
+}
+
+func (f *blockingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.once.Do(func() {
+		close(f.fs.reading)
+	})
+
+	<-f.fs.release
+
+	return f.File.ReadAt(p, off)
+}
+
+func testParallel(t *testing.T, options ...filesystem.Option) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &blockingFs{
+		Fs:      afero.NewMemMapFs(),
+		name:    "/slow",
+		reading: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	const (
+		workers    = 16
+		iterations = 50
+	)
+
+	for _, name := range []string{"slow", "fast"} {
+		if err := afero.WriteFile(backend.Fs, "/"+name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < workers; i++ {
+		if err := afero.WriteFile(backend.Fs, fmt.Sprintf("/file%v", i), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mfs, err := filesystem.Mount(context.Background(), dir, backend, append([]filesystem.Option{
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithoutWritebackCaching(),
+	}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	slow := make(chan error)
+	go func() {
+		_, err := ioutil.ReadFile(path.Join(dir, "slow"))
+
+		slow <- err
+	}()
+
+	<-backend.reading
+
+	// A read stuck in the backend doesn't hold up reads of other files.
+	fast := make(chan error)
+	go func() {
+		data, err := ioutil.ReadFile(path.Join(dir, "fast"))
+		if err == nil && string(data) != "fast" {
+			err = fmt.Errorf("unexpected content %q", data)
+		}
+
+		fast <- err
+	}()
+
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("read of an independent file was blocked")
+	}
+
+	close(backend.release)
+
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+
+	// Hammer the mount from many goroutines, which is meant to be run with the race detector.
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			errs <- hammer(dir, i, iterations)
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stats := mfs.Stats(); stats.Writes < workers*iterations {
+		t.Fatal("writes weren't counted", stats.Writes)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	testParallel(t)
+}
+
+func TestParallelBlockCache(t *testing.T) {
+	// The budget is small enough for the workers to evict the blocks of each other.
+	testParallel(t, filesystem.WithBlockCache(filesystem.BlockCache{
+		BlockSize: 4096,
+		Memory:    4 * 4096,
+	}))
+}
+
+// hammer writes and reads a file of its own while listing and changing the directory shared with the other workers.
+func hammer(dir string, i int, iterations int) error {
+	name := path.Join(dir, fmt.Sprintf("file%v", i))
+
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for j := 0; j < iterations; j++ {
+		content := []byte(fmt.Sprintf("worker %v iteration %v", i, j))
+
+		if _, err := file.WriteAt(content, 0); err != nil {
+			return err
+		}
+
+		read := make([]byte, len(content))
+		if _, err := file.ReadAt(read, 0); err != nil {
+			return err
+		}
+
+		if !bytes.Equal(read, content) {
+			return fmt.Errorf("%v: read %q after writing %q", name, read, content)
+		}
+
+		if _, err := os.Stat(name); err != nil {
+			return err
+		}
+
+		if _, err := ioutil.ReadDir(dir); err != nil {
+			return err
+		}
+
+		sub := path.Join(dir, fmt.Sprintf("dir%v", i))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			return err
+		}
+
+		if err := os.Remove(sub); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
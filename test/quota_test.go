@@ -0,0 +1,268 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/JakWai01/sile-fystem/pkg/quota"
+	"github.com/spf13/afero"
+)
+
+func TestQuotas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbDir, err := ioutil.TempDir("", "quota_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	q, err := quota.Open(path.Join(dbDir, "quota.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	uid := uint32(os.Getuid())
+
+	if err := q.SetUserLimit(uid, quota.Limit{Bytes: 8192}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.SetDirLimit("/small", quota.Limit{Inodes: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := afero.NewMemMapFs()
+
+	mfs, err := filesystem.Mount(context.Background(), dir, backend,
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithoutWritebackCaching(),
+		filesystem.WithQuotas(q),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	if err := ioutil.WriteFile(path.Join(dir, "a"), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "b"), make([]byte, 8192), 0644); !errors.Is(err, syscall.EDQUOT) {
+		t.Fatal(err)
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Blocks != 2 || stat.Bfree > 1 {
+		t.Fatal(stat.Blocks, stat.Bfree)
+	}
+
+	if err := os.Mkdir(path.Join(dir, "small"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(path.Join(dir, "small", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "small", "y"), nil, 0644); !errors.Is(err, syscall.EDQUOT) {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(path.Join(dir, "small", "x"), path.Join(dir, "x")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "small", "y"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(path.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "c"), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mfs.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := q.User(uid)
+	if before.Usage.Bytes != 8192 {
+		t.Fatal(before.Usage)
+	}
+
+	if err := filesystem.RebuildQuotas(q, backend, "/", uid); err != nil {
+		t.Fatal(err)
+	}
+
+	if after, _ := q.User(uid); after.Usage != before.Usage {
+		t.Fatal(before.Usage, after.Usage)
+	}
+}
+
+// failingFs fails writes to a file.
+type failingFs struct {
+	afero.Fs
+
+	name string
+}
+
+func (fs *failingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil || name != fs.name {
+		return file, err
+	}
+
+	return &failingFile{file}, nil
+}
+
+func (fs *failingFs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+type failingFile struct {
+	afero.File
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	return 0, syscall.EIO
+}
+
+func (f *failingFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EIO
+}
+
+func (f *failingFile) Truncate(size int64) error {
+	return syscall.EIO
+}
+
+func TestQuotasFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbDir, err := ioutil.TempDir("", "quota_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	q, err := quota.Open(path.Join(dbDir, "quota.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	uid := uint32(os.Getuid())
+
+	if err := q.SetUserLimit(uid, quota.Limit{Bytes: 8192}); err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := filesystem.Mount(context.Background(), dir, &failingFs{afero.NewMemMapFs(), "/broken"},
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithoutWritebackCaching(),
+		filesystem.WithQuotas(q),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	if err := ioutil.WriteFile(path.Join(dir, "broken"), make([]byte, 4096), 0644); !errors.Is(err, syscall.EIO) {
+		t.Fatal(err)
+	}
+
+	// Failed writes aren't charged.
+	if usage, _ := q.User(uid); usage.Usage.Bytes != 0 {
+		t.Fatal(usage.Usage)
+	}
+}
+
+func TestQuotasTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbDir, err := ioutil.TempDir("", "quota_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	q, err := quota.Open(path.Join(dbDir, "quota.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	uid := uint32(os.Getuid())
+
+	if err := q.SetUserLimit(uid, quota.Limit{Bytes: 8192}); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := afero.NewMemMapFs()
+	for _, name := range []string{"/a", "/broken"} {
+		if err := afero.WriteFile(backend, name, make([]byte, 2048), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := filesystem.RebuildQuotas(q, backend, "/", uid); err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := filesystem.Mount(context.Background(), dir, &failingFs{backend, "/broken"},
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithQuotas(q),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	if err := os.Truncate(path.Join(dir, "a"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := backend.Stat("/a"); err != nil || info.Size() != 0 {
+		t.Fatal(info, err)
+	}
+
+	if usage, _ := q.User(uid); usage.Usage.Bytes != 2048 {
+		t.Fatal(usage.Usage)
+	}
+
+	// Failed truncates aren't charged.
+	if err := os.Truncate(path.Join(dir, "broken"), 0); !errors.Is(err, syscall.EIO) {
+		t.Fatal(err)
+	}
+
+	if usage, _ := q.User(uid); usage.Usage.Bytes != 2048 {
+		t.Fatal(usage.Usage)
+	}
+}
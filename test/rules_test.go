@@ -0,0 +1,206 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/JakWai01/sile-fystem/pkg/posix"
+	"github.com/JakWai01/sile-fystem/pkg/rules"
+	"github.com/spf13/afero"
+)
+
+func TestRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := afero.NewMemMapFs()
+	for _, name := range []string{"/public/a", "/docs/b", "/secret/c", "/home/me/d", "/home/other/e"} {
+		if err := afero.WriteFile(backend, name, []byte("taco"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := rules.Parse(strings.NewReader(fmt.Sprintf(`
+# Everyone may see the public files.
+allow    /public/**
+readonly /docs/**
+deny     /secret/**
+allow    /home/me/** uid=%v
+deny     /home/**
+`, os.Getuid())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := filesystem.Mount(context.Background(), dir, backend,
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithRules(r),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	if _, err := ioutil.ReadFile(path.Join(dir, "public", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ioutil.ReadFile(path.Join(dir, "secret", "c")); !errors.Is(err, syscall.EACCES) {
+		t.Fatal(err)
+	}
+
+	if _, err := ioutil.ReadFile(path.Join(dir, "docs", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "docs", "b"), []byte("burrito"), 0644); !errors.Is(err, syscall.EROFS) {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "docs", "new"), []byte("burrito"), 0644); !errors.Is(err, syscall.EROFS) {
+		t.Fatal(err)
+	}
+
+	if _, err := ioutil.ReadFile(path.Join(dir, "home", "me", "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ioutil.ReadFile(path.Join(dir, "home", "other", "e")); !errors.Is(err, syscall.EACCES) {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(path.Join(dir, "home", "new"), 0755); !errors.Is(err, syscall.EACCES) {
+		t.Fatal(err)
+	}
+
+	names := func(p string) string {
+		entries, err := ioutil.ReadDir(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+
+		return strings.Join(names, ",")
+	}
+
+	if got := names(dir); got != "docs,home,public" {
+		t.Fatal(got)
+	}
+
+	if got := names(path.Join(dir, "home")); got != "me" {
+		t.Fatal(got)
+	}
+}
+
+func TestRulesFrozen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := afero.NewMemMapFs()
+	for _, name := range []string{"/public/a", "/secret/c", "/.sile-fystem-versions/secret/c/2022-01-01T00:00:00.000000000Z"} {
+		if err := afero.WriteFile(backend, name, []byte("taco"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := rules.Parse(strings.NewReader(`
+deny /secret/**
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := filesystem.New(dir, backend,
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+		filesystem.WithRules(r),
+	)
+	server.EnableVersioning(filesystem.Retention{})
+
+	mfs, err := server.Mount(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Unmount()
+
+	if err := mfs.CreateSnapshot("before"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Snapshots and versions are subject to the rules of the live paths they were taken from.
+	if _, err := ioutil.ReadFile(path.Join(dir, ".snapshots", "before", "secret", "c")); !errors.Is(err, syscall.EACCES) {
+		t.Fatal(err)
+	}
+
+	if _, err := ioutil.ReadFile(path.Join(dir, ".versions", "secret", "c", "2022-01-01T00:00:00.000000000Z")); !errors.Is(err, syscall.EACCES) {
+		t.Fatal(err)
+	}
+
+	entries, err := ioutil.ReadDir(path.Join(dir, ".snapshots", "before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != "public" {
+		t.Fatal(entries)
+	}
+
+	if _, err := ioutil.ReadFile(path.Join(dir, ".snapshots", "before", "public", "a")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRulesSupplementaryGroups(t *testing.T) {
+	r, err := rules.Parse(strings.NewReader(`
+deny /secret/** gid=100
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if action := r.Evaluate("/secret/c", 1000, []uint32{1000, 100}); action != rules.Deny {
+		t.Fatal(action)
+	}
+
+	if action := r.Evaluate("/secret/c", 1000, []uint32{1000}); action != rules.Allow {
+		t.Fatal(action)
+	}
+
+	process, err := posix.LookUpProcess(uint32(os.Getpid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := os.Getgroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(process.Groups) != len(groups) {
+		t.Fatal(process.Groups, groups)
+	}
+
+	for i, gid := range groups {
+		if process.Groups[i] != uint32(gid) {
+			t.Fatal(process.Groups, groups)
+		}
+	}
+}
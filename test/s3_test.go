@@ -0,0 +1,331 @@
+package filesystem
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+
+	internal "github.com/JakWai01/sile-fystem/internal/test"
+	"github.com/JakWai01/sile-fystem/pkg/s3fs"
+	"github.com/spf13/afero"
+)
+
+func setupS3Backend(t *testing.T, partSize int64) (*s3fs.Fs, *internal.FakeS3) {
+	fake := internal.NewFakeS3("bucket")
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	backend, err := s3fs.NewFs(s3fs.Config{
+		Endpoint:  server.URL,
+		Bucket:    "bucket",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PartSize:  partSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return backend, fake
+}
+
+func TestS3WriteAndRead(t *testing.T) {
+	backend, _ := setupS3Backend(t, 0)
+
+	const contents = "Hello, world!"
+
+	err := afero.WriteFile(backend, "/foo", []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(backend, "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != contents {
+		t.Fail()
+	}
+
+	f, err := backend.OpenFile("/foo", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt([]byte("J"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "Jello" {
+		t.Fail()
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = backend.Open("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf = make([]byte, 5)
+	if _, err := f.ReadAt(buf, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "world" {
+		t.Fail()
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != int64(len(contents)) || fi.Mode() != 0644 {
+		t.Fail()
+	}
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	backend, fake := setupS3Backend(t, 1024)
+
+	contents := bytes.Repeat([]byte("0123456789"), 1000)
+
+	err := afero.WriteFile(backend, "/large", contents, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fake.MultipartUploads != 1 {
+		t.Fail()
+	}
+
+	data, err := afero.ReadFile(backend, "/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, contents) {
+		t.Fail()
+	}
+}
+
+func TestS3Directories(t *testing.T) {
+	backend, _ := setupS3Backend(t, 0)
+
+	if err := backend.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.Mkdir("/dir", 0755); !os.IsExist(err) {
+		t.Fail()
+	}
+
+	if err := backend.Mkdir("/missing/dir", 0755); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	if err := afero.WriteFile(backend, "/dir/foo", []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.Mkdir("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := backend.Stat("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fi.IsDir() {
+		t.Fail()
+	}
+
+	f, err := backend.Open("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "foo" || names[1] != "sub" {
+		t.Fail()
+	}
+
+	if err := backend.Remove("/dir"); err == nil {
+		t.Fail()
+	}
+
+	if err := backend.Remove("/dir/sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Stat("/dir/sub"); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
+
+func TestS3Rename(t *testing.T) {
+	backend, _ := setupS3Backend(t, 0)
+
+	if err := backend.MkdirAll("/parent/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := afero.WriteFile(backend, "/parent/dir/foo", []byte("taco"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.Rename("/parent/dir/foo", "/parent/dir/bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Stat("/parent/dir/foo"); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	fi, err := backend.Stat("/parent/dir/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != int64(len("taco")) || fi.Mode() != 0600 {
+		t.Fail()
+	}
+
+	if err := backend.Rename("/parent", "/renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Stat("/parent"); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	data, err := afero.ReadFile(backend, "/renamed/dir/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "taco" {
+		t.Fail()
+	}
+}
+
+func TestS3ChmodAndRemoveAll(t *testing.T) {
+	backend, _ := setupS3Backend(t, 0)
+
+	if err := afero.WriteFile(backend, "/foo", []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.Chmod("/foo", 0754); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := backend.Stat("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode() != os.FileMode(0754) {
+		t.Fail()
+	}
+
+	if err := backend.MkdirAll("/a/b/c", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := afero.WriteFile(backend, "/a/b/c/d", []byte("d"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.RemoveAll("/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Stat("/a"); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	infos, err := afero.ReadDir(backend, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 1 || infos[0].Name() != "foo" {
+		t.Fail()
+	}
+}
+
+func TestS3Streams(t *testing.T) {
+	backend, fake := setupS3Backend(t, 0)
+
+	contents := bytes.Repeat([]byte("0123456789"), 1000)
+
+	if err := afero.WriteFile(backend, "/stream", contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.SetStreaming(true)
+
+	if !backend.IsStream("/stream") {
+		t.Fail()
+	}
+
+	info, err := backend.Stat("/stream")
+	if err != nil || info.Size() != 0 {
+		t.Fail()
+	}
+
+	// Streams are read until the store runs out of content.
+	data, err := afero.ReadFile(backend, "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, contents) {
+		t.Fail()
+	}
+
+	f, err := backend.OpenFile("/stream", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt([]byte("J"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.SetStreaming(false)
+
+	data, err = afero.ReadFile(backend, "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, append([]byte("J"), contents[1:]...)) {
+		t.Fail()
+	}
+}
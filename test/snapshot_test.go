@@ -0,0 +1,84 @@
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	internal "github.com/JakWai01/sile-fystem/internal/test"
+)
+
+func testSnapshot(test *internal.TestSetup, t *testing.T) {
+	server := test.Server
+
+	filePath := path.Join(test.Dir, "foo")
+
+	if err := ioutil.WriteFile(filePath, []byte("taco"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.CreateSnapshot("before"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filePath, []byte("burrito"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshotPath := path.Join(test.Dir, ".snapshots", "before", "foo")
+
+	data, err := ioutil.ReadFile(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "taco" {
+		t.Fail()
+	}
+
+	if err := ioutil.WriteFile(snapshotPath, []byte("nachos"), 0644); err == nil {
+		t.Fail()
+	}
+
+	// The snapshots are hidden from the listing of the root directory.
+	infos, err := ioutil.ReadDir(test.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, info := range infos {
+		if info.Name() == ".snapshots" {
+			t.Fail()
+		}
+	}
+
+	if err := os.Remove(filePath); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = ioutil.ReadFile(snapshotPath)
+	if err != nil || string(data) != "taco" {
+		t.Fail()
+	}
+
+	if snapshots := server.ListSnapshots(); len(snapshots) != 1 || snapshots[0].Name != "before" {
+		t.Fail()
+	}
+
+	if err := server.DeleteSnapshot("before"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(test.Dir, ".snapshots", "before")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	testOsFs := setupTestingEnvironment(true)
+	testSnapshot(testOsFs, t)
+
+	testMemMapFs := setupTestingEnvironment(false)
+	testSnapshot(testMemMapFs, t)
+}
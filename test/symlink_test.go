@@ -0,0 +1,155 @@
+package filesystem
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/JakWai01/sile-fystem/pkg/memfs"
+	"github.com/JakWai01/sile-fystem/pkg/posix"
+	"github.com/jacobsa/fuse"
+	"github.com/spf13/afero"
+)
+
+func mountMemFs(t *testing.T, backend *memfs.Fs) string {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := filesystem.NewFileSystem(posix.CurrentUid(), posix.CurrentGid(), dir, "/", logging.NewJSONLogger(*verbosity), backend, false)
+
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{DisableWritebackCaching: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Error(err)
+
+			return
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Error(err)
+		}
+
+		os.RemoveAll(dir)
+	})
+
+	return dir
+}
+
+func TestSymlinks(t *testing.T) {
+	backend := memfs.NewFs()
+
+	if err := afero.WriteFile(backend, "/foo", []byte("Hello, world!"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.SymlinkIfPossible("foo", "/existing"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := mountMemFs(t, backend)
+
+	target, err := os.Readlink(path.Join(dir, "existing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target != "foo" {
+		t.Fail()
+	}
+
+	if err := os.Symlink("foo", path.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(path.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Fail()
+	}
+
+	target, err = os.Readlink(path.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target != "foo" {
+		t.Fail()
+	}
+
+	target, err = backend.ReadlinkIfPossible("/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target != "foo" {
+		t.Fail()
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	backend := memfs.NewFs()
+
+	if err := afero.WriteFile(backend, "/foo", []byte("Hello, world!"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := mountMemFs(t, backend)
+	file := path.Join(dir, "foo")
+
+	if err := syscall.Setxattr(file, "user.tag", []byte("important"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	value := make([]byte, 64)
+
+	n, err := syscall.Getxattr(file, "user.tag", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(value[:n]) != "important" {
+		t.Fail()
+	}
+
+	names := make([]byte, 64)
+
+	n, err = syscall.Listxattr(file, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(names[:n]) != "user.tag\x00" {
+		t.Fail()
+	}
+
+	stored, err := backend.GetXattr("/foo", "user.tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(stored) != "important" {
+		t.Fail()
+	}
+
+	if err := syscall.Removexattr(file, "user.tag"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := syscall.Getxattr(file, "user.tag", value); err != syscall.ENODATA {
+		t.Fail()
+	}
+}
@@ -0,0 +1,117 @@
+package filesystem
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/JakWai01/sile-fystem/pkg/trash"
+	"github.com/spf13/afero"
+)
+
+func TestTrashMoveAndRestore(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	if err := fs.MkdirAll("/root/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := afero.WriteFile(fs, "/root/dir/foo", []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := trash.New(fs, "/root")
+
+	if err := tr.Move("/root/dir/foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat("/root/dir/foo"); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	entries, err := tr.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Path != "/dir/foo" {
+		t.FailNow()
+	}
+
+	// Restoring recreates missing parent directories.
+	if err := fs.RemoveAll("/root/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tr.Restore(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(fs, "/root/dir/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "foo" {
+		t.Fail()
+	}
+
+	if entries, err := tr.List(); err != nil || len(entries) != 0 {
+		t.Fail()
+	}
+}
+
+func TestTrashRestoreExisting(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	if err := afero.WriteFile(fs, "/foo", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := trash.New(fs, "")
+
+	if err := tr.Move("/foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := afero.WriteFile(fs, "/foo", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := tr.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tr.Restore(entries[0].ID); !os.IsExist(err) {
+		t.Fail()
+	}
+}
+
+func TestTrashEmpty(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	tr := trash.New(fs, "")
+
+	for _, name := range []string{"/foo", "/bar"} {
+		if err := afero.WriteFile(fs, name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tr.Move(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if removed, err := tr.Empty(time.Now().Add(-time.Hour)); err != nil || removed != 0 {
+		t.Fail()
+	}
+
+	if removed, err := tr.Empty(time.Now()); err != nil || removed != 2 {
+		t.Fail()
+	}
+
+	if entries, err := tr.List(); err != nil || len(entries) != 0 {
+		t.Fail()
+	}
+}
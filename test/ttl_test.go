@@ -0,0 +1,43 @@
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	internal "github.com/JakWai01/sile-fystem/internal/test"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+)
+
+func testNegativeTTL(test *internal.TestSetup, t *testing.T) {
+	filePath := path.Join(test.Dir, "foo")
+
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	// Creating a file through the mount replaces the cached missing name.
+	if err := ioutil.WriteFile(filePath, []byte("taco"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filePath); err != nil {
+		t.Fail()
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	ttl := filesystem.WithCacheTTL(filesystem.CacheTTL{
+		Attributes: time.Second,
+		Entries:    time.Second,
+		Negative:   time.Hour,
+	})
+
+	testOsFs := setupTestingEnvironment(true, ttl)
+	testNegativeTTL(testOsFs, t)
+
+	testMemMapFs := setupTestingEnvironment(false, ttl)
+	testNegativeTTL(testMemMapFs, t)
+}
@@ -0,0 +1,95 @@
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	internal "github.com/JakWai01/sile-fystem/internal/test"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+)
+
+func testVersions(test *internal.TestSetup, t *testing.T) {
+	test.Server.EnableVersioning(filesystem.Retention{
+		Count: 2,
+	})
+
+	filePath := path.Join(test.Dir, "foo")
+
+	for _, content := range []string{"taco", "burrito", "enchilada", "quesadillas"} {
+		if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := ioutil.ReadDir(path.Join(test.Dir, ".versions", "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the two most recent of the three replaced versions are kept.
+	if len(versions) != 2 {
+		t.FailNow()
+	}
+
+	data, err := ioutil.ReadFile(path.Join(test.Dir, ".versions", "foo", versions[1].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "enchilada" {
+		t.Fail()
+	}
+
+	if err := os.Remove(path.Join(test.Dir, ".versions", "foo", versions[0].Name())); err == nil {
+		t.Fail()
+	}
+}
+
+func TestVersions(t *testing.T) {
+	testOsFs := setupTestingEnvironment(true)
+	testVersions(testOsFs, t)
+
+	testMemMapFs := setupTestingEnvironment(false)
+	testVersions(testMemMapFs, t)
+}
+
+func TestVersionsBlockCache(t *testing.T) {
+	test := setupTestingEnvironment(false, filesystem.WithBlockCache(filesystem.BlockCache{BlockSize: 4096}))
+
+	test.Server.EnableVersioning(filesystem.Retention{
+		Count: 2,
+	})
+
+	filePath := path.Join(test.Dir, "foo")
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// The content is only cached until the file is flushed.
+	if _, err := file.Write([]byte("taco")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Truncate(filePath, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := ioutil.ReadDir(path.Join(test.Dir, ".versions", "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 1 {
+		t.FailNow()
+	}
+
+	data, err := ioutil.ReadFile(path.Join(test.Dir, ".versions", "foo", versions[0].Name()))
+	if err != nil || string(data) != "taco" {
+		t.Fail()
+	}
+}
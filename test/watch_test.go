@@ -0,0 +1,162 @@
+package filesystem
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/JakWai01/sile-fystem/internal/logging"
+	"github.com/JakWai01/sile-fystem/pkg/filesystem"
+	"github.com/spf13/afero"
+)
+
+func TestWatchDir(t *testing.T) {
+	test := setupTestingEnvironment(true)
+
+	watcher, err := test.Server.WatchDir(test.TestDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	// The kernel caches that the file doesn't exist yet.
+	if _, err := os.Stat(path.Join(test.Dir, "foo")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	if err := ioutil.WriteFile(path.Join(test.TestDir, "foo"), []byte("taco"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	data, err := ioutil.ReadFile(path.Join(test.Dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "taco" {
+		t.Fail()
+	}
+
+	if err := os.Remove(path.Join(test.TestDir, "foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := os.Stat(path.Join(test.Dir, "foo")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	test := setupTestingEnvironment(true)
+
+	if _, err := os.Stat(path.Join(test.Dir, "foo")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	if err := ioutil.WriteFile(path.Join(test.TestDir, "foo"), []byte("taco"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := test.Server.Invalidate("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(test.Dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "taco" {
+		t.Fail()
+	}
+
+	if err := ioutil.WriteFile(path.Join(test.TestDir, "foo"), []byte("burrito"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := test.Server.Invalidate("/foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = ioutil.ReadFile(path.Join(test.Dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "burrito" {
+		t.Fail()
+	}
+}
+
+func TestInvalidateUnmounted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := afero.NewMemMapFs()
+
+	server := filesystem.New(dir, backend,
+		filesystem.WithRoot("/"),
+		filesystem.WithLogger(logging.NewJSONLogger(*verbosity)),
+	)
+
+	// The kernel isn't notified about changes while nothing is mounted.
+	invalidate := func() {
+		done := make(chan error, 1)
+		go func() {
+			if err := afero.WriteFile(backend, "/foo", []byte("taco"), 0644); err != nil {
+				done <- err
+
+				return
+			}
+
+			if err := server.Invalidate("/"); err != nil {
+				done <- err
+
+				return
+			}
+
+			if err := server.CreateSnapshot("snapshot"); err != nil {
+				done <- err
+
+				return
+			}
+
+			done <- server.DeleteSnapshot("snapshot")
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("invalidating blocked")
+		}
+	}
+
+	invalidate()
+
+	mfs, err := server.Mount(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mfs.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mfs.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	invalidate()
+}